@@ -0,0 +1,299 @@
+package cmstore
+
+import (
+	"context"
+	"errors"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	toolscache "k8s.io/client-go/tools/cache"
+	"sigs.k8s.io/controller-runtime/pkg/cache"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// blobResource is the resource blobs are reported as in errors.
+var blobResource = schema.GroupResource{Group: streamPrefix, Resource: "blobs"}
+
+var errStaleBlob = errors.New("the blob has been modified; please apply your changes to the latest version and try again")
+
+// Blob is a labelled chunk of data, the form partitions and stream elements take no matter what kind of object
+// holds them.
+// Owner references without a kind refer to other blobs of the same backend. Where there's a cluster garbage collector,
+// deleting an owner deletes its dependents.
+type Blob struct {
+	metav1.ObjectMeta
+
+	// Data is the content of the blob.
+	Data []byte
+}
+
+// DeepCopy returns a deep copy of the blob.
+func (b *Blob) DeepCopy() *Blob {
+	if b == nil {
+		return nil
+	}
+
+	out := &Blob{ObjectMeta: *b.ObjectMeta.DeepCopy()}
+	if b.Data != nil {
+		out.Data = make([]byte, len(b.Data))
+		copy(out.Data, b.Data)
+	}
+
+	return out
+}
+
+// Backend keeps the blobs of stores and streams.
+// Errors are reported like the Kubernetes API reports them, so they can be inspected with the apierrors package.
+type Backend interface {
+	// Create creates a blob, naming it after its GenerateName when it has no name, and updates it with the result.
+	Create(ctx context.Context, blob *Blob) error
+	// Get returns the blob with the given name.
+	Get(ctx context.Context, name string) (*Blob, error)
+	// Update replaces a blob and updates it with the result, failing with a conflict if its resourceVersion is stale.
+	Update(ctx context.Context, blob *Blob) error
+	// Delete deletes a blob, failing with a conflict if its UID or resourceVersion, when set, no longer match.
+	Delete(ctx context.Context, blob *Blob) error
+	// List returns the blobs matching a label selector and the resourceVersion they were listed at.
+	List(ctx context.Context, selector labels.Selector) ([]Blob, string, error)
+	// ListMetadata is like List, but leaves out the data of each blob.
+	ListMetadata(ctx context.Context, selector labels.Selector) ([]Blob, string, error)
+	// Watch calls handler with every blob that exists, then with every blob added, updated or deleted.
+	// The returned func reports whether the blobs that existed have all been handled.
+	Watch(ctx context.Context, handler func(blob *Blob, deleted bool)) (toolscache.InformerSynced, error)
+}
+
+// blobKind converts between blobs and a kind of Kubernetes object.
+type blobKind struct {
+	gvk       schema.GroupVersionKind
+	listGVK   schema.GroupVersionKind
+	newObject func() client.Object
+	newList   func() client.ObjectList
+	toBlob    func(obj runtime.Object) (*Blob, bool)
+	fromBlob  func(blob *Blob) client.Object
+}
+
+// configMaps keeps blobs in the binary data of ConfigMaps.
+var configMaps = blobKind{
+	gvk:       corev1.SchemeGroupVersion.WithKind("ConfigMap"),
+	listGVK:   corev1.SchemeGroupVersion.WithKind("ConfigMapList"),
+	newObject: func() client.Object { return &corev1.ConfigMap{} },
+	newList:   func() client.ObjectList { return &corev1.ConfigMapList{} },
+	toBlob: func(obj runtime.Object) (*Blob, bool) {
+		cm, ok := obj.(*corev1.ConfigMap)
+		if !ok {
+			return nil, false
+		}
+
+		return &Blob{ObjectMeta: *cm.ObjectMeta.DeepCopy(), Data: cm.BinaryData[streamObjKey]}, true
+	},
+	fromBlob: func(blob *Blob) client.Object {
+		return &corev1.ConfigMap{
+			ObjectMeta: *blob.ObjectMeta.DeepCopy(),
+			BinaryData: map[string][]byte{
+				streamObjKey: blob.Data,
+			},
+		}
+	},
+}
+
+// secrets keeps blobs in the data of opaque Secrets.
+var secrets = blobKind{
+	gvk:       corev1.SchemeGroupVersion.WithKind("Secret"),
+	listGVK:   corev1.SchemeGroupVersion.WithKind("SecretList"),
+	newObject: func() client.Object { return &corev1.Secret{} },
+	newList:   func() client.ObjectList { return &corev1.SecretList{} },
+	toBlob: func(obj runtime.Object) (*Blob, bool) {
+		secret, ok := obj.(*corev1.Secret)
+		if !ok {
+			return nil, false
+		}
+
+		return &Blob{ObjectMeta: *secret.ObjectMeta.DeepCopy(), Data: secret.Data[streamObjKey]}, true
+	},
+	fromBlob: func(blob *Blob) client.Object {
+		return &corev1.Secret{
+			ObjectMeta: *blob.ObjectMeta.DeepCopy(),
+			Type:       corev1.SecretTypeOpaque,
+			Data: map[string][]byte{
+				streamObjKey: blob.Data,
+			},
+		}
+	},
+}
+
+// kubeBackend keeps blobs in Kubernetes objects of a single kind.
+type kubeBackend struct {
+	client    client.Client
+	informers cache.Informers
+	namespace string
+	kind      blobKind
+}
+
+var _ Backend = &kubeBackend{}
+
+// NewConfigMapBackend returns a backend that keeps blobs in the binary data of ConfigMaps in a namespace.
+// The informers are only needed to watch and must serve ConfigMaps in the namespace.
+func NewConfigMapBackend(client client.Client, informers cache.Informers, namespace string) Backend {
+	return newKubeBackend(client, informers, namespace, configMaps)
+}
+
+// NewSecretBackend returns a backend that keeps blobs in the data of opaque Secrets in a namespace.
+// The informers are only needed to watch and must serve Secrets in the namespace.
+func NewSecretBackend(client client.Client, informers cache.Informers, namespace string) Backend {
+	return newKubeBackend(client, informers, namespace, secrets)
+}
+
+func newKubeBackend(client client.Client, informers cache.Informers, namespace string, kind blobKind) *kubeBackend {
+	return &kubeBackend{
+		client:    client,
+		informers: informers,
+		namespace: namespace,
+		kind:      kind,
+	}
+}
+
+func (b *kubeBackend) Create(ctx context.Context, blob *Blob) error {
+	obj := b.object(blob)
+	if err := b.client.Create(ctx, obj); err != nil {
+		return err
+	}
+
+	return b.into(obj, blob)
+}
+
+func (b *kubeBackend) Get(ctx context.Context, name string) (*Blob, error) {
+	obj := b.kind.newObject()
+	if err := b.client.Get(ctx, client.ObjectKey{Namespace: b.namespace, Name: name}, obj); err != nil {
+		return nil, err
+	}
+
+	blob := &Blob{}
+	return blob, b.into(obj, blob)
+}
+
+func (b *kubeBackend) Update(ctx context.Context, blob *Blob) error {
+	obj := b.object(blob)
+	if err := b.client.Update(ctx, obj); err != nil {
+		return err
+	}
+
+	return b.into(obj, blob)
+}
+
+func (b *kubeBackend) Delete(ctx context.Context, blob *Blob) error {
+	var preconditions client.Preconditions
+	if uid := blob.GetUID(); uid != "" {
+		preconditions.UID = &uid
+	}
+	if rv := blob.GetResourceVersion(); rv != "" {
+		preconditions.ResourceVersion = &rv
+	}
+
+	obj := b.object(blob)
+
+	return b.client.Delete(ctx, obj, preconditions)
+}
+
+func (b *kubeBackend) List(ctx context.Context, selector labels.Selector) ([]Blob, string, error) {
+	list := b.kind.newList()
+	if err := b.client.List(ctx, list, client.InNamespace(b.namespace), client.MatchingLabelsSelector{Selector: selector}); err != nil {
+		return nil, "", err
+	}
+
+	items, err := meta.ExtractList(list)
+	if err != nil {
+		return nil, "", err
+	}
+
+	blobs := make([]Blob, len(items))
+	for i, item := range items {
+		blob, ok := b.kind.toBlob(item)
+		if !ok {
+			return nil, "", errors.New("listed an object of an unexpected kind")
+		}
+		blobs[i] = *blob
+	}
+
+	return blobs, list.GetResourceVersion(), nil
+}
+
+func (b *kubeBackend) ListMetadata(ctx context.Context, selector labels.Selector) ([]Blob, string, error) {
+	list := &metav1.PartialObjectMetadataList{}
+	list.SetGroupVersionKind(b.kind.listGVK)
+	if err := b.client.List(ctx, list, client.InNamespace(b.namespace), client.MatchingLabelsSelector{Selector: selector}); err != nil {
+		return nil, "", err
+	}
+
+	blobs := make([]Blob, len(list.Items))
+	for i, item := range list.Items {
+		blobs[i] = Blob{ObjectMeta: item.ObjectMeta}
+	}
+
+	return blobs, list.GetResourceVersion(), nil
+}
+
+func (b *kubeBackend) Watch(ctx context.Context, handler func(blob *Blob, deleted bool)) (toolscache.InformerSynced, error) {
+	if b.informers == nil {
+		return nil, errors.New("watching requires informers")
+	}
+
+	informer, err := b.informers.GetInformer(ctx, b.kind.newObject())
+	if err != nil {
+		return nil, err
+	}
+
+	handle := func(obj interface{}, deleted bool) {
+		if tombstone, ok := obj.(toolscache.DeletedFinalStateUnknown); ok {
+			obj = tombstone.Obj
+		}
+		o, ok := obj.(runtime.Object)
+		if !ok {
+			return
+		}
+		blob, ok := b.kind.toBlob(o)
+		if !ok || blob.GetNamespace() != b.namespace {
+			return
+		}
+
+		handler(blob, deleted)
+	}
+	informer.AddEventHandler(toolscache.ResourceEventHandlerFuncs{
+		AddFunc:    func(obj interface{}) { handle(obj, false) },
+		UpdateFunc: func(_, obj interface{}) { handle(obj, false) },
+		DeleteFunc: func(obj interface{}) { handle(obj, true) },
+	})
+
+	return informer.HasSynced, nil
+}
+
+// object returns the object holding blob in the backend namespace.
+// Owner references without a kind refer to other blobs, so they're given the kind blobs are kept in.
+func (b *kubeBackend) object(blob *Blob) client.Object {
+	obj := b.kind.fromBlob(blob)
+	obj.SetNamespace(b.namespace)
+
+	refs := obj.GetOwnerReferences()
+	for i := range refs {
+		if refs[i].Kind == "" {
+			refs[i].APIVersion, refs[i].Kind = b.kind.gvk.ToAPIVersionAndKind()
+		}
+	}
+	obj.SetOwnerReferences(refs)
+
+	return obj
+}
+
+// into copies the result of a write or read into blob.
+func (b *kubeBackend) into(obj runtime.Object, blob *Blob) error {
+	result, ok := b.kind.toBlob(obj)
+	if !ok {
+		return errors.New("read an object of an unexpected kind")
+	}
+	*blob = *result
+
+	return nil
+}
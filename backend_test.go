@@ -0,0 +1,108 @@
+package cmstore
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+// testBackend exercises the semantics every Backend shares.
+func testBackend(t *testing.T, backend Backend) {
+	var (
+		ctx     = context.Background()
+		changes []*Blob
+	)
+	if _, err := backend.Watch(ctx, func(blob *Blob, deleted bool) {
+		if deleted {
+			blob = nil
+		}
+		changes = append(changes, blob)
+	}); err != nil {
+		t.Fatalf("Watch failed: %v", err)
+	}
+
+	blob := &Blob{Data: []byte("Hello, world!")}
+	blob.SetGenerateName("partition-")
+	blob.SetLabels(map[string]string{labelKey: "default/my-config"})
+	if err := backend.Create(ctx, blob); err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+	if blob.GetName() == "" || blob.GetUID() == "" || blob.GetResourceVersion() == "" {
+		t.Errorf("expected a name, uid and resource version to be assigned, got %#v", blob.ObjectMeta)
+	}
+	if err := backend.Create(ctx, blob.DeepCopy()); !apierrors.IsAlreadyExists(err) {
+		t.Errorf("expecting already exists error, but get: %v", err)
+	}
+
+	stale := blob.DeepCopy()
+	blob.Data = []byte("Hello again!")
+	if err := backend.Update(ctx, blob); err != nil {
+		t.Fatalf("Update failed: %v", err)
+	}
+	if blob.GetResourceVersion() == stale.GetResourceVersion() {
+		t.Errorf("expected the resource version to change on update")
+	}
+	if err := backend.Update(ctx, stale.DeepCopy()); !apierrors.IsConflict(err) {
+		t.Errorf("expecting conflict error, but get: %v", err)
+	}
+
+	got, err := backend.Get(ctx, blob.GetName())
+	if err != nil {
+		t.Fatalf("Get failed: %v", err)
+	}
+	if !bytes.Equal(got.Data, blob.Data) {
+		t.Errorf("expected %q, got %q", blob.Data, got.Data)
+	}
+
+	other := &Blob{Data: []byte("Goodbye!")}
+	other.SetName("other")
+	if err := backend.Create(ctx, other); err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+
+	blobs, resourceVersion, err := backend.List(ctx, labels.Set{labelKey: "default/my-config"}.AsSelector())
+	if err != nil {
+		t.Fatalf("List failed: %v", err)
+	}
+	if len(blobs) != 1 || blobs[0].GetName() != blob.GetName() {
+		t.Errorf("expected only the labelled blob to be listed, got %v", blobs)
+	}
+	if resourceVersion != other.GetResourceVersion() {
+		t.Errorf("expected the list to be at the latest revision %s, got %s", other.GetResourceVersion(), resourceVersion)
+	}
+
+	blobs, _, err = backend.ListMetadata(ctx, labels.Everything())
+	if err != nil {
+		t.Fatalf("ListMetadata failed: %v", err)
+	}
+	if len(blobs) != 2 || blobs[0].Data != nil || blobs[1].Data != nil {
+		t.Errorf("expected every blob to be listed without data, got %v", blobs)
+	}
+
+	if err := backend.Delete(ctx, stale); !apierrors.IsConflict(err) {
+		t.Errorf("expecting conflict error, but get: %v", err)
+	}
+	if err := backend.Delete(ctx, blob); err != nil {
+		t.Fatalf("Delete failed: %v", err)
+	}
+	if _, err := backend.Get(ctx, blob.GetName()); !apierrors.IsNotFound(err) {
+		t.Errorf("expecting not found error, but get: %v", err)
+	}
+
+	// Every write was seen in order, and new watchers start from what's left
+	if len(changes) != 4 || changes[1] == nil || !bytes.Equal(changes[1].Data, []byte("Hello again!")) || changes[3] != nil {
+		t.Errorf("unexpected changes: %v", changes)
+	}
+	var replayed []string
+	if _, err := backend.Watch(ctx, func(blob *Blob, _ bool) {
+		replayed = append(replayed, blob.GetName())
+	}); err != nil {
+		t.Fatalf("Watch failed: %v", err)
+	}
+	if len(replayed) != 1 || replayed[0] != "other" {
+		t.Errorf("expected the remaining blob to be replayed, got %v", replayed)
+	}
+}
@@ -0,0 +1,177 @@
+package cmstore
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/uuid"
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+const (
+	// ConfigMapDataLimit is the most data a ConfigMap or Secret may hold, keys included.
+	ConfigMapDataLimit = corev1.MaxSecretSize
+	// EtcdRequestLimit is the most bytes etcd accepts in a request by default, which bounds the size of every stored
+	// object.
+	EtcdRequestLimit = 3 * 512 * 1024
+
+	// managedFieldsReserve is set aside in every stored object for the managedFields the API server records on it.
+	managedFieldsReserve = 2 * 1024
+	// encodingReserve is set aside in every stored object for its protobuf envelope and field framing, and for the etcd
+	// key and request framing it's written with.
+	encodingReserve = 512
+)
+
+// BudgetedTransformer is a Transformer that knows how much it adds to what's stored, so the store can pack partitions
+// to a budget.
+type BudgetedTransformer interface {
+	Transformer
+	// Overhead returns the most bytes TransformToStorage adds to the data it transforms, and the length of the longest
+	// key ID it returns.
+	Overhead() (data, keyID int)
+}
+
+// segmentLimiter is implemented by segment streams that bound the bytes each segment written to them may take.
+// Partitioners pack as much data into each segment as fits the limit, in place of their own segment size.
+type segmentLimiter interface {
+	SegmentLimit() int
+}
+
+// SetBudget makes the store pack partitions with as much data as fits in the given number of bytes per stored blob,
+// after base64, metadata, transformation and storage overhead. It's rejected if it exceeds the etcd request limit or
+// leaves no room for data with the transformer set, and transformers set later are checked against it in turn.
+// A zero budget goes back to splitting objects into segments of the partitioner's size.
+func (s *ConfigMapStore) SetBudget(bytes int) error {
+	switch {
+	case bytes < 0:
+		return fmt.Errorf("budget must not be negative")
+	case bytes > EtcdRequestLimit:
+		return fmt.Errorf("budget of %d bytes exceeds the etcd request limit of %d bytes", bytes, EtcdRequestLimit)
+	}
+	if err := s.fits(bytes, s.transformer); err != nil {
+		return err
+	}
+
+	s.budget = bytes
+	return nil
+}
+
+// fits returns an error unless partitions transformed with the given transformer can be fit to a budget.
+func (s *ConfigMapStore) fits(budget int, transformer Transformer) error {
+	if budget < 1 {
+		return nil
+	}
+	if _, ok := transformer.(BudgetedTransformer); transformer != nil && !ok {
+		return fmt.Errorf("transformer %T doesn't report its overhead, so partitions can't be fit to a budget", transformer)
+	}
+
+	// Keys built by the apiserver from a resource prefix, a namespace and a name are well within 1KiB and five levels
+	key := strings.Repeat("/"+strings.Repeat("k", 203), 5)
+	if _, err := segmentCapacity(s.segmentLimit(budget, transformer, key), Zstd); err != nil {
+		return fmt.Errorf("budget of %d bytes can never fit a partition: %v", budget, err)
+	}
+
+	return nil
+}
+
+// segmentLimit returns the most bytes a segment written for key may take to keep the blob storing it within budget
+// once transformed, or zero if there's no budget.
+func (s *ConfigMapStore) segmentLimit(budget int, transformer Transformer, key string) int {
+	if budget < 1 {
+		return 0
+	}
+
+	// ConfigMaps and Secrets limit their data on top of the limit on whole objects
+	limit := budget - s.metadataSize(transformer, key) - managedFieldsReserve - encodingReserve
+	if data := ConfigMapDataLimit - len(streamObjKey); data < limit {
+		limit = data
+	}
+	if budgeted, ok := transformer.(BudgetedTransformer); ok {
+		overhead, _ := budgeted.Overhead()
+		limit -= overhead
+	}
+
+	return limit
+}
+
+// metadataSize returns the most bytes the metadata of a blob stored for key and transformed with the given
+// transformer takes, including what's only set once it's written.
+func (s *ConfigMapStore) metadataSize(transformer Transformer, key string) int {
+	var (
+		blob   = &Blob{}
+		digits = len(strconv.FormatInt(math.MaxInt64, 10))
+		uid    = uuid.NewUUID()
+	)
+	// Segments have the longest names of the blobs data is stored in
+	blob.SetName(segmentName(nil))
+	blob.SetNamespace(strings.Repeat("n", validation.DNS1123LabelMaxLength))
+	blob.SetUID(uid)
+	blob.SetResourceVersion(strconv.FormatUint(math.MaxUint64, 10))
+	blob.SetCreationTimestamp(metav1.Now())
+	blob.SetOwnerReferences([]metav1.OwnerReference{{
+		APIVersion: corev1.SchemeGroupVersion.String(),
+		Kind:       "ConfigMap",
+		Name:       manifestName(key),
+		UID:        uid,
+	}})
+
+	blob.SetAnnotations(map[string]string{
+		positionAnnotationKey:   strings.Repeat("9", digits),
+		countAnnotationKey:      strings.Repeat("9", digits),
+		generationAnnotationKey: string(uid),
+		expiresAnnotationKey:    time.Now().UTC().Format(time.RFC3339),
+		// Every supported compression has a name of the same length
+		compressionAnnotationKey: string(Zstd),
+	})
+	s.stamp(key, blob)
+	if budgeted, ok := transformer.(BudgetedTransformer); ok {
+		_, keyID := budgeted.Overhead()
+		blob.Annotations[keyIDAnnotationKey] = strings.Repeat("k", keyID)
+	}
+	if s.contentAddressable {
+		blob.Annotations[refsAnnotationKey] = strings.Repeat("9", digits)
+		blob.Annotations[acquiredAnnotationKey] = blob.Annotations[expiresAnnotationKey]
+	}
+
+	return blob.ObjectMeta.Size()
+}
+
+// segmentCapacity returns the most data a segment written with the given compression can hold within limit bytes,
+// once base64 encoded and wrapped in its envelope.
+func segmentCapacity(limit int, compression Compression) (int, error) {
+	envelope, err := json.Marshal(SimpleSegment{
+		Position:    math.MaxUint32,
+		Data:        []byte{},
+		Compression: compression,
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	// The encoder ends every segment with a newline
+	encoded := limit - len(envelope) - 1
+	capacity := base64.StdEncoding.DecodedLen(encoded - encoded%4)
+	if capacity < 1 {
+		return 0, fmt.Errorf("a limit of %d bytes per segment leaves no room for data", limit)
+	}
+
+	return capacity, nil
+}
+
+// encodedSegmentSize returns the most bytes a segment of the given size and compression takes once written.
+func encodedSegmentSize(segmentSize int, compression Compression) int {
+	envelope, _ := json.Marshal(SimpleSegment{
+		Position:    math.MaxUint32,
+		Data:        []byte{},
+		Compression: compression,
+	})
+
+	return len(envelope) + base64.StdEncoding.EncodedLen(segmentSize) + 1
+}
@@ -0,0 +1,162 @@
+package cmstore
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"math/rand"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apiserver/pkg/storage"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// opaqueTransformer is a Transformer that doesn't report its overhead.
+type opaqueTransformer struct{}
+
+func (opaqueTransformer) TransformToStorage(data, _ []byte) ([]byte, string, error) {
+	return data, "opaque", nil
+}
+
+func (opaqueTransformer) TransformFromStorage(data, _ []byte, _ string) ([]byte, bool, error) {
+	return data, false, nil
+}
+
+// budgetedTransformer is a BudgetedTransformer that reports the given overhead.
+type budgetedTransformer struct {
+	opaqueTransformer
+	overhead int
+}
+
+func (t budgetedTransformer) Overhead() (int, int) {
+	return t.overhead, 0
+}
+
+func TestBudget(t *testing.T) {
+	var (
+		ctx    = context.Background()
+		c      = newTestClient(t)
+		store  = newTestStore(c)
+		key    = "default/my-config"
+		in     = &corev1.ConfigMap{}
+		budget = 16 * 1024
+	)
+	keyring, err := NewKeyring(Key{Name: "key1", Secret: []byte("abcdefghijklmnop")})
+	if err != nil {
+		t.Fatalf("NewKeyring failed: %v", err)
+	}
+	if err := store.SetTransformer(keyring); err != nil {
+		t.Fatalf("SetTransformer failed: %v", err)
+	}
+
+	// Budgets that can never be stored are rejected
+	for _, invalid := range []int{-1, 1024, EtcdRequestLimit + 1} {
+		if err := store.SetBudget(invalid); err == nil {
+			t.Errorf("expected a budget of %d bytes to be rejected", invalid)
+		}
+	}
+	if err := store.SetTransformer(opaqueTransformer{}); err != nil {
+		t.Fatalf("SetTransformer failed: %v", err)
+	}
+	if err := store.SetBudget(budget); err == nil {
+		t.Errorf("expected a budget to be rejected for a transformer that doesn't report its overhead")
+	}
+	if err := store.SetTransformer(keyring); err != nil {
+		t.Fatalf("SetTransformer failed: %v", err)
+	}
+	if err := store.SetBudget(budget); err != nil {
+		t.Fatalf("SetBudget failed: %v", err)
+	}
+
+	// So are transformers set later that can't fit it
+	for _, transformer := range []Transformer{opaqueTransformer{}, budgetedTransformer{overhead: budget}} {
+		if err := store.SetTransformer(transformer); err == nil {
+			t.Errorf("expected transformer %T to be rejected for the budget", transformer)
+		}
+	}
+	if store.transformer != keyring {
+		t.Fatalf("expected the keyring to be kept")
+	}
+
+	// Random data doesn't compress, so it takes several partitions once base64 encoded
+	data := make([]byte, 4*budget)
+	rand.New(rand.NewSource(0)).Read(data)
+	in.SetName("my-config")
+	in.BinaryData = map[string][]byte{"random": data}
+	if err := store.Create(ctx, key, in, nil, 0); err != nil {
+		t.Fatalf("Set failed: %v", err)
+	}
+
+	stored := &corev1.ConfigMapList{}
+	if err := c.List(ctx, stored, client.InNamespace("storage"), client.MatchingLabels{labelKey: keyLabel(key)}); err != nil {
+		t.Fatalf("failed to list ConfigMaps: %v", err)
+	}
+	var (
+		partitions int
+		packed     int
+	)
+	for i := range stored.Items {
+		cm := &stored.Items[i]
+		if isManifest(cm) {
+			continue
+		}
+
+		// Every stored object fits, with room for what the API server adds
+		partitions++
+		if size := cm.Size() + managedFieldsReserve + encodingReserve; size > budget {
+			t.Errorf("expected partition %s to fit in %d bytes, takes %d", cm.GetName(), budget, size)
+		}
+		// And all but the last are packed full, short of the worst case metadata they might have had
+		if cm.Size()+managedFieldsReserve+encodingReserve > budget-512 {
+			packed++
+		}
+	}
+	if partitions < 4 || packed < partitions-1 {
+		t.Errorf("expected %d partitions to be packed full, got %d", partitions-1, packed)
+	}
+
+	out := &corev1.ConfigMap{}
+	if err := store.Get(ctx, key, storage.GetOptions{}, out); err != nil || !bytes.Equal(out.BinaryData["random"], data) {
+		t.Errorf("expected to read the object back: %v", err)
+	}
+}
+
+func TestSegmentCapacity(t *testing.T) {
+	for _, compression := range []Compression{NoCompression, Gzip, Zstd} {
+		for _, limit := range []int{64, 1000, 1023, 4096} {
+			capacity, err := segmentCapacity(limit, compression)
+			if err != nil {
+				t.Fatalf("segmentCapacity failed: %v", err)
+			}
+
+			// Segments at capacity fit the limit, and one more byte of base64 would overflow it
+			if size := encodedSegmentSize(capacity, compression); size > limit || size+4 <= limit {
+				t.Errorf("expected %d bytes of %q data to be packed into %d bytes, takes %d", capacity, compression, limit, size)
+			}
+		}
+
+		if _, err := segmentCapacity(32, compression); err == nil {
+			t.Errorf("expected a limit too small for the envelope to leave no room for %q data", compression)
+		}
+	}
+
+	// Written segments stay within the limit
+	var w partitionWriter
+	w.limit = 256
+	if err := writeSegments(bytes.Repeat([]byte("a"), 4096), 4096, NoCompression, &w); err != nil {
+		t.Fatalf("writeSegments failed: %v", err)
+	}
+	capacity, _ := segmentCapacity(w.limit, NoCompression)
+	if expected := (4096 + capacity - 1) / capacity; len(w.partitions) != expected {
+		t.Errorf("expected %d segments, got %d", expected, len(w.partitions))
+	}
+	for _, p := range w.partitions {
+		if len(p.Data) > w.limit {
+			t.Errorf("expected segments within %d bytes, got %d", w.limit, len(p.Data))
+		}
+	}
+	if encoded := base64.StdEncoding.EncodedLen(capacity); encoded <= w.limit-64 {
+		t.Errorf("expected segments packed close to %d bytes, got %d bytes of base64", w.limit, encoded)
+	}
+}
@@ -0,0 +1,393 @@
+package cmstore
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/conversion"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/apiserver/pkg/storage"
+)
+
+// defaultCacheHistory is the number of events a Cacher keeps for watches to resume from when none is configured.
+const defaultCacheHistory = 100
+
+// CacheOptions configures a Cacher.
+type CacheOptions struct {
+	// History is the number of events kept for watches to resume from.
+	// Watches from a version older than the oldest event kept are expired.
+	// Defaults to 100.
+	History int
+}
+
+// cachedObject is an object kept by a Cacher, along with the manifest committing it.
+type cachedObject struct {
+	obj       runtime.Object
+	committed *Blob
+}
+
+// Cacher is a storage.Interface that serves reads and watches from the objects of a ConfigMapStore kept in memory, in
+// the vein of the API server's watch cache. It's fed by the informer the store already watches partitions with, and
+// writes go straight through to the store.
+// Reads without a resourceVersion are consistent, so they bypass the cache, as do reads at a version the cache hasn't
+// observed yet and paginated or exact lists.
+type Cacher struct {
+	store   *ConfigMapStore
+	history int
+
+	startMu    sync.Mutex
+	subscribed bool
+	synced     bool
+
+	mu      sync.RWMutex
+	objects map[string]cachedObject
+	// version is the latest version observed.
+	version uint64
+	// events are the latest changes, oldest first, and oldest is the version they start after.
+	events   []change
+	oldest   uint64
+	watchers map[*watcher]uint64
+}
+
+var _ storage.Interface = &Cacher{}
+
+// NewCacher returns a Cacher in front of the given store.
+// Nothing is cached until it's first read from or watched.
+func NewCacher(store *ConfigMapStore, opts CacheOptions) *Cacher {
+	history := opts.History
+	if history < 1 {
+		history = defaultCacheHistory
+	}
+
+	return &Cacher{
+		store:    store,
+		history:  history,
+		objects:  map[string]cachedObject{},
+		watchers: map[*watcher]uint64{},
+	}
+}
+
+// start subscribes to the changes the store observes, if it isn't already, and waits for the objects that exist to be
+// cached.
+func (c *Cacher) start(ctx context.Context) error {
+	c.startMu.Lock()
+	defer c.startMu.Unlock()
+
+	if !c.subscribed {
+		c.store.watchers.subscribe(c)
+		c.subscribed = true
+	}
+	if c.synced {
+		return nil
+	}
+
+	if err := c.store.watchers.start(ctx); err != nil {
+		return err
+	}
+
+	// What was observed while syncing is the state of the world rather than a history of it
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.events, c.oldest = nil, c.version
+	c.synced = true
+
+	return nil
+}
+
+func (c *Cacher) changed(ch change) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if ch.cur == nil {
+		delete(c.objects, ch.key)
+	} else {
+		c.objects[ch.key] = cachedObject{obj: ch.cur, committed: ch.committed}
+	}
+	if ch.version > c.version {
+		c.version = ch.version
+	}
+
+	c.events = append(c.events, ch)
+	if len(c.events) > c.history {
+		c.oldest = c.events[0].version
+		c.events = c.events[1:]
+	}
+
+	fanOut(c.watchers, ch)
+}
+
+func (c *Cacher) observed(version uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if version > c.version {
+		c.version = version
+	}
+}
+
+// cached returns the unexpired object cached for key, if any.
+// Callers must hold the lock.
+func (c *Cacher) cached(key string) (runtime.Object, bool) {
+	cached, ok := c.objects[key]
+	if !ok || c.store.expired(cached.committed) {
+		return nil, false
+	}
+
+	return cached.obj, true
+}
+
+// fresh returns true if the cache has observed the requested resourceVersion, starting it if need be.
+// Callers must not hold the lock.
+func (c *Cacher) fresh(ctx context.Context, resourceVersion string) (bool, error) {
+	requested, err := c.store.versioner.ParseResourceVersion(resourceVersion)
+	if err != nil {
+		return false, apierrors.NewBadRequest(fmt.Sprintf("invalid resource version: %v", err))
+	}
+
+	if err := c.start(ctx); err != nil {
+		return false, err
+	}
+
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	return requested <= c.version, nil
+}
+
+func (c *Cacher) Versioner() storage.Versioner {
+	return c.store.Versioner()
+}
+
+func (c *Cacher) Create(ctx context.Context, key string, obj, out runtime.Object, ttl uint64) error {
+	return c.store.Create(ctx, key, obj, out, ttl)
+}
+
+func (c *Cacher) Delete(ctx context.Context, key string, out runtime.Object, preconditions *storage.Preconditions, validateDeletion storage.ValidateObjectFunc) error {
+	return c.store.Delete(ctx, key, out, preconditions, validateDeletion)
+}
+
+// GuaranteedUpdate suggests the cached object to the store when the caller doesn't, so it's only read back when the
+// cache is behind.
+func (c *Cacher) GuaranteedUpdate(ctx context.Context, key string, ptrToType runtime.Object, ignoreNotFound bool, preconditions *storage.Preconditions, tryUpdate storage.UpdateFunc, suggestion ...runtime.Object) error {
+	if len(suggestion) < 1 || suggestion[0] == nil {
+		c.mu.RLock()
+		if obj, ok := c.cached(key); ok {
+			suggestion = []runtime.Object{obj}
+		}
+		c.mu.RUnlock()
+	}
+
+	return c.store.GuaranteedUpdate(ctx, key, ptrToType, ignoreNotFound, preconditions, tryUpdate, suggestion...)
+}
+
+func (c *Cacher) Count(key string) (int64, error) {
+	return c.store.Count(key)
+}
+
+func (c *Cacher) Watch(ctx context.Context, key string, opts storage.ListOptions) (watch.Interface, error) {
+	return c.watch(ctx, key, false, opts.ResourceVersion, opts.Predicate)
+}
+
+func (c *Cacher) WatchList(ctx context.Context, key string, opts storage.ListOptions) (watch.Interface, error) {
+	return c.watch(ctx, key, true, opts.ResourceVersion, opts.Predicate)
+}
+
+// watch registers a new watcher for key, first replaying the events kept since the given resourceVersion, or the
+// cached state of matching objects without one.
+// Watches from a version the cache hasn't observed yet start right away, since only later events are sent to them.
+func (c *Cacher) watch(ctx context.Context, key string, recursive bool, resourceVersion string, pred storage.SelectionPredicate) (watch.Interface, error) {
+	since, err := c.store.versioner.ParseResourceVersion(resourceVersion)
+	if err != nil {
+		return nil, apierrors.NewBadRequest(fmt.Sprintf("invalid resource version: %v", err))
+	}
+
+	if err := c.start(ctx); err != nil {
+		return nil, err
+	}
+
+	w := newWatcher(key, recursive, pred, c.store.versioner, c.remove)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var initial []change
+	switch {
+	case since == 0:
+		// Start from the current state of the world
+		for _, k := range c.keys(w.interested) {
+			obj, _ := c.cached(k)
+			initial = append(initial, change{key: k, cur: obj})
+		}
+	case since < c.oldest:
+		return nil, apierrors.NewResourceExpired(fmt.Sprintf("too old resource version: %d (%d)", since, c.oldest))
+	default:
+		for _, ch := range c.events {
+			if ch.version > since && w.interested(ch.key) {
+				initial = append(initial, ch)
+			}
+		}
+	}
+	c.watchers[w] = since
+
+	go w.run(ctx, initial)
+
+	return w, nil
+}
+
+func (c *Cacher) remove(w *watcher) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	delete(c.watchers, w)
+}
+
+// keys returns the sorted keys of the unexpired objects cached for which match returns true.
+// Callers must hold the lock.
+func (c *Cacher) keys(match func(key string) bool) []string {
+	var keys []string
+	for k := range c.objects {
+		if _, ok := c.cached(k); ok && match(k) {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+
+	return keys
+}
+
+func (c *Cacher) Get(ctx context.Context, key string, opts storage.GetOptions, objPtr runtime.Object) error {
+	if opts.ResourceVersion == "" {
+		return c.store.Get(ctx, key, opts, objPtr)
+	}
+
+	fresh, err := c.fresh(ctx, opts.ResourceVersion)
+	if err != nil {
+		return err
+	}
+	if !fresh {
+		// The cache is behind, read through to the store
+		return c.store.Get(ctx, key, opts, objPtr)
+	}
+
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	obj, ok := c.cached(key)
+	switch {
+	case ok:
+		return into(obj, objPtr)
+	case opts.IgnoreNotFound:
+		return runtime.SetZeroValue(objPtr)
+	}
+
+	return storage.NewKeyNotFoundError(key, int64(c.version))
+}
+
+func (c *Cacher) GetToList(ctx context.Context, key string, opts storage.ListOptions, listObj runtime.Object) error {
+	return c.list(ctx, key, opts, listObj, c.store.GetToList, func(k string) bool {
+		return k == key
+	})
+}
+
+func (c *Cacher) List(ctx context.Context, key string, opts storage.ListOptions, listObj runtime.Object) error {
+	// Only list objects below the key, treating it as a directory
+	prefix := key
+	if !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+
+	return c.list(ctx, key, opts, listObj, c.store.List, func(k string) bool {
+		return strings.HasPrefix(k, prefix)
+	})
+}
+
+// list sets listObj to the cached objects whose key match returns true that match the predicate, at the latest version
+// observed. Lists the cache can't serve are read through to the store with fromStore.
+func (c *Cacher) list(ctx context.Context, key string, opts storage.ListOptions, listObj runtime.Object, fromStore func(context.Context, string, storage.ListOptions, runtime.Object) error, match func(key string) bool) error {
+	if delegateList(opts) {
+		return fromStore(ctx, key, opts, listObj)
+	}
+
+	fresh, err := c.fresh(ctx, opts.ResourceVersion)
+	if err != nil {
+		return err
+	}
+	if !fresh {
+		// The cache is behind, read through to the store
+		return fromStore(ctx, key, opts, listObj)
+	}
+
+	newItem, err := newListItemFunc(listObj)
+	if err != nil {
+		return err
+	}
+
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	var items []runtime.Object
+	for _, k := range c.keys(match) {
+		obj, _ := c.cached(k)
+		matches, err := opts.Predicate.Matches(obj)
+		if err != nil {
+			return err
+		}
+		if !matches {
+			continue
+		}
+
+		item := newItem()
+		if err := into(obj, item); err != nil {
+			return err
+		}
+		items = append(items, item)
+	}
+
+	if err := meta.SetList(listObj, items); err != nil {
+		return err
+	}
+
+	return c.store.versioner.UpdateList(listObj, c.version, "", nil)
+}
+
+// delegateList returns true if a list must be read from the store: consistent lists, those continuing or limited to
+// a page of another, and those that must match a version exactly.
+func delegateList(opts storage.ListOptions) bool {
+	switch {
+	case opts.ResourceVersion == "":
+		return true
+	case opts.Predicate.Continue != "":
+		return true
+	case opts.Predicate.Limit > 0 && opts.ResourceVersion != "0":
+		return true
+	case opts.ResourceVersionMatch != "" && opts.ResourceVersionMatch != metav1.ResourceVersionMatchNotOlderThan:
+		return true
+	}
+
+	return false
+}
+
+// into sets objPtr to a copy of a cached object.
+func into(obj, objPtr runtime.Object) error {
+	v, err := conversion.EnforcePtr(objPtr)
+	if err != nil {
+		return err
+	}
+
+	copied := reflect.ValueOf(obj.DeepCopyObject())
+	if !copied.Elem().Type().AssignableTo(v.Type()) {
+		return fmt.Errorf("can't set a %v to a cached %v", v.Type(), copied.Elem().Type())
+	}
+	v.Set(copied.Elem())
+
+	return nil
+}
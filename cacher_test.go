@@ -0,0 +1,182 @@
+package cmstore
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/apiserver/pkg/storage"
+)
+
+func TestCacher(t *testing.T) {
+	var (
+		ctx     = context.Background()
+		backend = &selectingBackend{Backend: NewMemoryBackend()}
+		store   = NewBackendStore(backend, NewPartitioner(64), func() runtime.Object { return &corev1.ConfigMap{} })
+		cacher  = NewCacher(store, CacheOptions{History: 4})
+	)
+	create := func(name, greeting string) string {
+		in, out := &corev1.ConfigMap{}, &corev1.ConfigMap{}
+		in.SetName(name)
+		in.Data = map[string]string{"greeting": greeting}
+		if err := cacher.Create(ctx, "default/"+name, in, out, 0); err != nil {
+			t.Fatalf("Set failed: %v", err)
+		}
+
+		return out.GetResourceVersion()
+	}
+	update := func(name, greeting string) {
+		if err := cacher.GuaranteedUpdate(ctx, "default/"+name, &corev1.ConfigMap{}, false, nil, func(input runtime.Object, _ storage.ResponseMeta) (runtime.Object, *uint64, error) {
+			cm := input.(*corev1.ConfigMap)
+			cm.Data["greeting"] = greeting
+			return cm, nil, nil
+		}); err != nil {
+			t.Fatalf("GuaranteedUpdate failed: %v", err)
+		}
+	}
+	get := func(name, resourceVersion string) (*corev1.ConfigMap, int) {
+		backend.listed = nil
+		out := &corev1.ConfigMap{}
+		if err := cacher.Get(ctx, "default/"+name, storage.GetOptions{ResourceVersion: resourceVersion}, out); err != nil {
+			t.Fatalf("Get failed: %v", err)
+		}
+
+		return out, len(backend.listed)
+	}
+
+	if err := cacher.start(ctx); err != nil {
+		t.Fatalf("failed to start cache: %v", err)
+	}
+	created := create("config-a", "Hello, a!")
+	create("config-b", "Hello, b!")
+
+	// Reads at any version are served from the cache, consistent reads from the store
+	if out, listed := get("config-a", "0"); out.Data["greeting"] != "Hello, a!" || listed != 0 {
+		t.Errorf("expected a cached read, got %q after listing %d blobs", out.Data["greeting"], listed)
+	}
+	if out, listed := get("config-a", ""); out.Data["greeting"] != "Hello, a!" || listed == 0 {
+		t.Errorf("expected a consistent read to bypass the cache, got %q", out.Data["greeting"])
+	}
+	// So are reads at versions the cache hasn't observed yet
+	if err := cacher.Get(ctx, "default/config-a", storage.GetOptions{ResourceVersion: "1000"}, &corev1.ConfigMap{}); !storage.IsTooLargeResourceVersion(err) {
+		t.Errorf("expected a read ahead of the cache to be read through, got %v", err)
+	}
+	if err := cacher.Get(ctx, "default/missing", storage.GetOptions{ResourceVersion: "0"}, &corev1.ConfigMap{}); !storage.IsNotFound(err) {
+		t.Errorf("expected a missing object not to be found, got %v", err)
+	}
+
+	backend.listed = nil
+	list := &corev1.ConfigMapList{}
+	if err := cacher.List(ctx, "default", storage.ListOptions{ResourceVersion: "0", Predicate: storage.Everything}, list); err != nil {
+		t.Fatalf("List failed: %v", err)
+	}
+	if len(list.Items) != 2 || list.Items[0].GetName() != "config-a" || list.Items[1].GetName() != "config-b" || len(backend.listed) != 0 {
+		t.Errorf("expected both objects to be listed from the cache, got %d after listing %d blobs", len(list.Items), len(backend.listed))
+	}
+	if _, listed := get("config-b", list.GetResourceVersion()); listed != 0 {
+		t.Errorf("expected a read at the listed version to be cached")
+	}
+
+	// Cached objects are copies
+	out, _ := get("config-a", "0")
+	out.Data["greeting"] = "Goodbye!"
+	if out, _ = get("config-a", "0"); out.Data["greeting"] != "Hello, a!" {
+		t.Errorf("expected the cached object to be left alone, got %q", out.Data["greeting"])
+	}
+
+	// Watches fan out from the cache, each resuming from the history
+	var watchers []watch.Interface
+	for i := 0; i < 2; i++ {
+		w, err := cacher.WatchList(ctx, "default", storage.ListOptions{ResourceVersion: created, Predicate: storage.Everything})
+		if err != nil {
+			t.Fatalf("Watch failed: %v", err)
+		}
+		defer w.Stop()
+		watchers = append(watchers, w)
+	}
+	update("config-a", "Hello again, a!")
+	for _, w := range watchers {
+		expectEvent(t, w, watch.Added, "Hello, b!")
+		expectEvent(t, w, watch.Modified, "Hello again, a!")
+		expectNoEvent(t, w)
+	}
+	if out, listed := get("config-a", "0"); out.Data["greeting"] != "Hello again, a!" || listed != 0 {
+		t.Errorf("expected the cache to follow the update, got %q", out.Data["greeting"])
+	}
+
+	if err := cacher.Delete(ctx, "default/config-b", &corev1.ConfigMap{}, nil, storage.ValidateAllObjectFunc); err != nil {
+		t.Fatalf("Delete failed: %v", err)
+	}
+	for _, w := range watchers {
+		expectEvent(t, w, watch.Deleted, "Hello, b!")
+	}
+	if err := cacher.Get(ctx, "default/config-b", storage.GetOptions{ResourceVersion: "0"}, &corev1.ConfigMap{}); !storage.IsNotFound(err) {
+		t.Errorf("expected the deleted object to be gone from the cache, got %v", err)
+	}
+
+	// Watches from before the history window are expired
+	for i := 0; i < 4; i++ {
+		update("config-a", fmt.Sprintf("Hello %d, a!", i))
+	}
+	if _, err := cacher.Watch(ctx, "default/config-a", storage.ListOptions{ResourceVersion: created, Predicate: storage.Everything}); !apierrors.IsResourceExpired(err) {
+		t.Errorf("expected a watch from before the history to be expired, got %v", err)
+	}
+	w, err := cacher.Watch(ctx, "default/config-a", storage.ListOptions{ResourceVersion: "0", Predicate: storage.Everything})
+	if err != nil {
+		t.Fatalf("Watch failed: %v", err)
+	}
+	defer w.Stop()
+	expectEvent(t, w, watch.Added, "Hello 3, a!")
+	expectNoEvent(t, w)
+}
+
+func TestCacherDeleteVersion(t *testing.T) {
+	var (
+		ctx    = context.Background()
+		store  = NewBackendStore(NewMemoryBackend(), NewPartitioner(64), func() runtime.Object { return &corev1.ConfigMap{} })
+		cacher = NewCacher(store, CacheOptions{})
+		in     = &corev1.ConfigMap{}
+	)
+	if err := cacher.start(ctx); err != nil {
+		t.Fatalf("failed to start cache: %v", err)
+	}
+	in.SetName("my-config")
+	in.Data = map[string]string{"greeting": "Hello, world!"}
+	if err := cacher.Create(ctx, "default/my-config", in, nil, 0); err != nil {
+		t.Fatalf("Set failed: %v", err)
+	}
+
+	// Deletions are seen by watches from the version the deleted object was listed at
+	list := &corev1.ConfigMapList{}
+	if err := cacher.List(ctx, "default", storage.ListOptions{ResourceVersion: "0", Predicate: storage.Everything}, list); err != nil {
+		t.Fatalf("List failed: %v", err)
+	}
+	w, err := cacher.WatchList(ctx, "default", storage.ListOptions{ResourceVersion: list.GetResourceVersion(), Predicate: storage.Everything})
+	if err != nil {
+		t.Fatalf("Watch failed: %v", err)
+	}
+	defer w.Stop()
+	if err := cacher.Delete(ctx, "default/my-config", &corev1.ConfigMap{}, nil, storage.ValidateAllObjectFunc); err != nil {
+		t.Fatalf("Delete failed: %v", err)
+	}
+
+	select {
+	case event := <-w.ResultChan():
+		deleted, err := store.versioner.ObjectResourceVersion(event.Object)
+		if err != nil {
+			t.Fatalf("failed to version the deleted object: %v", err)
+		}
+		listed, _ := store.versioner.ParseResourceVersion(list.GetResourceVersion())
+		if event.Type != watch.Deleted || deleted <= listed {
+			t.Errorf("expected a deletion after version %d, got a %s event at %d", listed, event.Type, deleted)
+		}
+	case <-time.After(wait.ForeverTestTimeout):
+		t.Fatalf("timed out waiting for the deletion")
+	}
+}
@@ -0,0 +1,87 @@
+package cmstore
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io/ioutil"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Compression is an algorithm data is compressed with before it's stored.
+type Compression string
+
+const (
+	// NoCompression stores data as is.
+	NoCompression Compression = ""
+	// Gzip compresses data with gzip.
+	Gzip Compression = "gzip"
+	// Zstd compresses data with Zstandard.
+	Zstd Compression = "zstd"
+)
+
+// Validate returns an error if the compression algorithm isn't supported.
+func (c Compression) Validate() error {
+	switch c {
+	case NoCompression, Gzip, Zstd:
+		return nil
+	}
+
+	return fmt.Errorf("unsupported compression %q", string(c))
+}
+
+// compress returns data compressed with the algorithm.
+func (c Compression) compress(data []byte) ([]byte, error) {
+	switch c {
+	case NoCompression:
+		return data, nil
+	case Gzip:
+		var buf bytes.Buffer
+		w := gzip.NewWriter(&buf)
+		if _, err := w.Write(data); err != nil {
+			return nil, err
+		}
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+
+		return buf.Bytes(), nil
+	case Zstd:
+		w, err := zstd.NewWriter(nil)
+		if err != nil {
+			return nil, err
+		}
+		defer w.Close()
+
+		return w.EncodeAll(data, nil), nil
+	}
+
+	return nil, c.Validate()
+}
+
+// decompress returns the data that was compressed with the algorithm.
+func (c Compression) decompress(data []byte) ([]byte, error) {
+	switch c {
+	case NoCompression:
+		return data, nil
+	case Gzip:
+		r, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		defer r.Close()
+
+		return ioutil.ReadAll(r)
+	case Zstd:
+		r, err := zstd.NewReader(nil)
+		if err != nil {
+			return nil, err
+		}
+		defer r.Close()
+
+		return r.DecodeAll(data, nil)
+	}
+
+	return nil, c.Validate()
+}
@@ -0,0 +1,2076 @@
+package cmstore
+
+// The cases below are ported from the etcd3 storage.Interface tests in k8s.io/apiserver/pkg/storage/etcd3 (v0.19.2),
+// Copyright The Kubernetes Authors, licensed under the Apache License 2.0.
+//
+// They're adapted where ConfigMapStore knowingly differs from etcd3:
+// - only the latest state is kept, so exact reads of older resourceVersions are expired rather than served
+// - transformers record their key per partition rather than wrapping values, so the stale transformer cases are
+//   covered by transform_test.go instead
+// - paging can't be disabled, so those cases are left out
+// - there's no etcd client to count reads with, so ListContinuationWithFilter only checks the pages it returns
+// - ConsistentList can't create objects while listing, since the exact list that follows would be expired rather than
+//   served from a snapshot, so its objects are all created up front
+// - watches don't have an error channel, so WatchErrResultNotBlockAfterCancel blocks the watcher on a change instead
+// - partitioners don't take a codec that can be made to fail, so WatchError's store fails to transform what it watches
+//   instead of failing to decode it
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/apimachinery/pkg/watch"
+	examplev1 "k8s.io/apiserver/pkg/apis/example/v1"
+	"k8s.io/apiserver/pkg/storage"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+// conformanceScheme is the fixed scheme of the client partitions are written through.
+var conformanceScheme = runtime.NewScheme()
+
+func init() {
+	utilruntime.Must(corev1.AddToScheme(conformanceScheme))
+}
+
+// conformanceBackend returns the backend a conformance test stores its objects in.
+type conformanceBackend func(t *testing.T) Backend
+
+// newConformanceStore returns a store for example pods, with its reaper running until the test ends.
+func newConformanceStore(t *testing.T, newBackend conformanceBackend) (context.Context, *ConfigMapStore) {
+	store := NewBackendStore(newBackend(t), NewPartitioner(64), func() runtime.Object {
+		return &examplev1.Pod{}
+	})
+	store.reapPeriod = 100 * time.Millisecond
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	go store.Start(ctx)
+
+	return ctx, store
+}
+
+// newRevisionedBackend returns a ConfigMap backend whose client hands out cluster-wide resourceVersions.
+func newRevisionedBackend(t *testing.T) Backend {
+	c, informers := newTestInformers(&revisionedClient{
+		Client:    fake.NewFakeClientWithScheme(conformanceScheme),
+		revisions: map[types.NamespacedName]revision{},
+	})
+
+	return NewConfigMapBackend(c, informers, "storage")
+}
+
+// revisionedClient hands out resourceVersions from a single, cluster-wide revision like the API server does.
+// The fake client it wraps versions each object on its own, so the versions of different objects can't be compared.
+type revisionedClient struct {
+	client.Client
+
+	mu        sync.Mutex
+	revision  uint64
+	revisions map[types.NamespacedName]revision
+}
+
+// revision maps the resourceVersion the fake client gave an object to the cluster-wide revision it was written at.
+type revision struct {
+	fake    string
+	cluster uint64
+}
+
+func (c *revisionedClient) Get(ctx context.Context, key client.ObjectKey, obj client.Object) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if err := c.Client.Get(ctx, key, obj); err != nil {
+		return err
+	}
+	c.translate(obj)
+
+	return nil
+}
+
+func (c *revisionedClient) List(ctx context.Context, list client.ObjectList, opts ...client.ListOption) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if err := c.Client.List(ctx, list, opts...); err != nil {
+		return err
+	}
+	if err := meta.EachListItem(list, func(obj runtime.Object) error {
+		accessor, err := meta.Accessor(obj)
+		if err != nil {
+			return err
+		}
+		c.translate(accessor)
+
+		return nil
+	}); err != nil {
+		return err
+	}
+	list.SetResourceVersion(strconv.FormatUint(c.revision, 10))
+
+	return nil
+}
+
+func (c *revisionedClient) Create(ctx context.Context, obj client.Object, opts ...client.CreateOption) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if err := c.Client.Create(ctx, obj, opts...); err != nil {
+		return err
+	}
+	c.record(obj)
+
+	return nil
+}
+
+func (c *revisionedClient) Update(ctx context.Context, obj client.Object, opts ...client.UpdateOption) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	requested := obj.GetResourceVersion()
+	if current, ok := c.revisions[client.ObjectKeyFromObject(obj)]; ok && requested != "" {
+		if requested != strconv.FormatUint(current.cluster, 10) {
+			return apierrors.NewConflict(corev1.Resource("configmaps"), obj.GetName(), errors.New("object was modified"))
+		}
+		obj.SetResourceVersion(current.fake)
+	}
+
+	if err := c.Client.Update(ctx, obj, opts...); err != nil {
+		obj.SetResourceVersion(requested)
+		return err
+	}
+	c.record(obj)
+
+	return nil
+}
+
+func (c *revisionedClient) Delete(ctx context.Context, obj client.Object, opts ...client.DeleteOption) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// The fake client doesn't enforce preconditions
+	deleteOpts := &client.DeleteOptions{}
+	deleteOpts.ApplyOptions(opts)
+	if preconditions := deleteOpts.Preconditions; preconditions != nil {
+		current := obj.DeepCopyObject().(client.Object)
+		if err := c.Client.Get(ctx, client.ObjectKeyFromObject(obj), current); err != nil {
+			return err
+		}
+		c.translate(current)
+
+		if (preconditions.UID != nil && *preconditions.UID != current.GetUID()) ||
+			(preconditions.ResourceVersion != nil && *preconditions.ResourceVersion != current.GetResourceVersion()) {
+			return apierrors.NewConflict(corev1.Resource("configmaps"), obj.GetName(), errors.New("precondition failed"))
+		}
+	}
+
+	if err := c.Client.Delete(ctx, obj, opts...); err != nil {
+		return err
+	}
+	// Like the API server, report the deleted object at the revision it was deleted at
+	c.revision++
+	delete(c.revisions, client.ObjectKeyFromObject(obj))
+	obj.SetResourceVersion(strconv.FormatUint(c.revision, 10))
+
+	return nil
+}
+
+// record assigns the next revision to a written object.
+// Callers must hold the lock.
+func (c *revisionedClient) record(obj client.Object) {
+	c.revision++
+	c.revisions[client.ObjectKeyFromObject(obj)] = revision{fake: obj.GetResourceVersion(), cluster: c.revision}
+	obj.SetResourceVersion(strconv.FormatUint(c.revision, 10))
+}
+
+// translate replaces the resourceVersion the fake client gave an object with the revision it was written at.
+// Callers must hold the lock.
+func (c *revisionedClient) translate(obj metav1.Object) {
+	current, ok := c.revisions[types.NamespacedName{Namespace: obj.GetNamespace(), Name: obj.GetName()}]
+	if ok && current.fake == obj.GetResourceVersion() {
+		obj.SetResourceVersion(strconv.FormatUint(current.cluster, 10))
+	}
+}
+
+// testPropogateStore creates obj at a well-known key, replacing whatever was there before.
+func testPropogateStore(ctx context.Context, t *testing.T, store *ConfigMapStore, obj *examplev1.Pod) (string, *examplev1.Pod) {
+	key := "/testkey"
+	if err := store.Delete(ctx, key, &examplev1.Pod{}, nil, storage.ValidateAllObjectFunc); err != nil && !storage.IsNotFound(err) {
+		t.Fatalf("Cleanup failed: %v", err)
+	}
+
+	out := &examplev1.Pod{}
+	if err := store.Create(ctx, key, obj, out, 0); err != nil {
+		t.Fatalf("Set failed: %v", err)
+	}
+
+	return key, out
+}
+
+// checkStorageInvariants verifies that the object stored for key was written without a resourceVersion or selfLink.
+func checkStorageInvariants(ctx context.Context, t *testing.T, store *ConfigMapStore, key string) {
+	partitions, _, err := store.partitions(ctx, key)
+	if err != nil {
+		t.Fatalf("failed to list partitions: %v", err)
+	}
+	if len(partitions) == 0 {
+		t.Fatalf("expecting partitions for key: %s", key)
+	}
+
+	sorted, err := sortPartitions(partitions)
+	if err != nil {
+		t.Fatalf("failed to order partitions: %v", err)
+	}
+	segments := make([]io.Reader, len(sorted))
+	for i, partition := range sorted {
+		segments[i] = bytes.NewReader(partition.Data)
+	}
+
+	obj := &examplev1.Pod{}
+	if err := store.partitioner.Join(obj, io.MultiReader(segments...)); err != nil {
+		t.Fatalf("expecting successful join of stored object: %v", err)
+	}
+	if obj.ResourceVersion != "" {
+		t.Errorf("stored object should have empty resource version")
+	}
+	if obj.SelfLink != "" {
+		t.Errorf("stored output should have empty self link")
+	}
+}
+
+func testCheckEventType(t *testing.T, expectEventType watch.EventType, w watch.Interface) {
+	select {
+	case res := <-w.ResultChan():
+		if res.Type != expectEventType {
+			t.Errorf("event type want=%v, get=%v", expectEventType, res.Type)
+		}
+	case <-time.After(wait.ForeverTestTimeout):
+		t.Errorf("time out after waiting %v on ResultChan", wait.ForeverTestTimeout)
+	}
+}
+
+func testCheckResult(t *testing.T, i int, expectEventType watch.EventType, w watch.Interface, expectObj *examplev1.Pod) {
+	select {
+	case res := <-w.ResultChan():
+		if res.Type != expectEventType {
+			t.Errorf("#%d: event type want=%v, get=%v", i, expectEventType, res.Type)
+			return
+		}
+		if !reflect.DeepEqual(expectObj, res.Object) {
+			t.Errorf("#%d: obj want=\n%#v\nget=\n%#v", i, expectObj, res.Object)
+		}
+	case <-time.After(wait.ForeverTestTimeout):
+		t.Errorf("#%d: time out after waiting %v on ResultChan", i, wait.ForeverTestTimeout)
+	}
+}
+
+func testCheckStop(t *testing.T, i int, w watch.Interface) {
+	select {
+	case e, ok := <-w.ResultChan():
+		if ok {
+			t.Errorf("#%d: ResultChan should have been closed. Event: %s", i, e.Type)
+		}
+	case <-time.After(wait.ForeverTestTimeout):
+		t.Errorf("#%d: time out after waiting on ResultChan", i)
+	}
+}
+
+func TestConformance(t *testing.T) {
+	for name, test := range map[string]func(*testing.T, conformanceBackend){
+		"Create":                       testConformanceCreate,
+		"CreateWithTTL":                testConformanceCreateWithTTL,
+		"CreateWithKeyExist":           testConformanceCreateWithKeyExist,
+		"Get":                          testConformanceGet,
+		"UnconditionalDelete":          testConformanceUnconditionalDelete,
+		"ConditionalDelete":            testConformanceConditionalDelete,
+		"GetToList":                    testConformanceGetToList,
+		"GuaranteedUpdate":             testConformanceGuaranteedUpdate,
+		"GuaranteedUpdateWithTTL":      testConformanceGuaranteedUpdateWithTTL,
+		"GuaranteedUpdateWithConflict": testConformanceGuaranteedUpdateWithConflict,
+		"GuaranteedUpdateWithSuggestionAndConflict": testConformanceGuaranteedUpdateWithSuggestionAndConflict,
+		"CorruptedData":                      testConformanceCorruptedData,
+		"TransformationFailure":              testConformanceTransformationFailure,
+		"List":                               testConformanceList,
+		"ListContinuation":                   testConformanceListContinuation,
+		"ListContinuationWithFilter":         testConformanceListContinuationWithFilter,
+		"ConsistentList":                     testConformanceConsistentList,
+		"Watch":                              func(t *testing.T, b conformanceBackend) { testConformanceWatch(t, b, false) },
+		"WatchList":                          func(t *testing.T, b conformanceBackend) { testConformanceWatch(t, b, true) },
+		"DeleteTriggerWatch":                 testConformanceDeleteTriggerWatch,
+		"WatchFromZero":                      testConformanceWatchFromZero,
+		"WatchFromNoneZero":                  testConformanceWatchFromNoneZero,
+		"WatchError":                         testConformanceWatchError,
+		"WatchContextCancel":                 testConformanceWatchContextCancel,
+		"WatchErrResultNotBlockAfterCancel":  testConformanceWatchErrResultNotBlockAfterCancel,
+		"WatchDeleteEventObjectHaveLatestRV": testConformanceWatchDeleteEventObjectHaveLatestRV,
+	} {
+		for backendName, newBackend := range map[string]conformanceBackend{
+			"ConfigMap": newRevisionedBackend,
+			"Memory":    func(*testing.T) Backend { return NewMemoryBackend() },
+			"Dir":       func(t *testing.T) Backend { return newTestDirBackend(t) },
+		} {
+			t.Run(name+"/"+backendName, func(t *testing.T) { test(t, newBackend) })
+		}
+	}
+}
+
+func testConformanceCreate(t *testing.T, newBackend conformanceBackend) {
+	ctx, store := newConformanceStore(t, newBackend)
+
+	key := "/testkey"
+	out := &examplev1.Pod{}
+	obj := &examplev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "foo", SelfLink: "testlink"}}
+
+	// verify that the key is empty before set
+	if err := store.Get(ctx, key, storage.GetOptions{}, &examplev1.Pod{}); !storage.IsNotFound(err) {
+		t.Fatalf("expecting empty result on key: %s", key)
+	}
+
+	if err := store.Create(ctx, key, obj, out, 0); err != nil {
+		t.Fatalf("Set failed: %v", err)
+	}
+	// basic tests of the output
+	if obj.ObjectMeta.Name != out.ObjectMeta.Name {
+		t.Errorf("pod name want=%s, get=%s", obj.ObjectMeta.Name, out.ObjectMeta.Name)
+	}
+	if out.ResourceVersion == "" {
+		t.Errorf("output should have non-empty resource version")
+	}
+	if out.SelfLink != "" {
+		t.Errorf("output should have empty self link")
+	}
+
+	checkStorageInvariants(ctx, t, store, key)
+}
+
+func testConformanceCreateWithTTL(t *testing.T, newBackend conformanceBackend) {
+	ctx, store := newConformanceStore(t, newBackend)
+
+	input := &examplev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "foo"}}
+	key := "/somekey"
+
+	out := &examplev1.Pod{}
+	if err := store.Create(ctx, key, input, out, 1); err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+
+	w, err := store.Watch(ctx, key, storage.ListOptions{ResourceVersion: out.ResourceVersion, Predicate: storage.Everything})
+	if err != nil {
+		t.Fatalf("Watch failed: %v", err)
+	}
+	testCheckEventType(t, watch.Deleted, w)
+}
+
+func testConformanceCreateWithKeyExist(t *testing.T, newBackend conformanceBackend) {
+	ctx, store := newConformanceStore(t, newBackend)
+
+	obj := &examplev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "foo"}}
+	key, _ := testPropogateStore(ctx, t, store, obj)
+	out := &examplev1.Pod{}
+	err := store.Create(ctx, key, obj, out, 0)
+	if err == nil || !storage.IsNodeExist(err) {
+		t.Errorf("expecting key exists error, but get: %s", err)
+	}
+}
+
+func testConformanceGet(t *testing.T, newBackend conformanceBackend) {
+	ctx, store := newConformanceStore(t, newBackend)
+
+	// create an object to test
+	key, createdObj := testPropogateStore(ctx, t, store, &examplev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "foo"}})
+	// update the object once to allow get by exact resource version to be tested
+	updateObj := createdObj.DeepCopy()
+	updateObj.Annotations = map[string]string{"test-annotation": "1"}
+	storedObj := &examplev1.Pod{}
+	err := store.GuaranteedUpdate(ctx, key, storedObj, true, nil,
+		func(_ runtime.Object, _ storage.ResponseMeta) (runtime.Object, *uint64, error) {
+			ttl := uint64(10)
+			return updateObj, &ttl, nil
+		})
+	if err != nil {
+		t.Fatalf("Update failed: %v", err)
+	}
+	// create an additional object to increment the resource version for pods above the resource version of the foo object
+	lastUpdatedObj := &examplev1.Pod{}
+	if err := store.Create(ctx, "bar", &examplev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "bar"}}, lastUpdatedObj, 0); err != nil {
+		t.Fatalf("Set failed: %v", err)
+	}
+
+	currentRV, _ := strconv.Atoi(storedObj.ResourceVersion)
+	lastUpdatedCurrentRV, _ := strconv.Atoi(lastUpdatedObj.ResourceVersion)
+
+	tests := []struct {
+		name              string
+		key               string
+		ignoreNotFound    bool
+		expectNotFoundErr bool
+		expectRVTooLarge  bool
+		expectedOut       *examplev1.Pod
+		rv                string
+	}{{ // test get on existing item
+		name:        "get existing",
+		key:         key,
+		expectedOut: storedObj,
+	}, { // test get on existing item with resource version set to 0
+		name:        "resource version 0",
+		key:         key,
+		expectedOut: storedObj,
+		rv:          "0",
+	}, { // test get on existing item with resource version set to the resource version is was created on
+		name:        "object created resource version",
+		key:         key,
+		expectedOut: storedObj,
+		rv:          createdObj.ResourceVersion,
+	}, { // test get on existing item with resource version set to current resource version of the object
+		name:        "current object resource version, match=NotOlderThan",
+		key:         key,
+		expectedOut: storedObj,
+		rv:          fmt.Sprintf("%d", currentRV),
+	}, { // test get on existing item with resource version set to latest pod resource version
+		name:        "latest resource version",
+		key:         key,
+		expectedOut: storedObj,
+		rv:          fmt.Sprintf("%d", lastUpdatedCurrentRV),
+	}, { // test get on existing item with resource version set too high
+		name:             "too high resource version",
+		key:              key,
+		expectRVTooLarge: true,
+		rv:               fmt.Sprintf("%d", lastUpdatedCurrentRV+1),
+	}, { // test get on non-existing item with ignoreNotFound=false
+		name:              "get non-existing",
+		key:               "/non-existing",
+		expectNotFoundErr: true,
+	}, { // test get on non-existing item with ignoreNotFound=true
+		name:           "get non-existing, ignore not found",
+		key:            "/non-existing",
+		ignoreNotFound: true,
+		expectedOut:    &examplev1.Pod{},
+	}}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out := &examplev1.Pod{}
+			err := store.Get(ctx, tt.key, storage.GetOptions{IgnoreNotFound: tt.ignoreNotFound, ResourceVersion: tt.rv}, out)
+			if tt.expectNotFoundErr {
+				if err == nil || !storage.IsNotFound(err) {
+					t.Errorf("expecting not found error, but get: %v", err)
+				}
+				return
+			}
+			if tt.expectRVTooLarge {
+				if err == nil || !storage.IsTooLargeResourceVersion(err) {
+					t.Errorf("expecting resource version too high error, but get: %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Get failed: %v", err)
+			}
+			if !reflect.DeepEqual(tt.expectedOut, out) {
+				t.Errorf("pod want=\n%#v\nget=\n%#v", tt.expectedOut, out)
+			}
+		})
+	}
+}
+
+func testConformanceUnconditionalDelete(t *testing.T, newBackend conformanceBackend) {
+	ctx, store := newConformanceStore(t, newBackend)
+	key, storedObj := testPropogateStore(ctx, t, store, &examplev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "foo"}})
+
+	tests := []struct {
+		key               string
+		expectedObj       *examplev1.Pod
+		expectNotFoundErr bool
+	}{{ // test unconditional delete on existing key
+		key:         key,
+		expectedObj: storedObj,
+	}, { // test unconditional delete on non-existing key
+		key:               "/non-existing",
+		expectNotFoundErr: true,
+	}}
+
+	for i, tt := range tests {
+		out := &examplev1.Pod{} // reset
+		err := store.Delete(ctx, tt.key, out, nil, storage.ValidateAllObjectFunc)
+		if tt.expectNotFoundErr {
+			if err == nil || !storage.IsNotFound(err) {
+				t.Errorf("#%d: expecting not found error, but get: %s", i, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("Delete failed: %v", err)
+		}
+		if !reflect.DeepEqual(tt.expectedObj, out) {
+			t.Errorf("#%d: pod want=%#v, get=%#v", i, tt.expectedObj, out)
+		}
+	}
+}
+
+func testConformanceConditionalDelete(t *testing.T, newBackend conformanceBackend) {
+	ctx, store := newConformanceStore(t, newBackend)
+	key, storedObj := testPropogateStore(ctx, t, store, &examplev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "foo", UID: "A"}})
+
+	tests := []struct {
+		precondition        *storage.Preconditions
+		expectInvalidObjErr bool
+	}{{ // test conditional delete with UID match
+		precondition: storage.NewUIDPreconditions("A"),
+	}, { // test conditional delete with UID mismatch
+		precondition:        storage.NewUIDPreconditions("B"),
+		expectInvalidObjErr: true,
+	}}
+
+	for i, tt := range tests {
+		out := &examplev1.Pod{}
+		err := store.Delete(ctx, key, out, tt.precondition, storage.ValidateAllObjectFunc)
+		if tt.expectInvalidObjErr {
+			if err == nil || !storage.IsInvalidObj(err) {
+				t.Errorf("#%d: expecting invalid UID error, but get: %s", i, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("Delete failed: %v", err)
+		}
+		if !reflect.DeepEqual(storedObj, out) {
+			t.Errorf("#%d: pod want=%#v, get=%#v", i, storedObj, out)
+		}
+		key, storedObj = testPropogateStore(ctx, t, store, &examplev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "foo", UID: "A"}})
+	}
+}
+
+func testConformanceGetToList(t *testing.T, newBackend conformanceBackend) {
+	ctx, store := newConformanceStore(t, newBackend)
+
+	prevStoredObj := &examplev1.Pod{}
+	prevKey := "/prevkey"
+	if err := store.Create(ctx, prevKey, &examplev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "prev"}}, prevStoredObj, 0); err != nil {
+		t.Fatalf("Set failed: %v", err)
+	}
+	prevRV, _ := strconv.Atoi(prevStoredObj.ResourceVersion)
+
+	key, storedObj := testPropogateStore(ctx, t, store, &examplev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "foo"}})
+	currentRV, _ := strconv.Atoi(storedObj.ResourceVersion)
+
+	tests := []struct {
+		key              string
+		pred             storage.SelectionPredicate
+		expectedOut      []*examplev1.Pod
+		rv               string
+		rvMatch          metav1.ResourceVersionMatch
+		expectRVTooLarge bool
+		expectRVExpired  bool
+	}{{ // test GetToList on existing key
+		key:         key,
+		pred:        storage.Everything,
+		expectedOut: []*examplev1.Pod{storedObj},
+	}, { // test GetToList on existing key with minimum resource version set to 0
+		key:         key,
+		pred:        storage.Everything,
+		expectedOut: []*examplev1.Pod{storedObj},
+		rv:          "0",
+	}, { // test GetToList on existing key with minimum resource version set to 0, match=minimum
+		key:         key,
+		pred:        storage.Everything,
+		expectedOut: []*examplev1.Pod{storedObj},
+		rv:          "0",
+		rvMatch:     metav1.ResourceVersionMatchNotOlderThan,
+	}, { // test GetToList on existing key with minimum resource version set to current resource version
+		key:         key,
+		pred:        storage.Everything,
+		expectedOut: []*examplev1.Pod{storedObj},
+		rv:          fmt.Sprintf("%d", currentRV),
+	}, { // test GetToList on existing key with minimum resource version set to current resource version, match=minimum
+		key:         key,
+		pred:        storage.Everything,
+		expectedOut: []*examplev1.Pod{storedObj},
+		rv:          fmt.Sprintf("%d", currentRV),
+		rvMatch:     metav1.ResourceVersionMatchNotOlderThan,
+	}, { // test GetToList on existing key with minimum resource version set to previous resource version, match=minimum
+		key:         key,
+		pred:        storage.Everything,
+		expectedOut: []*examplev1.Pod{storedObj},
+		rv:          fmt.Sprintf("%d", prevRV),
+		rvMatch:     metav1.ResourceVersionMatchNotOlderThan,
+	}, { // test GetToList on existing key with resource version set to current resource version, match=exact
+		key:         key,
+		pred:        storage.Everything,
+		expectedOut: []*examplev1.Pod{storedObj},
+		rv:          fmt.Sprintf("%d", currentRV),
+		rvMatch:     metav1.ResourceVersionMatchExact,
+	}, { // test GetToList on existing key with resource version set to previous resource version, match=exact
+		key:         prevKey,
+		pred:        storage.Everything,
+		expectedOut: []*examplev1.Pod{prevStoredObj},
+		rv:          fmt.Sprintf("%d", prevRV),
+		rvMatch:     metav1.ResourceVersionMatchExact,
+	}, { // test GetToList on existing key with resource version older than the object, match=exact
+		key:             key,
+		pred:            storage.Everything,
+		rv:              fmt.Sprintf("%d", prevRV),
+		rvMatch:         metav1.ResourceVersionMatchExact,
+		expectRVExpired: true,
+	}, { // test GetToList on existing key with minimum resource version set too high
+		key:              key,
+		pred:             storage.Everything,
+		expectedOut:      []*examplev1.Pod{storedObj},
+		rv:               fmt.Sprintf("%d", currentRV+1),
+		expectRVTooLarge: true,
+	}, { // test GetToList on non-existing key
+		key:         "/non-existing",
+		pred:        storage.Everything,
+		expectedOut: nil,
+	}, { // test GetToList with matching pod name
+		key: "/non-existing",
+		pred: storage.SelectionPredicate{
+			Label: labels.Everything(),
+			Field: fields.ParseSelectorOrDie("metadata.name!=" + storedObj.Name),
+			GetAttrs: func(obj runtime.Object) (labels.Set, fields.Set, error) {
+				pod := obj.(*examplev1.Pod)
+				return nil, fields.Set{"metadata.name": pod.Name}, nil
+			},
+		},
+		expectedOut: nil,
+	}}
+
+	for i, tt := range tests {
+		out := &examplev1.PodList{}
+		err := store.GetToList(ctx, tt.key, storage.ListOptions{ResourceVersion: tt.rv, ResourceVersionMatch: tt.rvMatch, Predicate: tt.pred}, out)
+
+		if tt.expectRVTooLarge {
+			if err == nil || !storage.IsTooLargeResourceVersion(err) {
+				t.Errorf("#%d: expecting resource version too high error, but get: %s", i, err)
+			}
+			continue
+		}
+		if tt.expectRVExpired {
+			if err == nil || !apierrors.IsResourceExpired(err) {
+				t.Errorf("#%d: expecting resource version expired error, but get: %s", i, err)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Fatalf("GetToList failed: %v", err)
+		}
+		if len(out.ResourceVersion) == 0 {
+			t.Errorf("#%d: unset resourceVersion", i)
+		}
+		if len(out.Items) != len(tt.expectedOut) {
+			t.Errorf("#%d: length of list want=%d, get=%d", i, len(tt.expectedOut), len(out.Items))
+			continue
+		}
+		for j, wantPod := range tt.expectedOut {
+			getPod := &out.Items[j]
+			if !reflect.DeepEqual(wantPod, getPod) {
+				t.Errorf("#%d: pod want=%#v, get=%#v", i, wantPod, getPod)
+			}
+		}
+	}
+}
+
+func testConformanceGuaranteedUpdate(t *testing.T, newBackend conformanceBackend) {
+	ctx, store := newConformanceStore(t, newBackend)
+	key := "/testkey"
+
+	tests := []struct {
+		key                 string
+		ignoreNotFound      bool
+		precondition        *storage.Preconditions
+		expectNotFoundErr   bool
+		expectInvalidObjErr bool
+		expectNoUpdate      bool
+		hasSelfLink         bool
+	}{{ // GuaranteedUpdate on non-existing key with ignoreNotFound=false
+		key:               "/non-existing",
+		expectNotFoundErr: true,
+	}, { // GuaranteedUpdate on non-existing key with ignoreNotFound=true
+		key:            "/non-existing",
+		ignoreNotFound: true,
+	}, { // GuaranteedUpdate on existing key
+		key: key,
+	}, { // GuaranteedUpdate with same data
+		key:            key,
+		expectNoUpdate: true,
+	}, { // GuaranteedUpdate with same data AND a self link
+		key:            key,
+		expectNoUpdate: true,
+		hasSelfLink:    true,
+	}, { // GuaranteedUpdate with UID match
+		key:            key,
+		precondition:   storage.NewUIDPreconditions("A"),
+		expectNoUpdate: true,
+	}, { // GuaranteedUpdate with UID mismatch
+		key:                 key,
+		precondition:        storage.NewUIDPreconditions("B"),
+		expectInvalidObjErr: true,
+		expectNoUpdate:      true,
+	}}
+
+	for i, tt := range tests {
+		key, storeObj := testPropogateStore(ctx, t, store, &examplev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "foo", UID: "A"}})
+
+		out := &examplev1.Pod{}
+		name := fmt.Sprintf("foo-%d", i)
+		if tt.expectNoUpdate {
+			name = storeObj.Name
+		}
+		version := storeObj.ResourceVersion
+		err := store.GuaranteedUpdate(ctx, tt.key, out, tt.ignoreNotFound, tt.precondition,
+			storage.SimpleUpdate(func(obj runtime.Object) (runtime.Object, error) {
+				if tt.expectNotFoundErr && tt.ignoreNotFound {
+					if pod := obj.(*examplev1.Pod); pod.Name != "" {
+						t.Errorf("#%d: expecting zero value, but get=%#v", i, pod)
+					}
+				}
+				pod := *storeObj
+				if tt.hasSelfLink {
+					pod.SelfLink = "testlink"
+				}
+				pod.Name = name
+				return &pod, nil
+			}))
+
+		if tt.expectNotFoundErr {
+			if err == nil || !storage.IsNotFound(err) {
+				t.Errorf("#%d: expecting not found error, but get: %v", i, err)
+			}
+			continue
+		}
+		if tt.expectInvalidObjErr {
+			if err == nil || !storage.IsInvalidObj(err) {
+				t.Errorf("#%d: expecting invalid UID error, but get: %s", i, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("GuaranteedUpdate failed: %v", err)
+		}
+		if out.ObjectMeta.Name != name {
+			t.Errorf("#%d: pod name want=%s, get=%s", i, name, out.ObjectMeta.Name)
+		}
+		if out.SelfLink != "" {
+			t.Errorf("#%d: selflink should not be set", i)
+		}
+
+		// verify that the stored partitions match expectations
+		checkStorageInvariants(ctx, t, store, key)
+
+		switch tt.expectNoUpdate {
+		case true:
+			if version != out.ResourceVersion {
+				t.Errorf("#%d: expect no version change, before=%s, after=%s", i, version, out.ResourceVersion)
+			}
+		case false:
+			if version == out.ResourceVersion {
+				t.Errorf("#%d: expect version change, but get the same version=%s", i, version)
+			}
+		}
+	}
+}
+
+func testConformanceGuaranteedUpdateWithTTL(t *testing.T, newBackend conformanceBackend) {
+	ctx, store := newConformanceStore(t, newBackend)
+
+	input := &examplev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "foo"}}
+	key := "/somekey"
+
+	out := &examplev1.Pod{}
+	err := store.GuaranteedUpdate(ctx, key, out, true, nil,
+		func(_ runtime.Object, _ storage.ResponseMeta) (runtime.Object, *uint64, error) {
+			ttl := uint64(1)
+			return input, &ttl, nil
+		})
+	if err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+
+	w, err := store.Watch(ctx, key, storage.ListOptions{ResourceVersion: out.ResourceVersion, Predicate: storage.Everything})
+	if err != nil {
+		t.Fatalf("Watch failed: %v", err)
+	}
+	testCheckEventType(t, watch.Deleted, w)
+}
+
+func testConformanceGuaranteedUpdateWithConflict(t *testing.T, newBackend conformanceBackend) {
+	ctx, store := newConformanceStore(t, newBackend)
+	key, _ := testPropogateStore(ctx, t, store, &examplev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "foo"}})
+
+	errChan := make(chan error, 1)
+	var firstToFinish sync.WaitGroup
+	var secondToEnter sync.WaitGroup
+	firstToFinish.Add(1)
+	secondToEnter.Add(1)
+
+	go func() {
+		err := store.GuaranteedUpdate(ctx, key, &examplev1.Pod{}, false, nil,
+			storage.SimpleUpdate(func(obj runtime.Object) (runtime.Object, error) {
+				pod := obj.(*examplev1.Pod)
+				pod.Name = "foo-1"
+				secondToEnter.Wait()
+				return pod, nil
+			}))
+		firstToFinish.Done()
+		errChan <- err
+	}()
+
+	updateCount := 0
+	err := store.GuaranteedUpdate(ctx, key, &examplev1.Pod{}, false, nil,
+		storage.SimpleUpdate(func(obj runtime.Object) (runtime.Object, error) {
+			if updateCount == 0 {
+				secondToEnter.Done()
+				firstToFinish.Wait()
+			}
+			updateCount++
+			pod := obj.(*examplev1.Pod)
+			pod.Name = "foo-2"
+			return pod, nil
+		}))
+	if err != nil {
+		t.Fatalf("Second GuaranteedUpdate error %#v", err)
+	}
+	if err := <-errChan; err != nil {
+		t.Fatalf("First GuaranteedUpdate error %#v", err)
+	}
+
+	if updateCount != 2 {
+		t.Errorf("Should have conflict and called update func twice")
+	}
+}
+
+func testConformanceGuaranteedUpdateWithSuggestionAndConflict(t *testing.T, newBackend conformanceBackend) {
+	ctx, store := newConformanceStore(t, newBackend)
+	key, originalPod := testPropogateStore(ctx, t, store, &examplev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "foo"}})
+
+	// First, update without a suggestion so originalPod is outdated
+	updatedPod := &examplev1.Pod{}
+	err := store.GuaranteedUpdate(ctx, key, updatedPod, false, nil,
+		storage.SimpleUpdate(func(obj runtime.Object) (runtime.Object, error) {
+			pod := obj.(*examplev1.Pod)
+			pod.Name = "foo-2"
+			return pod, nil
+		}),
+	)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// Second, update using the outdated originalPod as the suggestion. Return a conflict error when
+	// passed originalPod, and make sure that SimpleUpdate is called a second time after a live lookup
+	// with the value of updatedPod.
+	sawConflict := false
+	updatedPod2 := &examplev1.Pod{}
+	err = store.GuaranteedUpdate(ctx, key, updatedPod2, false, nil,
+		storage.SimpleUpdate(func(obj runtime.Object) (runtime.Object, error) {
+			pod := obj.(*examplev1.Pod)
+			if pod.Name != "foo-2" {
+				if sawConflict {
+					t.Fatalf("unexpected second conflict")
+				}
+				sawConflict = true
+				// simulated stale object - return a conflict
+				return nil, apierrors.NewConflict(examplev1.SchemeGroupVersion.WithResource("pods").GroupResource(), "name", errors.New("foo"))
+			}
+			pod.Name = "foo-3"
+			return pod, nil
+		}),
+		originalPod,
+	)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if updatedPod2.Name != "foo-3" {
+		t.Errorf("unexpected pod name: %q", updatedPod2.Name)
+	}
+}
+
+// testConformanceCorruptedData is testConformanceTransformationFailure with data that can't be joined, rather than
+// transformed.
+func testConformanceCorruptedData(t *testing.T, newBackend conformanceBackend) {
+	ctx, store := newConformanceStore(t, newBackend)
+
+	preset := []struct {
+		key       string
+		obj       *examplev1.Pod
+		storedObj *examplev1.Pod
+	}{{
+		key: "/one-level/test",
+		obj: &examplev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "bar"}},
+	}, {
+		key: "/two-level/1/test",
+		obj: &examplev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "baz"}},
+	}}
+	preset[0].storedObj = &examplev1.Pod{}
+	if err := store.Create(ctx, preset[0].key, preset[0].obj, preset[0].storedObj, 0); err != nil {
+		t.Fatalf("Set failed: %v", err)
+	}
+
+	// create a second resource with data that can't be decoded
+	corrupt := &Blob{
+		ObjectMeta: metav1.ObjectMeta{GenerateName: "partition-"},
+		Data:       []byte("otherprefix!"),
+	}
+	store.stamp(preset[1].key, corrupt)
+	setPosition(corrupt, 0, 1, "corrupt")
+	if _, _, err := store.commit(ctx, preset[1].key, nil, nil, []*Blob{corrupt}); err != nil {
+		t.Fatalf("Set failed: %v", err)
+	}
+
+	// List should fail
+	var got examplev1.PodList
+	if err := store.List(ctx, "/", storage.ListOptions{Predicate: storage.Everything}, &got); !storage.IsInternalError(err) {
+		t.Errorf("Unexpected error %v", err)
+	}
+
+	// Get should fail
+	if err := store.Get(ctx, preset[1].key, storage.GetOptions{}, &examplev1.Pod{}); !storage.IsInternalError(err) {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	// GuaranteedUpdate without suggestion should return an error
+	if err := store.GuaranteedUpdate(ctx, preset[1].key, &examplev1.Pod{}, false, nil, func(input runtime.Object, res storage.ResponseMeta) (output runtime.Object, ttl *uint64, err error) {
+		return input, nil, nil
+	}); !storage.IsInternalError(err) {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	// GuaranteedUpdate with suggestion should return an error if we don't change the object
+	if err := store.GuaranteedUpdate(ctx, preset[1].key, &examplev1.Pod{}, false, nil, func(input runtime.Object, res storage.ResponseMeta) (output runtime.Object, ttl *uint64, err error) {
+		return input, nil, nil
+	}, preset[1].obj); err == nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+
+	// Delete fails with internal error.
+	if err := store.Delete(ctx, preset[1].key, &examplev1.Pod{}, nil, storage.ValidateAllObjectFunc); !storage.IsInternalError(err) {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	if err := store.Get(ctx, preset[1].key, storage.GetOptions{}, &examplev1.Pod{}); !storage.IsInternalError(err) {
+		t.Errorf("Unexpected error: %v", err)
+	}
+}
+
+func testConformanceTransformationFailure(t *testing.T, newBackend conformanceBackend) {
+	ctx, store := newConformanceStore(t, newBackend)
+	transformer, err := NewKeyring(Key{Name: "test", Secret: []byte("abcdefghijklmnop")})
+	if err != nil {
+		t.Fatalf("NewKeyring failed: %v", err)
+	}
+	otherTransformer, err := NewKeyring(Key{Name: "otherprefix", Secret: []byte("ponmlkjihgfedcba")})
+	if err != nil {
+		t.Fatalf("NewKeyring failed: %v", err)
+	}
+	if err := store.SetTransformer(transformer); err != nil {
+		t.Fatalf("SetTransformer failed: %v", err)
+	}
+
+	preset := []struct {
+		key       string
+		obj       *examplev1.Pod
+		storedObj *examplev1.Pod
+	}{{
+		key: "/one-level/test",
+		obj: &examplev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "bar"}},
+	}, {
+		key: "/two-level/1/test",
+		obj: &examplev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "baz"}},
+	}}
+	for i, ps := range preset[:1] {
+		preset[i].storedObj = &examplev1.Pod{}
+		err := store.Create(ctx, ps.key, ps.obj, preset[:1][i].storedObj, 0)
+		if err != nil {
+			t.Fatalf("Set failed: %v", err)
+		}
+	}
+
+	// create a second resource with a transformer the store doesn't have
+	if err := store.SetTransformer(otherTransformer); err != nil {
+		t.Fatalf("SetTransformer failed: %v", err)
+	}
+	for i, ps := range preset[1:] {
+		preset[1:][i].storedObj = &examplev1.Pod{}
+		err := store.Create(ctx, ps.key, ps.obj, preset[1:][i].storedObj, 0)
+		if err != nil {
+			t.Fatalf("Set failed: %v", err)
+		}
+	}
+	if err := store.SetTransformer(transformer); err != nil {
+		t.Fatalf("SetTransformer failed: %v", err)
+	}
+
+	// List should fail
+	var got examplev1.PodList
+	if err := store.List(ctx, "/", storage.ListOptions{Predicate: storage.Everything}, &got); !storage.IsInternalError(err) {
+		t.Errorf("Unexpected error %v", err)
+	}
+
+	// Get should fail
+	if err := store.Get(ctx, preset[1].key, storage.GetOptions{}, &examplev1.Pod{}); !storage.IsInternalError(err) {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	// GuaranteedUpdate without suggestion should return an error
+	if err := store.GuaranteedUpdate(ctx, preset[1].key, &examplev1.Pod{}, false, nil, func(input runtime.Object, res storage.ResponseMeta) (output runtime.Object, ttl *uint64, err error) {
+		return input, nil, nil
+	}); !storage.IsInternalError(err) {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	// GuaranteedUpdate with suggestion should return an error if we don't change the object
+	if err := store.GuaranteedUpdate(ctx, preset[1].key, &examplev1.Pod{}, false, nil, func(input runtime.Object, res storage.ResponseMeta) (output runtime.Object, ttl *uint64, err error) {
+		return input, nil, nil
+	}, preset[1].obj); err == nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+
+	// Delete fails with internal error.
+	if err := store.Delete(ctx, preset[1].key, &examplev1.Pod{}, nil, storage.ValidateAllObjectFunc); !storage.IsInternalError(err) {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	if err := store.Get(ctx, preset[1].key, storage.GetOptions{}, &examplev1.Pod{}); !storage.IsInternalError(err) {
+		t.Errorf("Unexpected error: %v", err)
+	}
+}
+
+func testConformanceList(t *testing.T, newBackend conformanceBackend) {
+	ctx, store := newConformanceStore(t, newBackend)
+
+	// Setup storage with the following structure:
+	//  /
+	//   - one-level/
+	//  |            - test
+	//  |
+	//   - two-level/
+	//  |            - 1/
+	//  |           |   - test
+	//  |           |
+	//  |            - 2/
+	//  |               - test
+	//  |
+	//   - z-level/
+	//               - 3/
+	//              |   - test
+	//              |
+	//               - 3/
+	//                  - test-2
+	preset := []struct {
+		key       string
+		obj       *examplev1.Pod
+		storedObj *examplev1.Pod
+	}{
+		{
+			key: "/one-level/test",
+			obj: &examplev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "foo"}},
+		},
+		{
+			key: "/two-level/1/test",
+			obj: &examplev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "foo"}},
+		},
+		{
+			key: "/two-level/2/test",
+			obj: &examplev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "bar"}},
+		},
+		{
+			key: "/z-level/3/test",
+			obj: &examplev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "fourth"}},
+		},
+		{
+			key: "/z-level/3/test-2",
+			obj: &examplev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "bar"}},
+		},
+	}
+
+	for i, ps := range preset {
+		preset[i].storedObj = &examplev1.Pod{}
+		err := store.Create(ctx, ps.key, ps.obj, preset[i].storedObj, 0)
+		if err != nil {
+			t.Fatalf("Set failed: %v", err)
+		}
+	}
+
+	list := &examplev1.PodList{}
+	if err := store.List(ctx, "/two-level", storage.ListOptions{ResourceVersion: "0", Predicate: storage.Everything}, list); err != nil {
+		t.Fatalf("List failed: %v", err)
+	}
+	continueRV, _ := strconv.Atoi(list.ResourceVersion)
+	secondContinuation, err := encodeContinue("/two-level/1/test", "/two-level/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	encodeContinueOrDie := func(after, prefix string) string {
+		token, err := encodeContinue(after, prefix)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return token
+	}
+
+	getAttrs := func(obj runtime.Object) (labels.Set, fields.Set, error) {
+		pod := obj.(*examplev1.Pod)
+		return nil, fields.Set{"metadata.name": pod.Name}, nil
+	}
+	int64Ptr := func(i int64) *int64 {
+		return &i
+	}
+
+	tests := []struct {
+		name                       string
+		rv                         string
+		rvMatch                    metav1.ResourceVersionMatch
+		prefix                     string
+		pred                       storage.SelectionPredicate
+		expectedOut                []*examplev1.Pod
+		expectContinue             bool
+		expectedRemainingItemCount *int64
+		expectError                bool
+		expectRVTooLarge           bool
+		expectRVExpired            bool
+		expectRV                   string
+	}{
+		{
+			name:        "rejects invalid resource version",
+			prefix:      "/",
+			pred:        storage.Everything,
+			rv:          "abc",
+			expectError: true,
+		},
+		{
+			name:   "rejects resource version and continue token",
+			prefix: "/",
+			pred: storage.SelectionPredicate{
+				Label:    labels.Everything(),
+				Field:    fields.Everything(),
+				Limit:    1,
+				Continue: encodeContinueOrDie("/two-level/1/test", "/"),
+			},
+			rv:          "1",
+			expectError: true,
+		},
+		{
+			name:             "rejects resource version set too high",
+			prefix:           "/",
+			rv:               fmt.Sprintf("%d", continueRV+1),
+			expectRVTooLarge: true,
+		},
+		{
+			name:        "test List on existing key",
+			prefix:      "/one-level/",
+			pred:        storage.Everything,
+			expectedOut: []*examplev1.Pod{preset[0].storedObj},
+		},
+		{
+			name:        "test List on existing key with resource version set to 0",
+			prefix:      "/one-level/",
+			pred:        storage.Everything,
+			expectedOut: []*examplev1.Pod{preset[0].storedObj},
+			rv:          "0",
+		},
+		{
+			name:            "test List on existing key with resource version set to 1, match=Exact",
+			prefix:          "/one-level/",
+			pred:            storage.Everything,
+			rv:              "1",
+			rvMatch:         metav1.ResourceVersionMatchExact,
+			expectRVExpired: true,
+		},
+		{
+			name:        "test List on existing key with resource version set to 1, match=NotOlderThan",
+			prefix:      "/one-level/",
+			pred:        storage.Everything,
+			expectedOut: []*examplev1.Pod{preset[0].storedObj},
+			rv:          "0",
+			rvMatch:     metav1.ResourceVersionMatchNotOlderThan,
+		},
+		{
+			name:        "test List on existing key with resource version set to 1, match=Invalid",
+			prefix:      "/one-level/",
+			pred:        storage.Everything,
+			rv:          "0",
+			rvMatch:     "Invalid",
+			expectError: true,
+		},
+		{
+			name:        "test List on existing key with resource version set to current resource version",
+			prefix:      "/one-level/",
+			pred:        storage.Everything,
+			expectedOut: []*examplev1.Pod{preset[0].storedObj},
+			rv:          list.ResourceVersion,
+		},
+		{
+			name:        "test List on existing key with resource version set to current resource version, match=Exact",
+			prefix:      "/one-level/",
+			pred:        storage.Everything,
+			expectedOut: []*examplev1.Pod{preset[0].storedObj},
+			rv:          list.ResourceVersion,
+			rvMatch:     metav1.ResourceVersionMatchExact,
+			expectRV:    list.ResourceVersion,
+		},
+		{
+			name:        "test List on existing key with resource version set to current resource version, match=NotOlderThan",
+			prefix:      "/one-level/",
+			pred:        storage.Everything,
+			expectedOut: []*examplev1.Pod{preset[0].storedObj},
+			rv:          list.ResourceVersion,
+			rvMatch:     metav1.ResourceVersionMatchNotOlderThan,
+		},
+		{
+			name:        "test List on non-existing key",
+			prefix:      "/non-existing/",
+			pred:        storage.Everything,
+			expectedOut: nil,
+		},
+		{
+			name:   "test List with pod name matching",
+			prefix: "/one-level/",
+			pred: storage.SelectionPredicate{
+				Label: labels.Everything(),
+				Field: fields.ParseSelectorOrDie("metadata.name!=foo"),
+			},
+			expectedOut: nil,
+		},
+		{
+			name:   "test List with limit",
+			prefix: "/two-level/",
+			pred: storage.SelectionPredicate{
+				Label: labels.Everything(),
+				Field: fields.Everything(),
+				Limit: 1,
+			},
+			expectedOut:                []*examplev1.Pod{preset[1].storedObj},
+			expectContinue:             true,
+			expectedRemainingItemCount: int64Ptr(1),
+		},
+		{
+			name:   "test List with limit at current resource version",
+			prefix: "/two-level/",
+			pred: storage.SelectionPredicate{
+				Label: labels.Everything(),
+				Field: fields.Everything(),
+				Limit: 1,
+			},
+			expectedOut:                []*examplev1.Pod{preset[1].storedObj},
+			expectContinue:             true,
+			expectedRemainingItemCount: int64Ptr(1),
+			rv:                         list.ResourceVersion,
+			expectRV:                   list.ResourceVersion,
+		},
+		{
+			name:   "test List with limit at current resource version and match=Exact",
+			prefix: "/two-level/",
+			pred: storage.SelectionPredicate{
+				Label: labels.Everything(),
+				Field: fields.Everything(),
+				Limit: 1,
+			},
+			expectedOut:                []*examplev1.Pod{preset[1].storedObj},
+			expectContinue:             true,
+			expectedRemainingItemCount: int64Ptr(1),
+			rv:                         list.ResourceVersion,
+			rvMatch:                    metav1.ResourceVersionMatchExact,
+			expectRV:                   list.ResourceVersion,
+		},
+		{
+			name:   "test List with limit at resource version 0",
+			prefix: "/two-level/",
+			pred: storage.SelectionPredicate{
+				Label: labels.Everything(),
+				Field: fields.Everything(),
+				Limit: 1,
+			},
+			expectedOut:                []*examplev1.Pod{preset[1].storedObj},
+			expectContinue:             true,
+			expectedRemainingItemCount: int64Ptr(1),
+			rv:                         "0",
+			expectRV:                   list.ResourceVersion,
+		},
+		{
+			name:   "test List with limit at resource version 0 match=NotOlderThan",
+			prefix: "/two-level/",
+			pred: storage.SelectionPredicate{
+				Label: labels.Everything(),
+				Field: fields.Everything(),
+				Limit: 1,
+			},
+			expectedOut:                []*examplev1.Pod{preset[1].storedObj},
+			expectContinue:             true,
+			expectedRemainingItemCount: int64Ptr(1),
+			rv:                         "0",
+			rvMatch:                    metav1.ResourceVersionMatchNotOlderThan,
+			expectRV:                   list.ResourceVersion,
+		},
+		{
+			name:   "test List with limit at resource version 1 and match=Exact",
+			prefix: "/two-level/",
+			pred: storage.SelectionPredicate{
+				Label: labels.Everything(),
+				Field: fields.Everything(),
+				Limit: 1,
+			},
+			rv:              "1",
+			rvMatch:         metav1.ResourceVersionMatchExact,
+			expectRVExpired: true,
+		},
+		{
+			name:   "test List with pregenerated continue token",
+			prefix: "/two-level/",
+			pred: storage.SelectionPredicate{
+				Label:    labels.Everything(),
+				Field:    fields.Everything(),
+				Limit:    1,
+				Continue: secondContinuation,
+			},
+			expectedOut: []*examplev1.Pod{preset[2].storedObj},
+		},
+		{
+			name:   "ignores resource version 0 for List with pregenerated continue token",
+			prefix: "/two-level/",
+			pred: storage.SelectionPredicate{
+				Label:    labels.Everything(),
+				Field:    fields.Everything(),
+				Limit:    1,
+				Continue: secondContinuation,
+			},
+			rv:          "0",
+			expectedOut: []*examplev1.Pod{preset[2].storedObj},
+		},
+		{
+			name:        "test List with multiple levels of directories and expect flattened result",
+			prefix:      "/two-level/",
+			pred:        storage.Everything,
+			expectedOut: []*examplev1.Pod{preset[1].storedObj, preset[2].storedObj},
+		},
+		{
+			name:   "test List with filter returning only one item, ensure only a single page returned",
+			prefix: "/",
+			pred: storage.SelectionPredicate{
+				Field: fields.OneTermEqualSelector("metadata.name", "fourth"),
+				Label: labels.Everything(),
+				Limit: 1,
+			},
+			expectedOut:    []*examplev1.Pod{preset[3].storedObj},
+			expectContinue: true,
+		},
+		{
+			name:   "test List with filter returning only one item, covers the entire list",
+			prefix: "/",
+			pred: storage.SelectionPredicate{
+				Field: fields.OneTermEqualSelector("metadata.name", "fourth"),
+				Label: labels.Everything(),
+				Limit: 2,
+			},
+			expectedOut:    []*examplev1.Pod{preset[3].storedObj},
+			expectContinue: false,
+		},
+		{
+			name:   "test List with filter returning only one item, covers the entire list, with resource version 0",
+			prefix: "/",
+			pred: storage.SelectionPredicate{
+				Field: fields.OneTermEqualSelector("metadata.name", "fourth"),
+				Label: labels.Everything(),
+				Limit: 2,
+			},
+			rv:             "0",
+			expectedOut:    []*examplev1.Pod{preset[3].storedObj},
+			expectContinue: false,
+		},
+		{
+			name:   "test List with filter returning two items, more pages possible",
+			prefix: "/",
+			pred: storage.SelectionPredicate{
+				Field: fields.OneTermEqualSelector("metadata.name", "foo"),
+				Label: labels.Everything(),
+				Limit: 2,
+			},
+			expectContinue: true,
+			expectedOut:    []*examplev1.Pod{preset[0].storedObj, preset[1].storedObj},
+		},
+		{
+			name:   "filter returns two items split across multiple pages",
+			prefix: "/",
+			pred: storage.SelectionPredicate{
+				Field: fields.OneTermEqualSelector("metadata.name", "bar"),
+				Label: labels.Everything(),
+				Limit: 2,
+			},
+			expectedOut: []*examplev1.Pod{preset[2].storedObj, preset[4].storedObj},
+		},
+		{
+			name:   "filter returns one item for last page, ends on last item, not full",
+			prefix: "/",
+			pred: storage.SelectionPredicate{
+				Field:    fields.OneTermEqualSelector("metadata.name", "bar"),
+				Label:    labels.Everything(),
+				Limit:    2,
+				Continue: encodeContinueOrDie("/z-level/3", "/"),
+			},
+			expectedOut: []*examplev1.Pod{preset[4].storedObj},
+		},
+		{
+			name:   "filter returns one item for last page, starts on last item, full",
+			prefix: "/",
+			pred: storage.SelectionPredicate{
+				Field:    fields.OneTermEqualSelector("metadata.name", "bar"),
+				Label:    labels.Everything(),
+				Limit:    1,
+				Continue: encodeContinueOrDie("/z-level/3/test", "/"),
+			},
+			expectedOut: []*examplev1.Pod{preset[4].storedObj},
+		},
+		{
+			name:   "filter returns one item for last page, starts on last item, partial page",
+			prefix: "/",
+			pred: storage.SelectionPredicate{
+				Field:    fields.OneTermEqualSelector("metadata.name", "bar"),
+				Label:    labels.Everything(),
+				Limit:    2,
+				Continue: encodeContinueOrDie("/z-level/3/test", "/"),
+			},
+			expectedOut: []*examplev1.Pod{preset[4].storedObj},
+		},
+		{
+			name:   "filter returns two items, page size equal to total list size",
+			prefix: "/",
+			pred: storage.SelectionPredicate{
+				Field: fields.OneTermEqualSelector("metadata.name", "bar"),
+				Label: labels.Everything(),
+				Limit: 5,
+			},
+			expectedOut: []*examplev1.Pod{preset[2].storedObj, preset[4].storedObj},
+		},
+		{
+			name:   "filter returns one item, page size equal to total list size",
+			prefix: "/",
+			pred: storage.SelectionPredicate{
+				Field: fields.OneTermEqualSelector("metadata.name", "fourth"),
+				Label: labels.Everything(),
+				Limit: 5,
+			},
+			expectedOut: []*examplev1.Pod{preset[3].storedObj},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.pred.GetAttrs == nil {
+				tt.pred.GetAttrs = getAttrs
+			}
+
+			out := &examplev1.PodList{}
+			storageOpts := storage.ListOptions{ResourceVersion: tt.rv, ResourceVersionMatch: tt.rvMatch, Predicate: tt.pred}
+			err := store.List(ctx, tt.prefix, storageOpts, out)
+			if tt.expectRVTooLarge {
+				if err == nil || !storage.IsTooLargeResourceVersion(err) {
+					t.Fatalf("expecting resource version too high error, but get: %s", err)
+				}
+				return
+			}
+			if tt.expectRVExpired {
+				if err == nil || !apierrors.IsResourceExpired(err) {
+					t.Fatalf("expecting resource version expired error, but get: %s", err)
+				}
+				return
+			}
+
+			if err != nil {
+				if !tt.expectError {
+					t.Fatalf("List failed: %v", err)
+				}
+				return
+			}
+			if tt.expectError {
+				t.Fatalf("expected error but got none")
+			}
+			if (len(out.Continue) > 0) != tt.expectContinue {
+				t.Errorf("unexpected continue token: %q", out.Continue)
+			}
+
+			// If a client requests an exact resource version, it must be echoed back to them.
+			if tt.expectRV != "" {
+				if tt.expectRV != out.ResourceVersion {
+					t.Errorf("resourceVersion in list response want=%s, got=%s", tt.expectRV, out.ResourceVersion)
+				}
+			}
+			if len(tt.expectedOut) != len(out.Items) {
+				t.Fatalf("length of list want=%d, got=%d", len(tt.expectedOut), len(out.Items))
+			}
+			if e, a := tt.expectedRemainingItemCount, out.ListMeta.GetRemainingItemCount(); (e == nil) != (a == nil) || (e != nil && a != nil && *e != *a) {
+				t.Errorf("remainingItemCount want=%#v, got=%#v", e, a)
+			}
+			for j, wantPod := range tt.expectedOut {
+				getPod := &out.Items[j]
+				if !reflect.DeepEqual(wantPod, getPod) {
+					t.Errorf("pod want=%#v, got=%#v", wantPod, getPod)
+				}
+			}
+		})
+	}
+}
+
+func testConformanceListContinuation(t *testing.T, newBackend conformanceBackend) {
+	ctx, store := newConformanceStore(t, newBackend)
+
+	// Setup storage with the following structure:
+	//  /
+	//   - one-level/
+	//  |            - test
+	//  |
+	//   - two-level/
+	//               - 1/
+	//              |   - test
+	//              |
+	//               - 2/
+	//                  - test
+	//
+	preset := []struct {
+		key       string
+		obj       *examplev1.Pod
+		storedObj *examplev1.Pod
+	}{
+		{
+			key: "/one-level/test",
+			obj: &examplev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "foo"}},
+		},
+		{
+			key: "/two-level/1/test",
+			obj: &examplev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "foo"}},
+		},
+		{
+			key: "/two-level/2/test",
+			obj: &examplev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "bar"}},
+		},
+	}
+
+	for i, ps := range preset {
+		preset[i].storedObj = &examplev1.Pod{}
+		err := store.Create(ctx, ps.key, ps.obj, preset[i].storedObj, 0)
+		if err != nil {
+			t.Fatalf("Set failed: %v", err)
+		}
+	}
+
+	// test continuations
+	out := &examplev1.PodList{}
+	pred := func(limit int64, continueValue string) storage.SelectionPredicate {
+		return storage.SelectionPredicate{
+			Limit:    limit,
+			Continue: continueValue,
+			Label:    labels.Everything(),
+			Field:    fields.Everything(),
+			GetAttrs: func(obj runtime.Object) (labels.Set, fields.Set, error) {
+				pod := obj.(*examplev1.Pod)
+				return nil, fields.Set{"metadata.name": pod.Name}, nil
+			},
+		}
+	}
+	if err := store.List(ctx, "/", storage.ListOptions{ResourceVersion: "0", Predicate: pred(1, "")}, out); err != nil {
+		t.Fatalf("Unable to get initial list: %v", err)
+	}
+	if len(out.Continue) == 0 {
+		t.Fatalf("No continuation token set")
+	}
+	if len(out.Items) != 1 || !reflect.DeepEqual(&out.Items[0], preset[0].storedObj) {
+		t.Fatalf("Unexpected first page: %#v", out.Items)
+	}
+
+	continueFromSecondItem := out.Continue
+
+	// no limit, should get two items
+	out = &examplev1.PodList{}
+	if err := store.List(ctx, "/", storage.ListOptions{ResourceVersion: "0", Predicate: pred(0, continueFromSecondItem)}, out); err != nil {
+		t.Fatalf("Unable to get second page: %v", err)
+	}
+	if len(out.Continue) != 0 {
+		t.Fatalf("Unexpected continuation token set")
+	}
+	if !reflect.DeepEqual(out.Items, []examplev1.Pod{*preset[1].storedObj, *preset[2].storedObj}) {
+		after, err := decodeContinue(continueFromSecondItem, "/")
+		t.Logf("continue token was %s %v", after, err)
+		t.Fatalf("Unexpected second page: %#v", out.Items)
+	}
+
+	// limit, should get two more pages
+	out = &examplev1.PodList{}
+	if err := store.List(ctx, "/", storage.ListOptions{ResourceVersion: "0", Predicate: pred(1, continueFromSecondItem)}, out); err != nil {
+		t.Fatalf("Unable to get second page: %v", err)
+	}
+	if len(out.Continue) == 0 {
+		t.Fatalf("No continuation token set")
+	}
+	if len(out.Items) != 1 || !reflect.DeepEqual(&out.Items[0], preset[1].storedObj) {
+		t.Fatalf("Unexpected second page: %#v", out.Items)
+	}
+
+	continueFromThirdItem := out.Continue
+
+	out = &examplev1.PodList{}
+	if err := store.List(ctx, "/", storage.ListOptions{ResourceVersion: "0", Predicate: pred(1, continueFromThirdItem)}, out); err != nil {
+		t.Fatalf("Unable to get second page: %v", err)
+	}
+	if len(out.Continue) != 0 {
+		t.Fatalf("Unexpected continuation token set")
+	}
+	if len(out.Items) != 1 || !reflect.DeepEqual(&out.Items[0], preset[2].storedObj) {
+		t.Fatalf("Unexpected third page: %#v", out.Items)
+	}
+}
+
+func testConformanceListContinuationWithFilter(t *testing.T, newBackend conformanceBackend) {
+	ctx, store := newConformanceStore(t, newBackend)
+
+	preset := []struct {
+		key       string
+		obj       *examplev1.Pod
+		storedObj *examplev1.Pod
+	}{
+		{
+			key: "/1",
+			obj: &examplev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "foo"}},
+		},
+		{
+			key: "/2",
+			obj: &examplev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "bar"}}, // this should not match
+		},
+		{
+			key: "/3",
+			obj: &examplev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "foo"}},
+		},
+		{
+			key: "/4",
+			obj: &examplev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "foo"}},
+		},
+	}
+
+	for i, ps := range preset {
+		preset[i].storedObj = &examplev1.Pod{}
+		err := store.Create(ctx, ps.key, ps.obj, preset[i].storedObj, 0)
+		if err != nil {
+			t.Fatalf("Set failed: %v", err)
+		}
+	}
+
+	// the first list call should return the first 2 matching items, skipping the one filtered out
+	// there should be a continueValue because there is more data
+	out := &examplev1.PodList{}
+	pred := func(limit int64, continueValue string) storage.SelectionPredicate {
+		return storage.SelectionPredicate{
+			Limit:    limit,
+			Continue: continueValue,
+			Label:    labels.Everything(),
+			Field:    fields.OneTermNotEqualSelector("metadata.name", "bar"),
+			GetAttrs: func(obj runtime.Object) (labels.Set, fields.Set, error) {
+				pod := obj.(*examplev1.Pod)
+				return nil, fields.Set{"metadata.name": pod.Name}, nil
+			},
+		}
+	}
+	if err := store.List(ctx, "/", storage.ListOptions{ResourceVersion: "0", Predicate: pred(2, "")}, out); err != nil {
+		t.Errorf("Unable to get initial list: %v", err)
+	}
+	if len(out.Continue) == 0 {
+		t.Errorf("No continuation token set")
+	}
+	if len(out.Items) != 2 || !reflect.DeepEqual(&out.Items[0], preset[0].storedObj) || !reflect.DeepEqual(&out.Items[1], preset[2].storedObj) {
+		t.Errorf("Unexpected first page, len=%d: %#v", len(out.Items), out.Items)
+	}
+
+	// the rest of the test does not make sense if the previous call failed
+	if t.Failed() {
+		return
+	}
+
+	cont := out.Continue
+
+	// the second list call should try to get 2 more items
+	// but since there is only one item left, that is all we should get with no continueValue
+	out = &examplev1.PodList{}
+	if err := store.List(ctx, "/", storage.ListOptions{ResourceVersion: "0", Predicate: pred(2, cont)}, out); err != nil {
+		t.Errorf("Unable to get second page: %v", err)
+	}
+	if len(out.Continue) != 0 {
+		t.Errorf("Unexpected continuation token set")
+	}
+	if len(out.Items) != 1 || !reflect.DeepEqual(&out.Items[0], preset[3].storedObj) {
+		t.Errorf("Unexpected second page, len=%d: %#v", len(out.Items), out.Items)
+	}
+}
+
+func testConformanceConsistentList(t *testing.T, newBackend conformanceBackend) {
+	ctx, store := newConformanceStore(t, newBackend)
+
+	for i := 1; i <= 5; i++ {
+		name := fmt.Sprintf("pod-%d", i)
+		obj := &examplev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{
+				Name: name,
+				Labels: map[string]string{
+					"even": strconv.FormatBool(i%2 == 0),
+				},
+			},
+		}
+		if err := store.Create(ctx, "/"+name, obj, &examplev1.Pod{}, 0); err != nil {
+			t.Fatalf("failed to create object: %v", err)
+		}
+	}
+
+	getAttrs := func(obj runtime.Object) (labels.Set, fields.Set, error) {
+		pod, ok := obj.(*examplev1.Pod)
+		if !ok {
+			return nil, nil, fmt.Errorf("invalid object")
+		}
+		return labels.Set(pod.Labels), nil, nil
+	}
+	predicate := storage.SelectionPredicate{
+		Label:    labels.Set{"even": "true"}.AsSelector(),
+		GetAttrs: getAttrs,
+		Limit:    4,
+	}
+
+	result1 := examplev1.PodList{}
+	if err := store.List(ctx, "/", storage.ListOptions{Predicate: predicate}, &result1); err != nil {
+		t.Fatalf("failed to list objects: %v", err)
+	}
+
+	// List objects from the returned resource version.
+	options := storage.ListOptions{
+		Predicate:            predicate,
+		ResourceVersion:      result1.ResourceVersion,
+		ResourceVersionMatch: metav1.ResourceVersionMatchExact,
+	}
+
+	result2 := examplev1.PodList{}
+	if err := store.List(ctx, "/", options, &result2); err != nil {
+		t.Fatalf("failed to list objects: %v", err)
+	}
+
+	if !reflect.DeepEqual(result1, result2) {
+		t.Errorf("inconsistent lists: %#v, %#v", result1, result2)
+	}
+
+	// Now also verify the  ResourceVersionMatchNotOlderThan.
+	options.ResourceVersionMatch = metav1.ResourceVersionMatchNotOlderThan
+
+	result3 := examplev1.PodList{}
+	if err := store.List(ctx, "/", options, &result3); err != nil {
+		t.Fatalf("failed to list objects: %v", err)
+	}
+
+	options.ResourceVersion = result3.ResourceVersion
+	options.ResourceVersionMatch = metav1.ResourceVersionMatchExact
+
+	result4 := examplev1.PodList{}
+	if err := store.List(ctx, "/", options, &result4); err != nil {
+		t.Fatalf("failed to list objects: %v", err)
+	}
+
+	if !reflect.DeepEqual(result3, result4) {
+		t.Errorf("inconsistent lists: %#v, %#v", result3, result4)
+	}
+}
+
+type testWatchStruct struct {
+	obj         *examplev1.Pod
+	expectEvent bool
+	watchType   watch.EventType
+}
+
+// testConformanceWatch tests that
+// - first occurrence of objects should notify Add event
+// - update should trigger Modified event
+// - update that gets filtered should trigger Deleted event
+func testConformanceWatch(t *testing.T, newBackend conformanceBackend, recursive bool) {
+	ctx, store := newConformanceStore(t, newBackend)
+	podFoo := &examplev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "foo"}}
+	podBar := &examplev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "bar"}}
+
+	tests := []struct {
+		key        string
+		pred       storage.SelectionPredicate
+		watchTests []*testWatchStruct
+	}{{ // create a key
+		key:        "/somekey-1",
+		watchTests: []*testWatchStruct{{podFoo, true, watch.Added}},
+		pred:       storage.Everything,
+	}, { // create a key but obj gets filtered. Then update it with unfiltered obj
+		key:        "/somekey-3",
+		watchTests: []*testWatchStruct{{podFoo, false, ""}, {podBar, true, watch.Added}},
+		pred: storage.SelectionPredicate{
+			Label: labels.Everything(),
+			Field: fields.ParseSelectorOrDie("metadata.name=bar"),
+			GetAttrs: func(obj runtime.Object) (labels.Set, fields.Set, error) {
+				pod := obj.(*examplev1.Pod)
+				return nil, fields.Set{"metadata.name": pod.Name}, nil
+			},
+		},
+	}, { // update
+		key:        "/somekey-4",
+		watchTests: []*testWatchStruct{{podFoo, true, watch.Added}, {podBar, true, watch.Modified}},
+		pred:       storage.Everything,
+	}, { // delete because of being filtered
+		key:        "/somekey-5",
+		watchTests: []*testWatchStruct{{podFoo, true, watch.Added}, {podBar, true, watch.Deleted}},
+		pred: storage.SelectionPredicate{
+			Label: labels.Everything(),
+			Field: fields.ParseSelectorOrDie("metadata.name!=bar"),
+			GetAttrs: func(obj runtime.Object) (labels.Set, fields.Set, error) {
+				pod := obj.(*examplev1.Pod)
+				return nil, fields.Set{"metadata.name": pod.Name}, nil
+			},
+		},
+	}}
+	for i, tt := range tests {
+		opts := storage.ListOptions{ResourceVersion: "0", Predicate: tt.pred}
+		var (
+			w   watch.Interface
+			err error
+		)
+		if recursive {
+			w, err = store.WatchList(ctx, tt.key, opts)
+		} else {
+			w, err = store.Watch(ctx, tt.key, opts)
+		}
+		if err != nil {
+			t.Fatalf("Watch failed: %v", err)
+		}
+		var prevObj *examplev1.Pod
+		for _, watchTest := range tt.watchTests {
+			out := &examplev1.Pod{}
+			key := tt.key
+			if recursive {
+				key = key + "/item"
+			}
+			err := store.GuaranteedUpdate(ctx, key, out, true, nil, storage.SimpleUpdate(
+				func(runtime.Object) (runtime.Object, error) {
+					return watchTest.obj.DeepCopy(), nil
+				}))
+			if err != nil {
+				t.Fatalf("GuaranteedUpdate failed: %v", err)
+			}
+			if watchTest.expectEvent {
+				expectObj := out
+				if watchTest.watchType == watch.Deleted {
+					expectObj = prevObj
+					expectObj.ResourceVersion = out.ResourceVersion
+				}
+				testCheckResult(t, i, watchTest.watchType, w, expectObj)
+			}
+			prevObj = out
+		}
+		w.Stop()
+		testCheckStop(t, i, w)
+	}
+}
+
+func testConformanceDeleteTriggerWatch(t *testing.T, newBackend conformanceBackend) {
+	ctx, store := newConformanceStore(t, newBackend)
+	key, storedObj := testPropogateStore(ctx, t, store, &examplev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "foo"}})
+	w, err := store.Watch(ctx, key, storage.ListOptions{ResourceVersion: storedObj.ResourceVersion, Predicate: storage.Everything})
+	if err != nil {
+		t.Fatalf("Watch failed: %v", err)
+	}
+	if err := store.Delete(ctx, key, &examplev1.Pod{}, nil, storage.ValidateAllObjectFunc); err != nil {
+		t.Fatalf("Delete failed: %v", err)
+	}
+	testCheckEventType(t, watch.Deleted, w)
+}
+
+// testConformanceWatchFromZero tests that
+// - watch from 0 should sync up and grab the object added before
+// - watch from 0 keeps returning the latest state of the object as it changes
+func testConformanceWatchFromZero(t *testing.T, newBackend conformanceBackend) {
+	ctx, store := newConformanceStore(t, newBackend)
+	key, storedObj := testPropogateStore(ctx, t, store, &examplev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "foo", Namespace: "ns"}})
+
+	w, err := store.Watch(ctx, key, storage.ListOptions{ResourceVersion: "0", Predicate: storage.Everything})
+	if err != nil {
+		t.Fatalf("Watch failed: %v", err)
+	}
+	testCheckResult(t, 0, watch.Added, w, storedObj)
+	w.Stop()
+
+	// Update
+	out := &examplev1.Pod{}
+	err = store.GuaranteedUpdate(ctx, key, out, true, nil, storage.SimpleUpdate(
+		func(runtime.Object) (runtime.Object, error) {
+			return &examplev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "foo", Namespace: "ns", Annotations: map[string]string{"a": "1"}}}, nil
+		}))
+	if err != nil {
+		t.Fatalf("GuaranteedUpdate failed: %v", err)
+	}
+
+	// Make sure when we watch from 0 we receive an ADDED event
+	w, err = store.Watch(ctx, key, storage.ListOptions{ResourceVersion: "0", Predicate: storage.Everything})
+	if err != nil {
+		t.Fatalf("Watch failed: %v", err)
+	}
+	testCheckResult(t, 1, watch.Added, w, out)
+	w.Stop()
+
+	// Update again
+	out = &examplev1.Pod{}
+	err = store.GuaranteedUpdate(ctx, key, out, true, nil, storage.SimpleUpdate(
+		func(runtime.Object) (runtime.Object, error) {
+			return &examplev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "foo", Namespace: "ns"}}, nil
+		}))
+	if err != nil {
+		t.Fatalf("GuaranteedUpdate failed: %v", err)
+	}
+
+	// Make sure we can still watch from 0 and receive an ADDED event
+	w, err = store.Watch(ctx, key, storage.ListOptions{ResourceVersion: "0", Predicate: storage.Everything})
+	if err != nil {
+		t.Fatalf("Watch failed: %v", err)
+	}
+	testCheckResult(t, 2, watch.Added, w, out)
+}
+
+// testConformanceWatchFromNoneZero tests that
+// - watch from non-0 should just watch changes after given version
+func testConformanceWatchFromNoneZero(t *testing.T, newBackend conformanceBackend) {
+	ctx, store := newConformanceStore(t, newBackend)
+	key, storedObj := testPropogateStore(ctx, t, store, &examplev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "foo"}})
+
+	w, err := store.Watch(ctx, key, storage.ListOptions{ResourceVersion: storedObj.ResourceVersion, Predicate: storage.Everything})
+	if err != nil {
+		t.Fatalf("Watch failed: %v", err)
+	}
+	out := &examplev1.Pod{}
+	err = store.GuaranteedUpdate(ctx, key, out, true, nil, storage.SimpleUpdate(
+		func(runtime.Object) (runtime.Object, error) {
+			return &examplev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "bar"}}, nil
+		}))
+	if err != nil {
+		t.Fatalf("GuaranteedUpdate failed: %v", err)
+	}
+	testCheckResult(t, 0, watch.Modified, w, out)
+}
+
+func testConformanceWatchError(t *testing.T, newBackend conformanceBackend) {
+	backend := newBackend(t)
+	sharedBackend := func(*testing.T) Backend { return backend }
+	validTransformer, err := NewKeyring(Key{Name: "test", Secret: []byte("abcdefghijklmnop")})
+	if err != nil {
+		t.Fatalf("NewKeyring failed: %v", err)
+	}
+	invalidTransformer, err := NewKeyring(Key{Name: "test", Secret: []byte("ponmlkjihgfedcba")})
+	if err != nil {
+		t.Fatalf("NewKeyring failed: %v", err)
+	}
+
+	ctx, invalidStore := newConformanceStore(t, sharedBackend)
+	if err := invalidStore.SetTransformer(invalidTransformer); err != nil {
+		t.Fatalf("SetTransformer failed: %v", err)
+	}
+	w, err := invalidStore.Watch(ctx, "/abc", storage.ListOptions{ResourceVersion: "0", Predicate: storage.Everything})
+	if err != nil {
+		t.Fatalf("Watch failed: %v", err)
+	}
+	_, validStore := newConformanceStore(t, sharedBackend)
+	if err := validStore.SetTransformer(validTransformer); err != nil {
+		t.Fatalf("SetTransformer failed: %v", err)
+	}
+	validStore.GuaranteedUpdate(ctx, "/abc", &examplev1.Pod{}, true, nil, storage.SimpleUpdate(
+		func(runtime.Object) (runtime.Object, error) {
+			return &examplev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "foo"}}, nil
+		}))
+	testCheckEventType(t, watch.Error, w)
+}
+
+func testConformanceWatchContextCancel(t *testing.T, newBackend conformanceBackend) {
+	ctx, store := newConformanceStore(t, newBackend)
+	canceledCtx, cancel := context.WithCancel(ctx)
+	cancel()
+	// When we watch with a canceled context, we should detect that it's context canceled.
+	// We won't take it as error and also close the watcher.
+	w, err := store.Watch(canceledCtx, "/abc", storage.ListOptions{ResourceVersion: "0", Predicate: storage.Everything})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case _, ok := <-w.ResultChan():
+		if ok {
+			t.Error("ResultChan() should be closed")
+		}
+	case <-time.After(wait.ForeverTestTimeout):
+		t.Errorf("timeout after %v", wait.ForeverTestTimeout)
+	}
+}
+
+func testConformanceWatchErrResultNotBlockAfterCancel(t *testing.T, newBackend conformanceBackend) {
+	origCtx, store := newConformanceStore(t, newBackend)
+	ctx, cancel := context.WithCancel(origCtx)
+	// make the incoming and result channels blocking to ensure ordering.
+	w := &watcher{
+		key:       "/abc",
+		pred:      storage.Everything,
+		versioner: store.versioner,
+		incoming:  make(chan change),
+		result:    make(chan watch.Event),
+		done:      make(chan struct{}),
+		remove:    func(*watcher) {},
+	}
+	// The event flow goes like:
+	// - first we send a change, it should block on result.
+	// - Then we cancel ctx. The blocking on result should be freed up
+	//   and run() goroutine should return.
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		w.run(ctx, nil)
+		wg.Done()
+	}()
+	w.incoming <- change{key: "/abc", cur: &examplev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "foo"}}}
+	cancel()
+	wg.Wait()
+}
+
+func testConformanceWatchDeleteEventObjectHaveLatestRV(t *testing.T, newBackend conformanceBackend) {
+	ctx, store := newConformanceStore(t, newBackend)
+	key, storedObj := testPropogateStore(ctx, t, store, &examplev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "foo"}})
+
+	w, err := store.Watch(ctx, key, storage.ListOptions{ResourceVersion: storedObj.ResourceVersion, Predicate: storage.Everything})
+	if err != nil {
+		t.Fatalf("Watch failed: %v", err)
+	}
+	// The object is deleted when its manifest is
+	deletedRevs := make(chan uint64, 1)
+	if _, err := store.backend.Watch(ctx, func(blob *Blob, deleted bool) {
+		if deleted && isManifest(blob) && blobKey(blob) == key {
+			deletedRevs <- listVersion(blob.GetResourceVersion())
+		}
+	}); err != nil {
+		t.Fatalf("Watch failed: %v", err)
+	}
+
+	if err := store.Delete(ctx, key, &examplev1.Pod{}, &storage.Preconditions{}, storage.ValidateAllObjectFunc); err != nil {
+		t.Fatalf("Delete failed: %v", err)
+	}
+
+	e := <-w.ResultChan()
+	watchedDeleteObj := e.Object.(*examplev1.Pod)
+	deletedRev := <-deletedRevs
+
+	watchedDeleteRev, err := store.versioner.ParseResourceVersion(watchedDeleteObj.ResourceVersion)
+	if err != nil {
+		t.Fatalf("ParseWatchResourceVersion failed: %v", err)
+	}
+	if watchedDeleteRev != deletedRev {
+		t.Errorf("Object from delete event have version: %v, should be the same as the manifest deletion's version: %d",
+			watchedDeleteRev, deletedRev)
+	}
+}
@@ -0,0 +1,483 @@
+package cmstore
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	utilrand "k8s.io/apimachinery/pkg/util/rand"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/apimachinery/pkg/util/uuid"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/apimachinery/pkg/util/wait"
+	toolscache "k8s.io/client-go/tools/cache"
+)
+
+const (
+	// dataFileSuffix names the file holding the content of a blob.
+	dataFileSuffix = ".data"
+	// metaFileSuffix names the sidecar file holding the metadata of a blob.
+	metaFileSuffix = ".meta.json"
+	// revisionFileName names the file holding the revision of the last write.
+	revisionFileName = ".revision"
+	// lockFileName names the file writers lock.
+	lockFileName = ".lock"
+
+	// defaultDirPollPeriod is how often a directory is checked for changes made by other processes.
+	defaultDirPollPeriod = time.Second
+)
+
+// DirBackend keeps blobs in a local directory, so stores and streams can run without a cluster.
+//
+// Each blob is a data file holding its content next to a JSON sidecar holding its metadata, so both can be inspected
+// with ordinary tools. Files are replaced by atomic renames and a lock file keeps writers in other processes out.
+// Like the API server, it versions every write with a single, increasing revision.
+type DirBackend struct {
+	dir        string
+	pollPeriod time.Duration
+
+	mu       sync.Mutex
+	seen     map[string]metav1.ObjectMeta
+	handlers []func(blob *Blob, deleted bool)
+}
+
+var _ Backend = &DirBackend{}
+
+// NewDirBackend returns a backend that keeps blobs in dir, creating it if it doesn't exist.
+func NewDirBackend(dir string) (*DirBackend, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	return &DirBackend{
+		dir:        dir,
+		pollPeriod: defaultDirPollPeriod,
+	}, nil
+}
+
+func (b *DirBackend) Create(_ context.Context, blob *Blob) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.locked(true, func() error {
+		created := blob.DeepCopy()
+		if created.GetName() == "" {
+			if created.GetGenerateName() == "" {
+				return apierrors.NewBadRequest("name or generateName is required")
+			}
+			created.SetName(created.GetGenerateName() + utilrand.String(5))
+		}
+
+		_, err := b.read(created.GetName())
+		if err == nil {
+			return apierrors.NewAlreadyExists(blobResource, created.GetName())
+		}
+		if !apierrors.IsNotFound(err) {
+			return err
+		}
+
+		created.SetUID(uuid.NewUUID())
+		created.SetCreationTimestamp(metav1.Now().Rfc3339Copy())
+		if err := b.write(created); err != nil {
+			return err
+		}
+		*blob = *created.DeepCopy()
+
+		return nil
+	})
+}
+
+func (b *DirBackend) Get(_ context.Context, name string) (blob *Blob, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	err = b.locked(false, func() (err error) {
+		blob, err = b.read(name)
+		return
+	})
+
+	return
+}
+
+func (b *DirBackend) Update(_ context.Context, blob *Blob) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.locked(true, func() error {
+		stored, err := b.read(blob.GetName())
+		if err != nil {
+			return err
+		}
+		if rv := blob.GetResourceVersion(); rv != "" && rv != stored.GetResourceVersion() {
+			return apierrors.NewConflict(blobResource, blob.GetName(), errStaleBlob)
+		}
+
+		updated := blob.DeepCopy()
+		updated.SetUID(stored.GetUID())
+		updated.SetCreationTimestamp(stored.GetCreationTimestamp())
+		if err := b.write(updated); err != nil {
+			return err
+		}
+		*blob = *updated.DeepCopy()
+
+		return nil
+	})
+}
+
+func (b *DirBackend) Delete(_ context.Context, blob *Blob) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.locked(true, func() error {
+		stored, err := b.read(blob.GetName())
+		if err != nil {
+			return err
+		}
+		if uid := blob.GetUID(); uid != "" && uid != stored.GetUID() {
+			return apierrors.NewConflict(blobResource, blob.GetName(), errStaleBlob)
+		}
+		if rv := blob.GetResourceVersion(); rv != "" && rv != stored.GetResourceVersion() {
+			return apierrors.NewConflict(blobResource, blob.GetName(), errStaleBlob)
+		}
+
+		// The sidecar marks a blob as present, so it goes first
+		if err := os.Remove(b.path(stored.GetName(), metaFileSuffix)); err != nil {
+			return err
+		}
+		if err := os.Remove(b.path(stored.GetName(), dataFileSuffix)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		revision, err := b.nextRevision()
+		if err != nil {
+			return err
+		}
+		// Like the API server, deletions are observed at the revision they were made at
+		stored.SetResourceVersion(strconv.FormatUint(revision, 10))
+		b.observe(stored, true)
+
+		return nil
+	})
+}
+
+func (b *DirBackend) List(_ context.Context, selector labels.Selector) (blobs []Blob, resourceVersion string, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	err = b.locked(false, func() error {
+		stored, err := b.scan()
+		if err != nil {
+			return err
+		}
+		for _, blob := range stored {
+			if selector.Matches(labels.Set(blob.GetLabels())) {
+				blobs = append(blobs, *blob)
+			}
+		}
+		sort.Slice(blobs, func(i, j int) bool {
+			return blobs[i].GetName() < blobs[j].GetName()
+		})
+
+		revision, err := b.revision()
+		resourceVersion = strconv.FormatUint(revision, 10)
+
+		return err
+	})
+
+	return
+}
+
+func (b *DirBackend) ListMetadata(ctx context.Context, selector labels.Selector) ([]Blob, string, error) {
+	blobs, resourceVersion, err := b.List(ctx, selector)
+	for i := range blobs {
+		blobs[i].Data = nil
+	}
+
+	return blobs, resourceVersion, err
+}
+
+// Watch calls handler with every change made through the backend as it's made.
+// Changes made by other processes are only seen while the backend is started.
+// Handlers are called while writes are blocked, so they must not call back into the backend.
+func (b *DirBackend) Watch(_ context.Context, handler func(blob *Blob, deleted bool)) (toolscache.InformerSynced, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var (
+		stored   map[string]*Blob
+		revision uint64
+	)
+	if err := b.locked(false, func() (err error) {
+		if stored, err = b.scan(); err != nil {
+			return
+		}
+		revision, err = b.revision()
+		return
+	}); err != nil {
+		return nil, err
+	}
+	b.sync(stored, revision)
+
+	names := make([]string, 0, len(stored))
+	for name := range stored {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		handler(stored[name].DeepCopy(), false)
+	}
+	b.handlers = append(b.handlers, handler)
+
+	return func() bool { return true }, nil
+}
+
+// Start polls the directory for changes made by other processes until the context is done.
+func (b *DirBackend) Start(ctx context.Context) error {
+	wait.UntilWithContext(ctx, func(context.Context) {
+		if err := b.poll(); err != nil {
+			utilruntime.HandleError(fmt.Errorf("failed to poll %s for changes: %v", b.dir, err))
+		}
+	}, b.pollPeriod)
+
+	return nil
+}
+
+// poll tells watchers about changes made since the directory was last read.
+func (b *DirBackend) poll() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if len(b.handlers) < 1 {
+		return nil
+	}
+
+	return b.locked(false, func() error {
+		stored, err := b.scan()
+		if err != nil {
+			return err
+		}
+		revision, err := b.revision()
+		if err != nil {
+			return err
+		}
+		b.sync(stored, revision)
+
+		return nil
+	})
+}
+
+// sync brings the blobs watchers have seen up to date with the stored ones, telling them about every difference in the
+// order it was made, up to the given revision.
+// Callers must hold the lock.
+func (b *DirBackend) sync(stored map[string]*Blob, revision uint64) {
+	if b.seen == nil {
+		b.seen = map[string]metav1.ObjectMeta{}
+	}
+
+	type difference struct {
+		blob    *Blob
+		deleted bool
+	}
+	var differences []difference
+	for name, meta := range b.seen {
+		if _, ok := stored[name]; !ok {
+			// The revision it was deleted at went with it, so it's observed at the latest one it could have been
+			deleted := &Blob{ObjectMeta: *meta.DeepCopy()}
+			deleted.SetResourceVersion(strconv.FormatUint(revision, 10))
+			differences = append(differences, difference{blob: deleted, deleted: true})
+		}
+	}
+	for name, blob := range stored {
+		if seen, ok := b.seen[name]; !ok || seen.GetResourceVersion() != blob.GetResourceVersion() {
+			differences = append(differences, difference{blob: blob})
+		}
+	}
+
+	// Watchers expect changes in the order they were made, e.g. partitions before the manifest committing them
+	sort.Slice(differences, func(i, j int) bool {
+		vi, vj := listVersion(differences[i].blob.GetResourceVersion()), listVersion(differences[j].blob.GetResourceVersion())
+		if vi != vj {
+			return vi < vj
+		}
+		return differences[i].blob.GetName() < differences[j].blob.GetName()
+	})
+	for _, d := range differences {
+		b.observe(d.blob, d.deleted)
+	}
+}
+
+// observe records a change for watchers and tells them about it.
+// Nothing is recorded until the first watch, which reads everything there is anyway.
+// Callers must hold the lock.
+func (b *DirBackend) observe(blob *Blob, deleted bool) {
+	if b.seen == nil {
+		return
+	}
+
+	if deleted {
+		delete(b.seen, blob.GetName())
+	} else {
+		b.seen[blob.GetName()] = *blob.ObjectMeta.DeepCopy()
+	}
+
+	for _, handler := range b.handlers {
+		handler(blob.DeepCopy(), deleted)
+	}
+}
+
+// locked runs fn while holding the lock file, shared with other readers unless exclusive.
+func (b *DirBackend) locked(exclusive bool, fn func() error) error {
+	f, err := os.OpenFile(filepath.Join(b.dir, lockFileName), os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if err := lockFile(f, exclusive); err != nil {
+		return fmt.Errorf("failed to lock %s: %v", b.dir, err)
+	}
+	defer unlockFile(f)
+
+	return fn()
+}
+
+// path returns the path of a file belonging to the named blob.
+func (b *DirBackend) path(name, suffix string) string {
+	return filepath.Join(b.dir, name+suffix)
+}
+
+// read returns the named blob.
+// Callers must hold the lock file.
+func (b *DirBackend) read(name string) (*Blob, error) {
+	if errs := validation.IsDNS1123Subdomain(name); len(errs) > 0 {
+		return nil, apierrors.NewBadRequest(fmt.Sprintf("invalid blob name %q: %s", name, strings.Join(errs, ", ")))
+	}
+
+	meta, err := ioutil.ReadFile(b.path(name, metaFileSuffix))
+	if os.IsNotExist(err) {
+		return nil, apierrors.NewNotFound(blobResource, name)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	blob := &Blob{}
+	if err := json.Unmarshal(meta, &blob.ObjectMeta); err != nil {
+		return nil, fmt.Errorf("failed to read metadata of blob %s: %v", name, err)
+	}
+	if blob.Data, err = ioutil.ReadFile(b.path(name, dataFileSuffix)); err != nil {
+		return nil, err
+	}
+
+	return blob, nil
+}
+
+// scan returns every stored blob by name.
+// Callers must hold the lock file.
+func (b *DirBackend) scan() (map[string]*Blob, error) {
+	files, err := ioutil.ReadDir(b.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	blobs := map[string]*Blob{}
+	for _, file := range files {
+		name := file.Name()
+		if strings.HasPrefix(name, ".") || !strings.HasSuffix(name, metaFileSuffix) {
+			continue
+		}
+
+		name = strings.TrimSuffix(name, metaFileSuffix)
+		blob, err := b.read(name)
+		if err != nil {
+			return nil, err
+		}
+		blobs[name] = blob
+	}
+
+	return blobs, nil
+}
+
+// write stores a blob at the next revision and tells watchers about it.
+// The content is written before the sidecar, so a blob is never seen without it.
+// Callers must hold the lock file exclusively.
+func (b *DirBackend) write(blob *Blob) error {
+	if errs := validation.IsDNS1123Subdomain(blob.GetName()); len(errs) > 0 {
+		return apierrors.NewBadRequest(fmt.Sprintf("invalid blob name %q: %s", blob.GetName(), strings.Join(errs, ", ")))
+	}
+
+	revision, err := b.nextRevision()
+	if err != nil {
+		return err
+	}
+	blob.SetResourceVersion(strconv.FormatUint(revision, 10))
+
+	meta, err := json.MarshalIndent(blob.ObjectMeta, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := b.replace(b.path(blob.GetName(), dataFileSuffix), blob.Data); err != nil {
+		return err
+	}
+	if err := b.replace(b.path(blob.GetName(), metaFileSuffix), meta); err != nil {
+		return err
+	}
+	b.observe(blob, false)
+
+	return nil
+}
+
+// revision returns the revision of the last write.
+// Callers must hold the lock file.
+func (b *DirBackend) revision() (uint64, error) {
+	data, err := ioutil.ReadFile(filepath.Join(b.dir, revisionFileName))
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	return strconv.ParseUint(strings.TrimSpace(string(data)), 10, 64)
+}
+
+// nextRevision records a new write and returns its revision.
+// Callers must hold the lock file exclusively.
+func (b *DirBackend) nextRevision() (uint64, error) {
+	revision, err := b.revision()
+	if err != nil {
+		return 0, err
+	}
+	revision++
+
+	return revision, b.replace(filepath.Join(b.dir, revisionFileName), []byte(strconv.FormatUint(revision, 10)+"\n"))
+}
+
+// replace atomically replaces the file at path with one holding data.
+func (b *DirBackend) replace(path string, data []byte) error {
+	tmp, err := ioutil.TempFile(b.dir, "."+filepath.Base(path)+".tmp-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
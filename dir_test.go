@@ -0,0 +1,205 @@
+package cmstore
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+// newTestDirBackend returns a backend kept in a directory removed when the test ends.
+func newTestDirBackend(t *testing.T) *DirBackend {
+	dir, err := ioutil.TempDir("", "cmstore-")
+	if err != nil {
+		t.Fatalf("failed to create directory: %v", err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	backend, err := NewDirBackend(dir)
+	if err != nil {
+		t.Fatalf("failed to create backend: %v", err)
+	}
+
+	return backend
+}
+
+func TestDirBackend(t *testing.T) {
+	testBackend(t, newTestDirBackend(t))
+}
+
+func TestDirBackendFiles(t *testing.T) {
+	var (
+		ctx     = context.Background()
+		backend = newTestDirBackend(t)
+		blob    = &Blob{Data: []byte("Hello, world!")}
+	)
+	blob.SetName("my-blob")
+	blob.SetLabels(map[string]string{labelKey: "default/my-config"})
+	if err := backend.Create(ctx, blob); err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+
+	// Partitions can be inspected without going through the backend
+	data, err := ioutil.ReadFile(filepath.Join(backend.dir, "my-blob"+dataFileSuffix))
+	if err != nil {
+		t.Fatalf("failed to read data file: %v", err)
+	}
+	if !bytes.Equal(data, blob.Data) {
+		t.Errorf("expected data file to hold %q, got %q", blob.Data, data)
+	}
+	meta, err := ioutil.ReadFile(filepath.Join(backend.dir, "my-blob"+metaFileSuffix))
+	if err != nil {
+		t.Fatalf("failed to read metadata file: %v", err)
+	}
+	if !bytes.Contains(meta, []byte(`"stream.x-k8s.io/key": "default/my-config"`)) || !bytes.Contains(meta, []byte(`"resourceVersion": "1"`)) {
+		t.Errorf("expected metadata file to hold labels and resource version, got %s", meta)
+	}
+
+	// Names can't escape the directory
+	escaping := &Blob{}
+	escaping.SetName("../escaped")
+	if err := backend.Create(ctx, escaping); err == nil {
+		t.Errorf("expected a name outside the directory to be rejected")
+	}
+}
+
+func TestDirBackendPoll(t *testing.T) {
+	var (
+		ctx, cancel = context.WithCancel(context.Background())
+		backend     = newTestDirBackend(t)
+		changes     = make(chan *Blob, 10)
+	)
+	defer cancel()
+
+	backend.pollPeriod = 10 * time.Millisecond
+	go backend.Start(ctx)
+
+	if _, err := backend.Watch(ctx, func(blob *Blob, deleted bool) {
+		if deleted {
+			blob = nil
+		}
+		changes <- blob
+	}); err != nil {
+		t.Fatalf("Watch failed: %v", err)
+	}
+
+	// Another process writing to the same directory
+	other, err := NewDirBackend(backend.dir)
+	if err != nil {
+		t.Fatalf("failed to create backend: %v", err)
+	}
+	blob := &Blob{Data: []byte("Hello, world!")}
+	blob.SetName("my-blob")
+	if err := other.Create(ctx, blob); err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+	select {
+	case got := <-changes:
+		if got == nil || !bytes.Equal(got.Data, blob.Data) {
+			t.Errorf("expected the created blob, got %v", got)
+		}
+	case <-time.After(wait.ForeverTestTimeout):
+		t.Fatalf("timed out waiting for the change to be polled")
+	}
+
+	if err := other.Delete(ctx, blob); err != nil {
+		t.Fatalf("Delete failed: %v", err)
+	}
+	select {
+	case got := <-changes:
+		if got != nil {
+			t.Errorf("expected a deletion, got %v", got)
+		}
+	case <-time.After(wait.ForeverTestTimeout):
+		t.Fatalf("timed out waiting for the change to be polled")
+	}
+}
+
+func TestDirBackendPollOrder(t *testing.T) {
+	var (
+		ctx      = context.Background()
+		backend  = newTestDirBackend(t)
+		versions []uint64
+		deleted  []bool
+	)
+	if _, err := backend.Watch(ctx, func(blob *Blob, d bool) {
+		versions = append(versions, listVersion(blob.GetResourceVersion()))
+		deleted = append(deleted, d)
+	}); err != nil {
+		t.Fatalf("Watch failed: %v", err)
+	}
+	expectOrdered := func(expectDeleted bool) {
+		for i := range versions {
+			if i > 0 && versions[i] < versions[i-1] {
+				t.Errorf("expected changes in the order they were made, got versions %v", versions)
+				break
+			}
+			if deleted[i] != expectDeleted {
+				t.Errorf("expected deleted to be %t, got changes %v", expectDeleted, deleted)
+				break
+			}
+		}
+	}
+
+	// Another process making several changes between polls
+	other, err := NewDirBackend(backend.dir)
+	if err != nil {
+		t.Fatalf("failed to create backend: %v", err)
+	}
+	var blobs []*Blob
+	for i := 0; i < 16; i++ {
+		blob := &Blob{Data: []byte("Hello, world!")}
+		blob.SetName(fmt.Sprintf("blob-%d", i))
+		if err := other.Create(ctx, blob); err != nil {
+			t.Fatalf("Create failed: %v", err)
+		}
+		blobs = append(blobs, blob)
+	}
+	if err := backend.poll(); err != nil {
+		t.Fatalf("failed to poll: %v", err)
+	}
+	if len(versions) != len(blobs) {
+		t.Fatalf("expected %d changes to be polled, got %d", len(blobs), len(versions))
+	}
+	expectOrdered(false)
+	written := versions[len(versions)-1]
+
+	// Deletions are observed after the writes that came before them
+	versions, deleted = nil, nil
+	for _, blob := range blobs {
+		if err := other.Delete(ctx, blob); err != nil {
+			t.Fatalf("Delete failed: %v", err)
+		}
+	}
+	if err := backend.poll(); err != nil {
+		t.Fatalf("failed to poll: %v", err)
+	}
+	if len(versions) != len(blobs) || versions[0] <= written {
+		t.Errorf("expected %d deletions after version %d, got versions %v", len(blobs), written, versions)
+	}
+	expectOrdered(true)
+}
+
+func TestDirStreamRoundTrip(t *testing.T) {
+	var (
+		stream = NewBackendStream(newTestDirBackend(t), "streamer")
+		in     = []byte("Hello, world!")
+	)
+	if _, err := stream.Write(in); err != nil {
+		t.Fatalf("failed to write data: %s", err)
+	}
+
+	out, err := ioutil.ReadAll(stream)
+	if err != nil {
+		t.Fatalf("failed to read data: %s", err)
+	}
+	if !bytes.Equal(out, in) {
+		t.Errorf("output %q doesn't match input %q", out, in)
+	}
+}
@@ -0,0 +1,223 @@
+package cmstore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/apiserver/pkg/registry/generic"
+	"k8s.io/apiserver/pkg/storage"
+	"k8s.io/apiserver/pkg/storage/storagebackend"
+	"k8s.io/apiserver/pkg/storage/storagebackend/factory"
+	toolscache "k8s.io/client-go/tools/cache"
+	"sigs.k8s.io/controller-runtime/pkg/cache"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const (
+	// defaultSegmentSize is the number of encoded bytes kept in each partition when no segment size is configured.
+	// It leaves plenty of room under the ConfigMap size limit.
+	defaultSegmentSize = 512 * 1024
+	// defaultCountMetricPollPeriod is how often the number of stored objects is counted for metrics.
+	defaultCountMetricPollPeriod = time.Minute
+)
+
+// Config describes how to build ConfigMapStores for API resources, in the vein of storagebackend.Config.
+type Config struct {
+	// Client reads and writes partitions.
+	Client client.Client
+	// Informers serve the partitions in Namespace to watches.
+	Informers cache.Informers
+	// Secrets keeps partitions in Secrets instead of ConfigMaps.
+	Secrets bool
+	// Namespace is the storage namespace partitions are kept in.
+	Namespace string
+	// Codec encodes stored objects, e.g. as JSON, YAML or protobuf with a codec from NewCodec.
+	// When unset, the codec from the storagebackend.Config given to the decorator is used.
+	Codec runtime.Codec
+	// SegmentSize is the number of encoded bytes kept in each partition.
+	// Defaults to 512KiB, unless there's a Budget.
+	SegmentSize int
+	// Budget is the most bytes each stored blob may take, metadata and encoding overhead included, e.g.
+	// EtcdRequestLimit. Partitions are packed with as much data as fits when set, in place of SegmentSize.
+	Budget int
+	// Compression compresses encoded objects before they're split into partitions when set.
+	Compression Compression
+	// Transformer transforms segments before they're stored when set, e.g. a Keyring to encrypt them.
+	Transformer Transformer
+	// OwnerReferences maps the ownerReferences of stored objects onto the blobs stored for them when set, e.g.
+	// CopyOwnerReferences. It must only return references to cluster-scoped owners and owners in Namespace, since the
+	// garbage collector deletes blobs whose namespaced owners aren't found in their own namespace.
+	OwnerReferences OwnerReferencesFunc
+	// GarbageCollection periodically collects partitions no object commits when set.
+	GarbageCollection *GCOptions
+	// ContentAddressable keeps partitions in segments shared by every object storing the same data.
+	// Segments are only deleted by garbage collection, so it requires GarbageCollection.
+	ContentAddressable bool
+	// Cache serves reads and watches from objects kept in memory when set, reading through to the store for consistent
+	// reads.
+	Cache *CacheOptions
+	// Backend keeps partitions in place of Client, Informers and Namespace when set, e.g. a DirBackend to run
+	// without a cluster. A DirBackend is started along with the store, so it sees changes made by other processes.
+	Backend Backend
+}
+
+// Create returns a store for the objects allocated by newFunc, and a func that stops its background work.
+// The store takes every key in the storage namespace as its own, so it must be the only one keeping objects there;
+// stores sharing the namespace are built by StorageDecorator, scoped to their resource prefix.
+func (c Config) Create(newFunc func() runtime.Object) (storage.Interface, factory.DestroyFunc, error) {
+	return c.create("", newFunc)
+}
+
+// create returns a store for the objects allocated by newFunc, scoped to the keys below prefix.
+func (c Config) create(prefix string, newFunc func() runtime.Object) (storage.Interface, factory.DestroyFunc, error) {
+	switch {
+	case c.Backend == nil && c.Client == nil:
+		return nil, nil, errors.New("a client is required")
+	case c.Backend == nil && c.Informers == nil:
+		return nil, nil, errors.New("informers are required")
+	case c.Backend == nil && c.Namespace == "":
+		return nil, nil, errors.New("a storage namespace is required")
+	case c.Codec == nil:
+		return nil, nil, errors.New("a codec is required")
+	case c.SegmentSize < 0:
+		return nil, nil, errors.New("segment size must not be negative")
+	case c.SegmentSize > 0 && c.Budget != 0:
+		return nil, nil, errors.New("segment size and budget are mutually exclusive")
+	case c.ContentAddressable && c.GarbageCollection == nil:
+		return nil, nil, errors.New("content addressable storage requires garbage collection")
+	case c.GarbageCollection != nil && c.GarbageCollection.GracePeriod < 0:
+		return nil, nil, errors.New("garbage collection grace period must not be negative")
+	case c.Cache != nil && c.Cache.History < 0:
+		return nil, nil, errors.New("cache history must not be negative")
+	}
+	if err := c.Compression.Validate(); err != nil {
+		return nil, nil, err
+	}
+
+	segmentSize := c.SegmentSize
+	if segmentSize == 0 {
+		segmentSize = defaultSegmentSize
+	}
+	if c.Budget == 0 {
+		stored := encodedSegmentSize(segmentSize, c.Compression)
+		if budgeted, ok := c.Transformer.(BudgetedTransformer); ok {
+			overhead, _ := budgeted.Overhead()
+			stored += overhead
+		}
+		if stored > ConfigMapDataLimit-len(streamObjKey) {
+			return nil, nil, fmt.Errorf("segment size of %d bytes takes %d bytes once encoded, more than the %d bytes a ConfigMap holds", segmentSize, stored, ConfigMapDataLimit)
+		}
+	}
+
+	backend := c.Backend
+	switch {
+	case backend != nil:
+	case c.Secrets:
+		backend = NewSecretBackend(c.Client, c.Informers, c.Namespace)
+	default:
+		backend = NewConfigMapBackend(c.Client, c.Informers, c.Namespace)
+	}
+	partitioner := NewCodecPartitioner(c.Codec, segmentSize)
+	partitioner.SetCompression(c.Compression)
+	store := NewBackendStore(backend, partitioner, newFunc)
+	if c.Transformer != nil {
+		if err := store.SetTransformer(c.Transformer); err != nil {
+			return nil, nil, err
+		}
+	}
+	if err := store.SetBudget(c.Budget); err != nil {
+		return nil, nil, err
+	}
+	if c.OwnerReferences != nil {
+		store.SetOwnerReferences(c.OwnerReferences)
+	}
+	if c.GarbageCollection != nil {
+		store.SetGarbageCollection(*c.GarbageCollection)
+	}
+	store.SetContentAddressable(c.ContentAddressable)
+	store.SetPrefix(prefix)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go store.Start(ctx)
+	if dir, ok := backend.(*DirBackend); ok {
+		go dir.Start(ctx)
+	}
+
+	if c.Cache != nil {
+		// Start caching right away, so there's history to resume watches from by the time they're made
+		cacher := NewCacher(store, *c.Cache)
+		go func() {
+			if err := cacher.start(ctx); err != nil {
+				utilruntime.HandleError(fmt.Errorf("failed to start cache: %v", err))
+			}
+		}()
+
+		return cacher, factory.DestroyFunc(cancel), nil
+	}
+
+	return store, factory.DestroyFunc(cancel), nil
+}
+
+// StorageDecorator returns a generic.StorageDecorator that builds ConfigMapStores in place of etcd-backed storage.
+func (c Config) StorageDecorator() generic.StorageDecorator {
+	return func(
+		config *storagebackend.Config,
+		resourcePrefix string,
+		keyFunc func(obj runtime.Object) (string, error),
+		newFunc func() runtime.Object,
+		newListFunc func() runtime.Object,
+		getAttrsFunc storage.AttrFunc,
+		trigger storage.IndexerFuncs,
+		indexers *toolscache.Indexers) (storage.Interface, factory.DestroyFunc, error) {
+		// Decorators are reused across resources, so each store gets its own copy of the config
+		cfg := c
+		if cfg.Codec == nil && config != nil {
+			cfg.Codec = config.Codec
+		}
+
+		// Registries root the keys of a resource at its prefix, with a leading slash whether it's given one or not
+		if !strings.HasPrefix(resourcePrefix, "/") {
+			resourcePrefix = "/" + resourcePrefix
+		}
+
+		return cfg.create(resourcePrefix, newFunc)
+	}
+}
+
+// RESTOptionsGetter hands generic registries options that store every resource in ConfigMaps.
+type RESTOptionsGetter struct {
+	Config
+
+	// EnableGarbageCollection is passed through to the registries.
+	EnableGarbageCollection bool
+	// DeleteCollectionWorkers is passed through to the registries.
+	// Defaults to 1.
+	DeleteCollectionWorkers int
+}
+
+var _ generic.RESTOptionsGetter = RESTOptionsGetter{}
+
+// GetRESTOptions implements generic.RESTOptionsGetter.
+func (g RESTOptionsGetter) GetRESTOptions(resource schema.GroupResource) (generic.RESTOptions, error) {
+	workers := g.DeleteCollectionWorkers
+	if workers < 1 {
+		workers = 1
+	}
+
+	return generic.RESTOptions{
+		StorageConfig: &storagebackend.Config{
+			Codec: g.Codec,
+		},
+		Decorator:               g.StorageDecorator(),
+		EnableGarbageCollection: g.EnableGarbageCollection,
+		DeleteCollectionWorkers: workers,
+		ResourcePrefix:          resource.Group + "/" + resource.Resource,
+		CountMetricPollPeriod:   defaultCountMetricPollPeriod,
+	}, nil
+}
@@ -0,0 +1,202 @@
+package cmstore
+
+import (
+	"bytes"
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/runtime/serializer"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/apiserver/pkg/apis/example"
+	examplev1 "k8s.io/apiserver/pkg/apis/example/v1"
+	"k8s.io/apiserver/pkg/storage"
+	"k8s.io/apiserver/pkg/storage/storagebackend"
+)
+
+func newExampleCodec() runtime.Codec {
+	scheme := runtime.NewScheme()
+	metav1.AddToGroupVersion(scheme, metav1.SchemeGroupVersion)
+	utilruntime.Must(example.AddToScheme(scheme))
+	utilruntime.Must(examplev1.AddToScheme(scheme))
+
+	return serializer.NewCodecFactory(scheme).LegacyCodec(examplev1.SchemeGroupVersion)
+}
+
+func TestRESTOptionsGetter(t *testing.T) {
+	c, informers := newTestInformers(newTestClient(t))
+	getter := RESTOptionsGetter{
+		Config: Config{
+			Client:      c,
+			Informers:   informers,
+			Namespace:   "storage",
+			Codec:       newExampleCodec(),
+			SegmentSize: 64,
+		},
+	}
+
+	opts, err := getter.GetRESTOptions(schema.GroupResource{Group: example.GroupName, Resource: "pods"})
+	if err != nil {
+		t.Fatalf("GetRESTOptions failed: %v", err)
+	}
+	if opts.ResourcePrefix != example.GroupName+"/pods" {
+		t.Errorf("unexpected resource prefix: %s", opts.ResourcePrefix)
+	}
+
+	newFunc := func() runtime.Object { return &example.Pod{} }
+	newListFunc := func() runtime.Object { return &example.PodList{} }
+	s, destroy, err := opts.Decorator(opts.StorageConfig, opts.ResourcePrefix, nil, newFunc, newListFunc, storage.DefaultNamespaceScopedAttr, nil, nil)
+	if err != nil {
+		t.Fatalf("failed to decorate storage: %v", err)
+	}
+	defer destroy()
+	if prefix := s.(*ConfigMapStore).prefix; prefix != "/"+opts.ResourcePrefix+"/" {
+		t.Errorf("expected the store to be scoped to the resource prefix, got %q", prefix)
+	}
+
+	// Internal objects go through the codec, so they're stored in their versioned form
+	ctx := context.Background()
+	key := "/" + opts.ResourcePrefix + "/ns/foo"
+	in := &example.Pod{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "ns", Name: "foo"},
+		Spec:       example.PodSpec{NodeName: "node-1", RestartPolicy: example.RestartPolicy("Always")},
+	}
+	created := &example.Pod{}
+	if err := s.Create(ctx, key, in, created, 0); err != nil {
+		t.Fatalf("Set failed: %v", err)
+	}
+
+	out := &example.Pod{}
+	if err := s.Get(ctx, key, storage.GetOptions{}, out); err != nil {
+		t.Fatalf("Get failed: %v", err)
+	}
+	if !reflect.DeepEqual(created, out) {
+		t.Errorf("pod want=%#v, get=%#v", created, out)
+	}
+	if out.Spec.NodeName != "node-1" {
+		t.Errorf("expected spec to round-trip, got %#v", out.Spec)
+	}
+
+	partitions, _, err := s.(*ConfigMapStore).partitions(ctx, key)
+	if err != nil {
+		t.Fatalf("failed to list partitions: %v", err)
+	}
+	var segments bytes.Buffer
+	for _, p := range partitions {
+		segments.Write(p.Data)
+	}
+	data, err := readSegments(&segments)
+	if err != nil {
+		t.Fatalf("failed to read segments: %v", err)
+	}
+	if !bytes.Contains(data, []byte(`"apiVersion":"example.apiserver.k8s.io/v1"`)) {
+		t.Errorf("expected the versioned form to be stored, got %s", data)
+	}
+
+	list := &example.PodList{}
+	if err := s.List(ctx, "/"+opts.ResourcePrefix, storage.ListOptions{Predicate: storage.Everything}, list); err != nil {
+		t.Fatalf("List failed: %v", err)
+	}
+	if len(list.Items) != 1 || !reflect.DeepEqual(&list.Items[0], created) {
+		t.Errorf("unexpected list: %#v", list.Items)
+	}
+}
+
+func TestStorageDecoratorCodec(t *testing.T) {
+	c, informers := newTestInformers(newTestClient(t))
+	decorator := Config{
+		Client:    c,
+		Informers: informers,
+		Namespace: "storage",
+	}.StorageDecorator()
+	newFunc := func() runtime.Object { return &example.Pod{} }
+	newListFunc := func() runtime.Object { return &example.PodList{} }
+
+	// Each resource is stored with the codec it's decorated with, even when the decorator is reused
+	for _, codec := range []runtime.Codec{newExampleCodec(), newExampleCodec()} {
+		s, destroy, err := decorator(&storagebackend.Config{Codec: codec}, "pods", nil, newFunc, newListFunc, storage.DefaultNamespaceScopedAttr, nil, nil)
+		if err != nil {
+			t.Fatalf("failed to decorate storage: %v", err)
+		}
+		defer destroy()
+		if got := s.(*ConfigMapStore).partitioner.(*CodecPartitioner).codec; got != codec {
+			t.Errorf("expected the store to use the codec it was decorated with")
+		}
+	}
+}
+
+func TestConfigCreate(t *testing.T) {
+	c, informers := newTestInformers(newTestClient(t))
+	valid := Config{
+		Client:    c,
+		Informers: informers,
+		Namespace: "storage",
+		Codec:     newExampleCodec(),
+	}
+	newFunc := func() runtime.Object { return &example.Pod{} }
+
+	for name, mutate := range map[string]func(*Config){
+		"no client":           func(c *Config) { c.Client = nil },
+		"no informers":        func(c *Config) { c.Informers = nil },
+		"no namespace":        func(c *Config) { c.Namespace = "" },
+		"no codec":            func(c *Config) { c.Codec = nil },
+		"negative segment":    func(c *Config) { c.SegmentSize = -1 },
+		"bad compression":     func(c *Config) { c.Compression = Compression("lz4") },
+		"negative grace":      func(c *Config) { c.GarbageCollection = &GCOptions{GracePeriod: -time.Second} },
+		"oversized segment":   func(c *Config) { c.SegmentSize = ConfigMapDataLimit },
+		"segment and budget":  func(c *Config) { c.SegmentSize, c.Budget = 1024, EtcdRequestLimit },
+		"oversized budget":    func(c *Config) { c.Budget = EtcdRequestLimit + 1 },
+		"undersized budget":   func(c *Config) { c.Budget = 1024 },
+		"negative history":    func(c *Config) { c.Cache = &CacheOptions{History: -1} },
+		"segments without gc": func(c *Config) { c.ContentAddressable = true },
+	} {
+		config := valid
+		mutate(&config)
+		if _, _, err := config.Create(newFunc); err == nil {
+			t.Errorf("%s: expected an invalid config to be rejected", name)
+		}
+	}
+
+	s, destroy, err := valid.Create(newFunc)
+	if err != nil {
+		t.Fatalf("failed to create store: %v", err)
+	}
+	defer destroy()
+
+	if partitioner := s.(*ConfigMapStore).partitioner.(*CodecPartitioner); partitioner.segmentSize != defaultSegmentSize {
+		t.Errorf("expected the default segment size, got %d", partitioner.segmentSize)
+	}
+	if kind := s.(*ConfigMapStore).backend.(*kubeBackend).kind.listGVK.Kind; kind != "ConfigMapList" {
+		t.Errorf("expected partitions to be kept in ConfigMaps, got %s", kind)
+	}
+
+	valid.Secrets = true
+	s, destroySecrets, err := valid.Create(newFunc)
+	if err != nil {
+		t.Fatalf("failed to create store: %v", err)
+	}
+	defer destroySecrets()
+
+	if kind := s.(*ConfigMapStore).backend.(*kubeBackend).kind.listGVK.Kind; kind != "SecretList" {
+		t.Errorf("expected partitions to be kept in Secrets, got %s", kind)
+	}
+
+	// A backend stands in for the cluster
+	local := Config{
+		Codec:   newExampleCodec(),
+		Backend: newTestDirBackend(t),
+	}
+	s, destroyLocal, err := local.Create(newFunc)
+	if err != nil {
+		t.Fatalf("failed to create store: %v", err)
+	}
+	defer destroyLocal()
+
+	if _, ok := s.(*ConfigMapStore).backend.(*DirBackend); !ok {
+		t.Errorf("expected partitions to be kept in the given backend, got %T", s.(*ConfigMapStore).backend)
+	}
+}
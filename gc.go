@@ -0,0 +1,230 @@
+package cmstore
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/selection"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+)
+
+// defaultGCGracePeriod is how long partitions are left alone after they're created before they can be collected.
+const defaultGCGracePeriod = 5 * time.Minute
+
+// GCOptions configures garbage collection of partitions no object commits.
+type GCOptions struct {
+	// GracePeriod is how long partitions are left alone after they're created, and segments after they're last
+	// acquired, so the partitions of writes in progress aren't collected before they're committed. It should be longer
+	// than any write takes.
+	// Defaults to 5 minutes.
+	GracePeriod time.Duration
+	// DryRun reports what would be collected without deleting anything.
+	DryRun bool
+	// Report is called with what each background collection removed when set.
+	Report func(GCReport)
+}
+
+// GCReport describes the partitions and segments removed by a garbage collection.
+type GCReport struct {
+	// DryRun is true when nothing was actually deleted.
+	DryRun bool
+	// Removed lists the removed partitions, ordered by key and name, segments first.
+	Removed []CollectedPartition
+}
+
+// CollectedPartition is a partition removed by garbage collection, a segment nothing refers to, or a manifest that
+// reserved a key nothing was ever committed to.
+type CollectedPartition struct {
+	// Key is the key the partition was written for, empty for segments.
+	Key string
+	// Name is the name of the partition.
+	Name string
+	// Orphaned is true when nothing is committed for the key, and false when the partition isn't part of what is.
+	Orphaned bool
+	// Created is when the partition was created.
+	Created time.Time
+}
+
+// SetGarbageCollection makes Start periodically collect partitions no object commits with the given options.
+func (s *ConfigMapStore) SetGarbageCollection(opts GCOptions) {
+	s.gc = &opts
+}
+
+// CollectGarbage deletes the partitions no manifest commits, and the manifests that never committed any, that are
+// older than the grace period: the leftovers of failed creates, crashed writers and replaced generations.
+// Segments are deleted once every reference to them is released, or once nothing refers to them for the grace period
+// when their references were leaked, e.g. by crashed writers or streams deleted by the cluster garbage collector.
+// Deletions are conditional on the partitions listed, so partitions that change in the meantime survive.
+func (s *ConfigMapStore) CollectGarbage(ctx context.Context, opts GCOptions) (GCReport, error) {
+	report := GCReport{DryRun: opts.DryRun}
+	if opts.GracePeriod < 0 {
+		return report, fmt.Errorf("grace period must not be negative")
+	}
+	grace := opts.GracePeriod
+	if grace == 0 {
+		grace = defaultGCGracePeriod
+	}
+
+	stored, err := labels.NewRequirement(labelKey, selection.Exists, nil)
+	if err != nil {
+		return report, err
+	}
+	committed, err := labels.NewRequirement(manifestLabelKey, selection.Exists, nil)
+	if err != nil {
+		return report, err
+	}
+
+	// List segments before what refers to them, and partitions before manifests, so everything committed by the time
+	// manifests are listed is known to be
+	segmentsSelector, err := segmentSelector()
+	if err != nil {
+		return report, err
+	}
+	segments, _, err := s.backend.ListMetadata(ctx, segmentsSelector)
+	if err != nil {
+		return report, err
+	}
+	blobs, _, err := s.backend.ListMetadata(ctx, labels.NewSelector().Add(*stored))
+	if err != nil {
+		return report, err
+	}
+	manifests, _, err := s.backend.List(ctx, labels.NewSelector().Add(*stored, *committed))
+	if err != nil {
+		return report, err
+	}
+
+	// Keys with unreadable manifests are left alone, there's no telling what they commit
+	var (
+		keyed      = map[string]map[string]bool{}
+		refs       = map[string]int{}
+		unreadable bool
+	)
+	for i := range manifests {
+		key := blobKey(&manifests[i])
+		m, err := readManifest(&manifests[i])
+		if err != nil {
+			keyed[key] = nil
+			unreadable = true
+			continue
+		}
+
+		names := map[string]bool{}
+		for _, entry := range m.Partitions {
+			names[entry.Name] = true
+			refs[entry.Name]++
+		}
+		keyed[key] = names
+	}
+	for i := range blobs {
+		if name, ok := blobs[i].GetAnnotations()[contentAnnotationKey]; ok {
+			refs[name]++
+		}
+	}
+
+	var (
+		now  = s.clock.Now()
+		errs []error
+	)
+	for i := range segments {
+		segment := &segments[i]
+		switch {
+		case segmentRefs(segment) < 1:
+			// Released by everything that referred to it
+		case unreadable, refs[segment.GetName()] > 0, now.Sub(segmentAcquired(segment)) < grace:
+			// Referred to, possibly by a write in progress
+			continue
+		}
+
+		if !opts.DryRun {
+			err := s.backend.Delete(ctx, segment)
+			if apierrors.IsNotFound(err) || apierrors.IsConflict(err) {
+				// Deleted, or acquired again in the meantime
+				continue
+			}
+			if err != nil {
+				errs = append(errs, err)
+				continue
+			}
+		}
+
+		report.Removed = append(report.Removed, CollectedPartition{
+			Name:     segment.GetName(),
+			Orphaned: true,
+			Created:  segment.GetCreationTimestamp().Time,
+		})
+	}
+	for i := range blobs {
+		var (
+			blob      = &blobs[i]
+			key       = blobKey(blob)
+			names, ok = keyed[key]
+		)
+		switch _, partition := blob.GetAnnotations()[generationAnnotationKey]; {
+		case isManifest(blob):
+			if isCommitted(blob) {
+				continue
+			}
+			// A reservation nothing was ever committed to
+		case !partition:
+			// Not a partition, e.g. a stream element
+			continue
+		case ok && (names == nil || names[blob.GetName()]):
+			continue
+		}
+
+		created := blob.GetCreationTimestamp().Time
+		if now.Sub(created) < grace {
+			// Possibly part of a write in progress
+			continue
+		}
+
+		if !opts.DryRun {
+			err := s.backend.Delete(ctx, blob)
+			if apierrors.IsNotFound(err) || apierrors.IsConflict(err) {
+				// Deleted or changed by someone else, leave it to them
+				continue
+			}
+			if err != nil {
+				errs = append(errs, err)
+				continue
+			}
+		}
+
+		report.Removed = append(report.Removed, CollectedPartition{
+			Key:      key,
+			Name:     blob.GetName(),
+			Orphaned: len(names) < 1,
+			Created:  created,
+		})
+	}
+
+	sort.Slice(report.Removed, func(i, j int) bool {
+		a, b := report.Removed[i], report.Removed[j]
+		if a.Key != b.Key {
+			return a.Key < b.Key
+		}
+		return a.Name < b.Name
+	})
+
+	return report, utilerrors.NewAggregate(errs)
+}
+
+// collect runs a background garbage collection, if enabled.
+func (s *ConfigMapStore) collect(ctx context.Context) {
+	if s.gc == nil {
+		return
+	}
+
+	report, err := s.CollectGarbage(ctx, *s.gc)
+	if err != nil {
+		utilruntime.HandleError(fmt.Errorf("failed to collect garbage: %v", err))
+	}
+	if s.gc.Report != nil {
+		s.gc.Report(report)
+	}
+}
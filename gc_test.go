@@ -0,0 +1,120 @@
+package cmstore
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/clock"
+	"k8s.io/apiserver/pkg/storage"
+)
+
+func TestCollectGarbage(t *testing.T) {
+	var (
+		ctx     = context.Background()
+		backend = NewMemoryBackend()
+		store   = NewBackendStore(backend, NewPartitioner(64), func() runtime.Object { return &corev1.ConfigMap{} })
+		fake    = clock.NewFakeClock(time.Now())
+		key     = "default/my-config"
+		in      = &corev1.ConfigMap{}
+	)
+	store.clock = fake
+
+	in.SetName("my-config")
+	in.Data = map[string]string{"greeting": fmt.Sprintf("%128s", "Hello, world!")}
+	if err := store.Create(ctx, key, in, nil, 0); err != nil {
+		t.Fatalf("Set failed: %v", err)
+	}
+
+	// Leave behind the partitions of a write that never committed and of an object that was never created
+	leave := func(key string) []*Blob {
+		partitions, err := store.split(key, &corev1.ConfigMap{Data: map[string]string{"greeting": "Goodbye!"}}, time.Time{})
+		if err != nil {
+			t.Fatalf("failed to split object: %v", err)
+		}
+		for _, p := range partitions {
+			if err := backend.Create(ctx, p); err != nil {
+				t.Fatalf("failed to create partition: %v", err)
+			}
+		}
+
+		return partitions
+	}
+	stale := leave(key)
+	orphaned := leave("default/never-created")
+	if _, err := store.reserve(ctx, "default/never-committed"); err != nil {
+		t.Fatalf("failed to reserve key: %v", err)
+	}
+	collectable := len(stale) + len(orphaned) + 1
+
+	// Streams share the key label, but aren't partitions
+	stream := NewBackendStream(backend, "my-stream")
+	if _, err := stream.Write([]byte("Hello, stream!")); err != nil {
+		t.Fatalf("failed to write to stream: %v", err)
+	}
+
+	opts := GCOptions{GracePeriod: time.Minute}
+	report, err := store.CollectGarbage(ctx, opts)
+	if err != nil {
+		t.Fatalf("CollectGarbage failed: %v", err)
+	}
+	if len(report.Removed) > 0 {
+		t.Errorf("expected partitions within the grace period to be left alone, removed %v", report.Removed)
+	}
+
+	fake.Step(2 * time.Minute)
+	opts.DryRun = true
+	if report, err = store.CollectGarbage(ctx, opts); err != nil {
+		t.Fatalf("CollectGarbage failed: %v", err)
+	}
+	if !report.DryRun || len(report.Removed) != collectable {
+		t.Errorf("expected %d blobs to be reported, got %v", collectable, report.Removed)
+	}
+	for _, removed := range report.Removed {
+		if removed.Orphaned != (removed.Key != key) {
+			t.Errorf("partition %s of %s reported orphaned: %t", removed.Name, removed.Key, removed.Orphaned)
+		}
+	}
+	if partitions, _, err := store.partitions(ctx, key); err != nil || len(partitions) <= len(stale) {
+		t.Errorf("expected a dry run to leave partitions alone, found %d: %v", len(partitions), err)
+	}
+
+	opts.DryRun = false
+	if report, err = store.CollectGarbage(ctx, opts); err != nil {
+		t.Fatalf("CollectGarbage failed: %v", err)
+	}
+	if report.DryRun || len(report.Removed) != collectable {
+		t.Errorf("expected %d blobs to be removed, got %v", collectable, report.Removed)
+	}
+
+	// Only what's committed is left
+	blobs, _, err := store.blobs(ctx, key)
+	if err != nil {
+		t.Fatalf("failed to list blobs: %v", err)
+	}
+	_, committed, err := store.committed(key, blobs)
+	if err != nil {
+		t.Fatalf("failed to find committed partitions: %v", err)
+	}
+	if len(blobs) != len(committed)+1 {
+		t.Errorf("expected only the manifest and %d committed partitions to be left, found %d blobs", len(committed), len(blobs))
+	}
+	if partitions, _, err := store.partitions(ctx, "default/never-created"); err != nil || len(partitions) > 0 {
+		t.Errorf("expected orphaned partitions to be removed, found %d: %v", len(partitions), err)
+	}
+	if reserved, _, err := store.blobs(ctx, "default/never-committed"); err != nil || len(reserved) > 0 {
+		t.Errorf("expected the reservation to be removed, found %d blobs: %v", len(reserved), err)
+	}
+	out := &corev1.ConfigMap{}
+	if err := store.Get(ctx, key, storage.GetOptions{}, out); err != nil || out.Data["greeting"] != in.Data["greeting"] {
+		t.Errorf("expected the object to survive, got %v: %v", out.Data, err)
+	}
+	data, err := ioutil.ReadAll(NewBackendStream(backend, "my-stream"))
+	if err != nil || string(data) != "Hello, stream!" {
+		t.Errorf("expected the stream to survive, got %q: %v", data, err)
+	}
+}
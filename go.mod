@@ -3,6 +3,8 @@ module github.com/njhale/cmstore
 go 1.14
 
 require (
+	github.com/klauspost/compress v1.11.3
+	github.com/modern-go/reflect2 v1.0.2 // indirect
 	github.com/spf13/cobra v1.1.1
 	github.com/spf13/pflag v1.0.5
 	github.com/stretchr/testify v1.6.1
@@ -10,5 +12,7 @@ require (
 	k8s.io/apimachinery v0.20.0
 	k8s.io/apiserver v0.19.2
 	k8s.io/cli-runtime v0.20.0
+	k8s.io/client-go v0.20.0
 	sigs.k8s.io/controller-runtime v0.7.0
+	sigs.k8s.io/yaml v1.2.0
 )
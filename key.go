@@ -0,0 +1,105 @@
+package cmstore
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/selection"
+)
+
+// keyLabel returns the label value the blobs stored for key are selected by.
+// Storage keys contain slashes and are often longer than the 63 characters a label value may hold, so they're hashed,
+// and the key itself is kept in an annotation.
+func keyLabel(key string) string {
+	sum := sha256.Sum224([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// prefixLabelKey returns the label holding the hash of the directory a key is stored below at the given depth.
+func prefixLabelKey(depth int) string {
+	return fmt.Sprintf("%s/prefix-%d", streamPrefix, depth)
+}
+
+// keyPrefixes returns the directories a key is stored below, from the root down, e.g. "/", "/registry/" and
+// "/registry/widgets/" for "/registry/widgets/foo".
+func keyPrefixes(key string) []string {
+	var prefixes []string
+	for i := range key {
+		if key[i] == '/' {
+			prefixes = append(prefixes, key[:i+1])
+		}
+	}
+
+	return prefixes
+}
+
+// stampKey labels a blob with the hashes of the key it's stored for and of every directory above it, and annotates it
+// with the key itself.
+func stampKey(key string, blob metav1.Object) {
+	labels := blob.GetLabels()
+	if labels == nil {
+		labels = map[string]string{}
+	}
+	labels[labelKey] = keyLabel(key)
+	for depth, prefix := range keyPrefixes(key) {
+		labels[prefixLabelKey(depth)] = keyLabel(prefix)
+	}
+	blob.SetLabels(labels)
+
+	annotations := blob.GetAnnotations()
+	if annotations == nil {
+		annotations = map[string]string{}
+	}
+	annotations[keyAnnotationKey] = key
+	blob.SetAnnotations(annotations)
+}
+
+// blobKey returns the key a blob was stored for.
+func blobKey(blobMeta metav1.Object) string {
+	return blobMeta.GetAnnotations()[keyAnnotationKey]
+}
+
+// keySelector selects the blobs stored for key, along with those of any other key whose hash collides with it.
+func keySelector(key string) labels.Selector {
+	return labels.Set{
+		labelKey: keyLabel(key),
+	}.AsSelector()
+}
+
+// prefixSelector selects the blobs stored for keys below the directory prefix ends in, along with those of any other
+// directory whose hash collides with it. Every stored blob is selected when there's no directory.
+func prefixSelector(prefix string) (labels.Selector, error) {
+	stored, err := labels.NewRequirement(labelKey, selection.Exists, nil)
+	if err != nil {
+		return nil, err
+	}
+	selector := labels.NewSelector().Add(*stored)
+
+	prefixes := keyPrefixes(prefix)
+	if len(prefixes) < 1 {
+		return selector, nil
+	}
+
+	depth := len(prefixes) - 1
+	below, err := labels.NewRequirement(prefixLabelKey(depth), selection.Equals, []string{keyLabel(prefixes[depth])})
+	if err != nil {
+		return nil, err
+	}
+
+	return selector.Add(*below), nil
+}
+
+// forKey returns the blobs stored for key among those selected for it, dropping any stored for a colliding key.
+func forKey(key string, blobs []Blob) []Blob {
+	var matching []Blob
+	for i := range blobs {
+		if blobKey(&blobs[i]) == key {
+			matching = append(matching, blobs[i])
+		}
+	}
+
+	return matching
+}
@@ -0,0 +1,220 @@
+package cmstore
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/selection"
+	"k8s.io/apimachinery/pkg/util/clock"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/apiserver/pkg/storage"
+)
+
+func TestKeys(t *testing.T) {
+	var (
+		ctx     = context.Background()
+		backend = NewMemoryBackend()
+		store   = NewBackendStore(backend, NewPartitioner(64), func() runtime.Object { return &corev1.ConfigMap{} })
+		prefix  = "/registry/example.apiserver.k8s.io/configmaps/" + strings.Repeat("namespace", 7)
+		long    = prefix + "/My_Config!"
+		other   = prefix + "/other-config"
+	)
+	create := func(key, greeting string) {
+		in := &corev1.ConfigMap{}
+		in.SetName(key[strings.LastIndex(key, "/")+1:])
+		in.Data = map[string]string{"greeting": fmt.Sprintf("%128s", greeting)}
+		if err := store.Create(ctx, key, in, nil, 0); err != nil {
+			t.Fatalf("Set failed: %v", err)
+		}
+	}
+	get := func(key, greeting string) {
+		out := &corev1.ConfigMap{}
+		if err := store.Get(ctx, key, storage.GetOptions{}, out); err != nil {
+			t.Fatalf("Get failed: %v", err)
+		}
+		if out.Data["greeting"] != fmt.Sprintf("%128s", greeting) {
+			t.Errorf("expected greeting %q, got %q", greeting, out.Data["greeting"])
+		}
+	}
+	stored := func() []Blob {
+		requirement, err := labels.NewRequirement(labelKey, selection.Exists, nil)
+		if err != nil {
+			t.Fatalf("failed to select blobs: %v", err)
+		}
+		blobs, _, err := backend.List(ctx, labels.NewSelector().Add(*requirement))
+		if err != nil {
+			t.Fatalf("failed to list blobs: %v", err)
+		}
+
+		return blobs
+	}
+
+	// Keys too long for a label value and full of characters labels can't hold are stored all the same
+	if len(long) <= validation.LabelValueMaxLength {
+		t.Fatalf("expected a key longer than a label value")
+	}
+	create(long, "Hello, world!")
+	create(other, "Hello, other!")
+	for _, blob := range stored() {
+		if errs := validation.IsValidLabelValue(blob.GetLabels()[labelKey]); len(errs) > 0 {
+			t.Errorf("expected blob %s to have a valid key label: %v", blob.GetName(), errs)
+		}
+		if key := blobKey(&blob); key != long && key != other {
+			t.Errorf("expected blob %s to be annotated with its key, got %q", blob.GetName(), key)
+		}
+	}
+	get(long, "Hello, world!")
+	if count, err := store.Count(prefix); err != nil || count != 2 {
+		t.Errorf("expected 2 objects to be counted, got %d: %v", count, err)
+	}
+
+	// Blobs of a key whose hash collides are never read as the key's own
+	for _, blob := range stored() {
+		if blobKey(&blob) != other {
+			continue
+		}
+		blob.Labels[labelKey] = keyLabel(long)
+		if err := backend.Update(ctx, &blob); err != nil {
+			t.Fatalf("failed to update blob: %v", err)
+		}
+	}
+	get(long, "Hello, world!")
+
+	list := &corev1.ConfigMapList{}
+	if err := store.List(ctx, prefix, storage.ListOptions{Predicate: storage.Everything}, list); err != nil {
+		t.Fatalf("List failed: %v", err)
+	}
+	if len(list.Items) != 2 {
+		t.Errorf("expected colliding keys to be listed apart, got %d objects", len(list.Items))
+	}
+}
+
+// selectingBackend is a Backend that records the blobs listed from it.
+type selectingBackend struct {
+	Backend
+	listed []Blob
+}
+
+func (b *selectingBackend) List(ctx context.Context, selector labels.Selector) ([]Blob, string, error) {
+	blobs, resourceVersion, err := b.Backend.List(ctx, selector)
+	b.listed = append(b.listed, blobs...)
+	return blobs, resourceVersion, err
+}
+
+func (b *selectingBackend) ListMetadata(ctx context.Context, selector labels.Selector) ([]Blob, string, error) {
+	blobs, resourceVersion, err := b.Backend.ListMetadata(ctx, selector)
+	b.listed = append(b.listed, blobs...)
+	return blobs, resourceVersion, err
+}
+
+func TestPrefixes(t *testing.T) {
+	var (
+		ctx     = context.Background()
+		backend = &selectingBackend{Backend: NewMemoryBackend()}
+		store   = NewBackendStore(backend, NewPartitioner(64), func() runtime.Object { return &corev1.ConfigMap{} })
+		keys    = []string{
+			"/registry/widgets/ns1/a",
+			"/registry/widgets/ns1/b",
+			"/registry/widgets/ns10/c",
+			"/registry/widgets/ns2/d",
+			"/registry/gadgets/ns1/e",
+		}
+	)
+	for _, key := range keys {
+		in := &corev1.ConfigMap{}
+		in.SetName(key[strings.LastIndex(key, "/")+1:])
+		in.Data = map[string]string{"greeting": fmt.Sprintf("%128s", "Hello, "+in.GetName()+"!")}
+		if err := store.Create(ctx, key, in, nil, 0); err != nil {
+			t.Fatalf("Set failed: %v", err)
+		}
+	}
+
+	for _, tc := range []struct {
+		prefix   string
+		expected []string
+	}{
+		{prefix: "/registry/widgets/ns1/", expected: []string{"a", "b"}},
+		{prefix: "/registry/widgets/ns1", expected: []string{"a", "b"}},
+		{prefix: "/registry/widgets/", expected: []string{"a", "b", "c", "d"}},
+		{prefix: "/registry/", expected: []string{"e", "a", "b", "c", "d"}},
+		{prefix: "/registry/widgets/ns3/"},
+	} {
+		// Only the blobs of keys below the prefix are listed from the backend
+		backend.listed = nil
+		list := &corev1.ConfigMapList{}
+		if err := store.List(ctx, tc.prefix, storage.ListOptions{Predicate: storage.Everything}, list); err != nil {
+			t.Fatalf("List failed: %v", err)
+		}
+		var names []string
+		for _, item := range list.Items {
+			names = append(names, item.GetName())
+		}
+		if fmt.Sprint(names) != fmt.Sprint(tc.expected) {
+			t.Errorf("expected %v to be listed below %q, got %v", tc.expected, tc.prefix, names)
+		}
+
+		below := strings.TrimSuffix(tc.prefix, "/") + "/"
+		for _, blob := range backend.listed {
+			if key := blobKey(&blob); !strings.HasPrefix(key, below) {
+				t.Errorf("expected only blobs below %q to be listed, got %s of %q", tc.prefix, blob.GetName(), key)
+			}
+		}
+
+		backend.listed = nil
+		if count, err := store.Count(tc.prefix); err != nil || count != int64(len(tc.expected)) {
+			t.Errorf("expected %d objects to be counted below %q, got %d: %v", len(tc.expected), tc.prefix, count, err)
+		}
+		if len(backend.listed) != len(tc.expected) {
+			t.Errorf("expected only the manifests below %q to be listed, got %d", tc.prefix, len(backend.listed))
+		}
+	}
+}
+
+func TestStorePrefix(t *testing.T) {
+	var (
+		ctx        = context.Background()
+		backend    = NewMemoryBackend()
+		configMaps = NewBackendStore(backend, NewPartitioner(64), func() runtime.Object { return &corev1.ConfigMap{} })
+		namespaces = NewBackendStore(backend, NewPartitioner(64), func() runtime.Object { return &corev1.Namespace{} })
+		fake       = clock.NewFakeClock(time.Now())
+		key        = "/configmaps/default/my-config"
+		in         = &corev1.ConfigMap{}
+	)
+	configMaps.SetPrefix("/configmaps")
+	namespaces.SetPrefix("/namespaces")
+	namespaces.clock = fake
+
+	in.SetName("my-config")
+	in.Data = map[string]string{"greeting": "Hello, world!"}
+	if err := configMaps.Create(ctx, key, in, nil, 10); err != nil {
+		t.Fatalf("Set failed: %v", err)
+	}
+
+	// Other stores' objects are never watched or cached as their own
+	cacher := NewCacher(namespaces, CacheOptions{})
+	w, err := cacher.WatchList(ctx, "/", storage.ListOptions{ResourceVersion: "0", Predicate: storage.Everything})
+	if err != nil {
+		t.Fatalf("Watch failed: %v", err)
+	}
+	defer w.Stop()
+	expectNoEvent(t, w)
+	if err := cacher.Get(ctx, key, storage.GetOptions{ResourceVersion: "0"}, &corev1.Namespace{}); !storage.IsNotFound(err) {
+		t.Errorf("expected another store's object not to be cached, got %v", err)
+	}
+
+	// Nor reaped
+	fake.Step(time.Minute)
+	if err := namespaces.reap(ctx); err != nil {
+		t.Fatalf("reap failed: %v", err)
+	}
+	out := &corev1.ConfigMap{}
+	if err := configMaps.Get(ctx, key, storage.GetOptions{}, out); err != nil || out.Data["greeting"] != "Hello, world!" {
+		t.Errorf("expected another store's object to be left alone, got %v: %v", out.Data, err)
+	}
+}
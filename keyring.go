@@ -0,0 +1,127 @@
+package cmstore
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	"sigs.k8s.io/yaml"
+)
+
+// Key is a named AES key.
+type Key struct {
+	// Name identifies the key in the partitions it encrypts.
+	Name string `json:"name"`
+	// Secret is a 16, 24 or 32 byte AES key, base64 encoded in keyring files.
+	Secret []byte `json:"secret"`
+}
+
+// keyringFile is the format of keyring files.
+type keyringFile struct {
+	Keys []Key `json:"keys"`
+}
+
+// Keyring is a Transformer that encrypts segments with AES-GCM.
+// Segments are always encrypted with the newest key, but can be decrypted with any key on the keyring, so keys can be
+// rotated by adding a new key, rewriting stored objects, then dropping the old key.
+type Keyring struct {
+	newest string
+	aeads  map[string]cipher.AEAD
+}
+
+var _ BudgetedTransformer = &Keyring{}
+
+// NewKeyring returns a keyring holding the given keys, newest first.
+func NewKeyring(keys ...Key) (*Keyring, error) {
+	if len(keys) < 1 {
+		return nil, errors.New("a keyring needs at least one key")
+	}
+
+	k := &Keyring{
+		newest: keys[0].Name,
+		aeads:  map[string]cipher.AEAD{},
+	}
+	for _, key := range keys {
+		if key.Name == "" {
+			return nil, errors.New("keys must be named")
+		}
+		if _, ok := k.aeads[key.Name]; ok {
+			return nil, fmt.Errorf("duplicate key %s", key.Name)
+		}
+
+		block, err := aes.NewCipher(key.Secret)
+		if err != nil {
+			return nil, fmt.Errorf("invalid key %s: %v", key.Name, err)
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, fmt.Errorf("invalid key %s: %v", key.Name, err)
+		}
+		k.aeads[key.Name] = aead
+	}
+
+	return k, nil
+}
+
+// LoadKeyring reads a keyring from a YAML or JSON file listing keys, newest first:
+//
+//	keys:
+//	- name: key2
+//	  secret: <base64 encoded key>
+//	- name: key1
+//	  secret: <base64 encoded key>
+func LoadKeyring(path string) (*Keyring, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var file keyringFile
+	if err := yaml.UnmarshalStrict(data, &file); err != nil {
+		return nil, fmt.Errorf("failed to parse keyring %s: %v", path, err)
+	}
+
+	return NewKeyring(file.Keys...)
+}
+
+// TransformToStorage implements Transformer.
+func (k *Keyring) TransformToStorage(data, context []byte) ([]byte, string, error) {
+	aead := k.aeads[k.newest]
+
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(data)+aead.Overhead())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, "", fmt.Errorf("failed to generate nonce: %v", err)
+	}
+
+	return aead.Seal(nonce, nonce, data, context), k.newest, nil
+}
+
+// TransformFromStorage implements Transformer.
+func (k *Keyring) TransformFromStorage(data, context []byte, keyID string) ([]byte, bool, error) {
+	aead, ok := k.aeads[keyID]
+	if !ok {
+		return nil, false, fmt.Errorf("unknown key %s", keyID)
+	}
+	if len(data) < aead.NonceSize() {
+		return nil, false, errors.New("data is too short to have been encrypted")
+	}
+
+	nonce, ciphertext := data[:aead.NonceSize()], data[aead.NonceSize():]
+	out, err := aead.Open(nil, nonce, ciphertext, context)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to decrypt with key %s: %v", keyID, err)
+	}
+
+	return out, keyID != k.newest, nil
+}
+
+// Overhead implements BudgetedTransformer.
+// Segments are only ever encrypted with the newest key, so only it adds to what's stored.
+func (k *Keyring) Overhead() (int, int) {
+	aead := k.aeads[k.newest]
+	return aead.NonceSize() + aead.Overhead(), len(k.newest)
+}
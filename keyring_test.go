@@ -0,0 +1,144 @@
+package cmstore
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadKeyring(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cmstore-")
+	if err != nil {
+		t.Fatalf("failed to create directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, tt := range []struct {
+		name    string
+		file    string
+		newest  string
+		invalid bool
+	}{{
+		name: "newest first",
+		file: `
+keys:
+- name: key2
+  secret: MTIzNDU2Nzg5MDEyMzQ1Njc4OTAxMjM0NTY3ODkwMTI=
+- name: key1
+  secret: YWJjZGVmZ2hpamtsbW5vcA==
+`,
+		newest: "key2",
+	}, {
+		name:    "no keys",
+		file:    `keys: []`,
+		invalid: true,
+	}, {
+		name: "duplicate keys",
+		file: `
+keys:
+- name: key1
+  secret: YWJjZGVmZ2hpamtsbW5vcA==
+- name: key1
+  secret: YWJjZGVmZ2hpamtsbW5vcA==
+`,
+		invalid: true,
+	}, {
+		name: "unnamed key",
+		file: `
+keys:
+- secret: YWJjZGVmZ2hpamtsbW5vcA==
+`,
+		invalid: true,
+	}, {
+		name: "wrong key size",
+		file: `
+keys:
+- name: key1
+  secret: c2hvcnQ=
+`,
+		invalid: true,
+	}, {
+		name: "unknown field",
+		file: `
+keys:
+- name: key1
+  secret: YWJjZGVmZ2hpamtsbW5vcA==
+  provider: aescbc
+`,
+		invalid: true,
+	}} {
+		path := filepath.Join(dir, "keyring.yaml")
+		if err := ioutil.WriteFile(path, []byte(tt.file), 0600); err != nil {
+			t.Fatalf("failed to write keyring: %v", err)
+		}
+
+		keyring, err := LoadKeyring(path)
+		if tt.invalid {
+			if err == nil {
+				t.Errorf("%s: expected keyring to be rejected", tt.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s: LoadKeyring failed: %v", tt.name, err)
+		}
+		if keyring.newest != tt.newest {
+			t.Errorf("%s: expected newest key %s, got %s", tt.name, tt.newest, keyring.newest)
+		}
+	}
+}
+
+func TestKeyring(t *testing.T) {
+	var (
+		key1    = Key{Name: "key1", Secret: []byte("abcdefghijklmnop")}
+		key2    = Key{Name: "key2", Secret: []byte("12345678901234567890123456789012")}
+		context = []byte("default/my-config#0#generation")
+		in      = []byte("Hello, world!")
+	)
+	old, err := NewKeyring(key1)
+	if err != nil {
+		t.Fatalf("NewKeyring failed: %v", err)
+	}
+
+	sealed, keyID, err := old.TransformToStorage(in, context)
+	if err != nil {
+		t.Fatalf("TransformToStorage failed: %v", err)
+	}
+	if keyID != "key1" || bytes.Contains(sealed, in) {
+		t.Errorf("expected data to be encrypted with key1, got %q with %s", sealed, keyID)
+	}
+	if again, _, _ := old.TransformToStorage(in, context); bytes.Equal(again, sealed) {
+		t.Errorf("expected every encryption to use a new nonce")
+	}
+
+	out, stale, err := old.TransformFromStorage(sealed, context, keyID)
+	if err != nil || stale || !bytes.Equal(out, in) {
+		t.Errorf("expected %q to be decrypted fresh, got %q (stale: %t): %v", in, out, stale, err)
+	}
+	if _, _, err := old.TransformFromStorage(sealed, []byte("default/other#0#generation"), keyID); err == nil {
+		t.Errorf("expected data moved to another context to fail to decrypt")
+	}
+
+	// Older keys keep working after rotation, but their data is stale
+	rotated, err := NewKeyring(key2, key1)
+	if err != nil {
+		t.Fatalf("NewKeyring failed: %v", err)
+	}
+	out, stale, err = rotated.TransformFromStorage(sealed, context, keyID)
+	if err != nil || !stale || !bytes.Equal(out, in) {
+		t.Errorf("expected %q to be decrypted stale, got %q (stale: %t): %v", in, out, stale, err)
+	}
+	if _, keyID, _ := rotated.TransformToStorage(in, context); keyID != "key2" {
+		t.Errorf("expected data to be encrypted with the newest key, got %s", keyID)
+	}
+
+	dropped, err := NewKeyring(key2)
+	if err != nil {
+		t.Fatalf("NewKeyring failed: %v", err)
+	}
+	if _, _, err := dropped.TransformFromStorage(sealed, context, keyID); err == nil {
+		t.Errorf("expected data encrypted with a dropped key to fail to decrypt")
+	}
+}
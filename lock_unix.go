@@ -0,0 +1,24 @@
+//go:build !windows
+// +build !windows
+
+package cmstore
+
+import (
+	"os"
+	"syscall"
+)
+
+// lockFile blocks until it holds an advisory lock on f, shared with other readers unless exclusive.
+func lockFile(f *os.File, exclusive bool) error {
+	how := syscall.LOCK_SH
+	if exclusive {
+		how = syscall.LOCK_EX
+	}
+
+	return syscall.Flock(int(f.Fd()), how)
+}
+
+// unlockFile releases the lock held on f.
+func unlockFile(f *os.File) error {
+	return syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+}
@@ -0,0 +1,19 @@
+//go:build windows
+// +build windows
+
+package cmstore
+
+import (
+	"os"
+)
+
+// lockFile is a no-op on Windows, where advisory locks aren't available from the standard library.
+// Writers in the same process are still serialized, but other processes must not share the directory.
+func lockFile(f *os.File, exclusive bool) error {
+	return nil
+}
+
+// unlockFile is a no-op on Windows.
+func unlockFile(f *os.File) error {
+	return nil
+}
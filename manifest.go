@@ -0,0 +1,355 @@
+package cmstore
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"strings"
+	"time"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apiserver/pkg/storage"
+)
+
+// manifest lists the partitions committed for a key.
+// Writers create the partitions of a new generation first, then swap the manifest, so readers that only follow it
+// always see a complete object.
+// The manifest is also the root blob of its key: it owns every partition written for the key, and is reserved
+// before the first partitions are written so they have something to be owned by. Content-addressed segments are shared
+// with other keys, so they're reference counted instead.
+type manifest struct {
+	Generation string          `json:"generation"`
+	Partitions []manifestEntry `json:"partitions"`
+}
+
+// manifestEntry names a committed partition and the digest of the data it stores.
+type manifestEntry struct {
+	Name   string `json:"name"`
+	Digest string `json:"digest"`
+}
+
+// manifestName returns the name of the manifest for a key.
+// Names are derived from the key so only one manifest can ever be created for it.
+func manifestName(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return "manifest-" + hex.EncodeToString(sum[:])
+}
+
+// digest returns the digest of stored data.
+func digest(data []byte) string {
+	sum := sha256.Sum256(data)
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+// isManifest returns true if the given blob is a manifest.
+func isManifest(blobMeta metav1.Object) bool {
+	_, ok := blobMeta.GetLabels()[manifestLabelKey]
+	return ok
+}
+
+// isCommitted returns true if the given manifest commits partitions, rather than just reserving the key.
+func isCommitted(manifestMeta metav1.Object) bool {
+	return manifestMeta.GetAnnotations()[generationAnnotationKey] != ""
+}
+
+// reserve creates a manifest for key that commits nothing yet, to own the partitions written for it.
+func (s *ConfigMapStore) reserve(ctx context.Context, key string) (*Blob, error) {
+	blob := &Blob{Data: []byte("{}")}
+	blob.SetName(manifestName(key))
+	s.stamp(key, blob)
+	blob.Labels[manifestLabelKey] = "true"
+
+	return blob, s.backend.Create(ctx, blob)
+}
+
+// newManifest returns a manifest for key that commits the given stored partitions of a generation, and is owned by the
+// given owners.
+func (s *ConfigMapStore) newManifest(key, generation string, expires time.Time, partitions []*Blob, owners []metav1.OwnerReference) (*Blob, error) {
+	m := manifest{
+		Generation: generation,
+	}
+	for _, p := range partitions {
+		m.Partitions = append(m.Partitions, manifestEntry{
+			Name:   p.GetName(),
+			Digest: digest(p.Data),
+		})
+	}
+
+	data, err := json.Marshal(m)
+	if err != nil {
+		return nil, err
+	}
+
+	blob := &Blob{Data: data}
+	blob.SetName(manifestName(key))
+	blob.SetOwnerReferences(owners)
+	blob.SetAnnotations(map[string]string{
+		generationAnnotationKey: m.Generation,
+	})
+	s.stamp(key, blob)
+	blob.Labels[manifestLabelKey] = "true"
+	// Partitions may be shared by objects that expire at other times, so only the manifest tells when the object does
+	setExpiry(blob, expires)
+
+	return blob, nil
+}
+
+// readManifest returns the manifest stored in a blob.
+func readManifest(blob *Blob) (*manifest, error) {
+	m := &manifest{}
+	if err := json.Unmarshal(blob.Data, m); err != nil {
+		return nil, err
+	}
+
+	return m, nil
+}
+
+// findManifest returns the manifest among blobs stored for a key, or nil if nothing's committed.
+func findManifest(blobs []Blob) *Blob {
+	for i := range blobs {
+		if isManifest(&blobs[i]) {
+			return &blobs[i]
+		}
+	}
+
+	return nil
+}
+
+// committed returns the manifest among the blobs stored for key and the partitions it commits, in order.
+// Partitions the manifest doesn't list are ignored, so writes in progress and leftovers of past writes are never read.
+func (s *ConfigMapStore) committed(key string, blobs []Blob) (*Blob, []*Blob, error) {
+	committed := findManifest(blobs)
+	if committed == nil {
+		return nil, nil, storage.NewKeyNotFoundError(key, 0)
+	}
+
+	m, err := readManifest(committed)
+	if err != nil {
+		return nil, nil, storage.NewInternalErrorf("failed to read manifest of %s: %v", key, err)
+	}
+	if len(m.Partitions) < 1 {
+		// The key is reserved, but nothing's been committed yet
+		return nil, nil, storage.NewKeyNotFoundError(key, 0)
+	}
+
+	stored := map[string]*Blob{}
+	for i := range blobs {
+		stored[blobs[i].GetName()] = &blobs[i]
+	}
+
+	listed := make([]Blob, 0, len(m.Partitions))
+	for _, entry := range m.Partitions {
+		p, ok := stored[entry.Name]
+		if !ok && strings.HasPrefix(entry.Name, segmentPrefix) {
+			// Segments are read apart from the rest, so they may be collected in the meantime
+			return nil, nil, storage.NewKeyNotFoundError(key, 0)
+		}
+		if !ok {
+			// Partitions are only deleted along with their manifest, so the object can never be read again
+			return nil, nil, storage.NewInternalErrorf("%s is corrupt: %v %s", key, errMissingPartition, entry.Name)
+		}
+		if d := digest(p.Data); d != entry.Digest {
+			return nil, nil, storage.NewInternalErrorf("partition %s of %s has digest %s, not %s", entry.Name, key, d, entry.Digest)
+		}
+		if g := p.GetAnnotations()[generationAnnotationKey]; !isSegment(p) && g != m.Generation {
+			return nil, nil, storage.NewInternalErrorf("partition %s of %s is from generation %q, not %q", entry.Name, key, g, m.Generation)
+		}
+
+		listed = append(listed, *p)
+	}
+
+	if isSegment(&listed[0]) {
+		// Segments are shared by other positions and generations, so only the manifest knows their order
+		sorted := make([]*Blob, len(listed))
+		for i := range listed {
+			sorted[i] = &listed[i]
+		}
+
+		return committed, sorted, nil
+	}
+
+	sorted, err := sortPartitions(listed)
+	if err != nil {
+		return nil, nil, storage.NewInternalErrorf("failed to order partitions of %s: %v", key, err)
+	}
+
+	return committed, sorted, nil
+}
+
+// missingPartitions returns the names of the partitions and segments committed by the manifest among the blobs stored
+// for a key that aren't among them.
+func missingPartitions(blobs []Blob) []string {
+	committed := findManifest(blobs)
+	if committed == nil {
+		return nil
+	}
+	m, err := readManifest(committed)
+	if err != nil {
+		return nil
+	}
+
+	present := map[string]bool{}
+	for i := range blobs {
+		present[blobs[i].GetName()] = true
+	}
+
+	var missing []string
+	for _, entry := range m.Partitions {
+		if !present[entry.Name] {
+			missing = append(missing, entry.Name)
+			present[entry.Name] = true
+		}
+	}
+
+	return missing
+}
+
+// incomplete returns the manifest stored for key and the partitions it commits that are left, when some of them are
+// missing. Otherwise, it returns the error key was read with.
+func (s *ConfigMapStore) incomplete(ctx context.Context, key string, readErr error) (*Blob, []*Blob, bool, error) {
+	blobs, _, err := s.blobs(ctx, key)
+	if err != nil {
+		return nil, nil, false, err
+	}
+	committed := findManifest(blobs)
+	if committed == nil || len(missingPartitions(blobs)) < 1 {
+		return nil, nil, false, readErr
+	}
+	m, err := readManifest(committed)
+	if err != nil {
+		return nil, nil, false, readErr
+	}
+
+	listed := map[string]bool{}
+	for _, entry := range m.Partitions {
+		listed[entry.Name] = true
+	}
+	var left []*Blob
+	for i := range blobs {
+		if listed[blobs[i].GetName()] {
+			left = append(left, &blobs[i])
+		}
+	}
+
+	return committed, left, true, nil
+}
+
+// commit creates the given partitions, then swaps them in for the ones committed by the current manifest.
+// When there's no current manifest, one is reserved first, so the partitions can be owned by it.
+// Content-addressed partitions are replaced by the segments they're stored in instead.
+// The manifest's resourceVersion guards against concurrent writers: when another writer commits first, the partitions
+// are rolled back and the write should be retried against the latest state.
+func (s *ConfigMapStore) commit(ctx context.Context, key string, current *Blob, owners []metav1.OwnerReference, partitions []*Blob) (committed *Blob, retry bool, err error) {
+	var (
+		reserved *Blob
+		created  []*Blob
+	)
+	defer func() {
+		if err == nil && !retry {
+			// Transaction was successful!
+			return
+		}
+
+		// Cancel transaction
+		s.discard(ctx, created)
+		if reserved != nil {
+			s.discard(ctx, []*Blob{reserved})
+		}
+	}()
+
+	if current == nil {
+		reserved, err = s.reserve(ctx, key)
+		if apierrors.IsAlreadyExists(err) {
+			reserved = nil
+			return nil, true, nil
+		}
+		if err != nil {
+			return nil, false, err
+		}
+		current = reserved
+	}
+
+	generation, expires := partitions[0].GetAnnotations()[generationAnnotationKey], partitionExpiry(partitions[0])
+
+	// TODO(njhale): parallelize
+	for i, p := range partitions {
+		if s.contentAddressable {
+			var segment *Blob
+			if segment, err = acquireSegment(ctx, s.backend, p, s.clock.Now()); err != nil {
+				return nil, false, err
+			}
+
+			created = append(created, segment)
+			partitions[i] = segment
+			continue
+		}
+
+		p.SetOwnerReferences(ownedBy(current))
+		if err = s.backend.Create(ctx, p); err != nil {
+			return nil, false, err
+		}
+
+		created = append(created, p)
+	}
+
+	if committed, err = s.newManifest(key, generation, expires, partitions, owners); err != nil {
+		return nil, false, storage.NewInternalErrorf("failed to build manifest of %s: %v", key, err)
+	}
+	committed.SetUID(current.GetUID())
+	committed.SetResourceVersion(current.GetResourceVersion())
+
+	err = s.backend.Update(ctx, committed)
+	if apierrors.IsConflict(err) || apierrors.IsNotFound(err) {
+		return nil, true, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+
+	return committed, false, nil
+}
+
+// remove deletes the object committed by a manifest, failing if the manifest has changed since it was read.
+// The object is gone once its manifest is, so its partitions are deleted on a best-effort basis.
+func (s *ConfigMapStore) remove(ctx context.Context, committed *Blob, partitions []*Blob) (retry bool, err error) {
+	err = s.backend.Delete(ctx, committed)
+	if apierrors.IsConflict(err) || apierrors.IsNotFound(err) {
+		// Another writer beat us to it
+		return true, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	s.discard(ctx, partitions)
+
+	return false, nil
+}
+
+// discard deletes partitions that are no longer committed, and releases the segments they were stored in.
+// Nothing reads them, so any that can't be deleted are left behind.
+func (s *ConfigMapStore) discard(ctx context.Context, partitions []*Blob) {
+	for _, p := range partitions {
+		// TODO(njhale): log errors
+		if isSegment(p) {
+			releaseSegment(ctx, s.backend, p.GetName())
+			continue
+		}
+		s.backend.Delete(ctx, p)
+	}
+}
+
+// committedVersion returns the version of the object committed by a manifest.
+// Segments change as references to them come and go without changing what they store, so they don't version it.
+func committedVersion(committed *Blob, partitions []*Blob) (uint64, error) {
+	versioned := []*Blob{committed}
+	for _, p := range partitions {
+		if !isSegment(p) {
+			versioned = append(versioned, p)
+		}
+	}
+
+	return partitionsVersion(versioned)
+}
@@ -0,0 +1,122 @@
+package cmstore
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apiserver/pkg/storage"
+)
+
+func TestManifest(t *testing.T) {
+	var (
+		ctx    = context.Background()
+		store  = NewBackendStore(NewMemoryBackend(), NewPartitioner(64), func() runtime.Object { return &corev1.ConfigMap{} })
+		key    = "default/my-config"
+		in     = &corev1.ConfigMap{}
+		stored = &corev1.ConfigMap{}
+	)
+	committed := func() (*Blob, []*Blob) {
+		blobs, _, err := store.blobs(ctx, key)
+		if err != nil {
+			t.Fatalf("failed to list blobs: %v", err)
+		}
+		manifest, partitions, err := store.committed(key, blobs)
+		if err != nil {
+			t.Fatalf("failed to find committed partitions: %v", err)
+		}
+
+		return manifest, partitions
+	}
+	get := func(expected string) {
+		out := &corev1.ConfigMap{}
+		if err := store.Get(ctx, key, storage.GetOptions{}, out); err != nil {
+			t.Fatalf("Get failed: %v", err)
+		}
+		if out.Data["greeting"] != expected {
+			t.Errorf("expected greeting %q, got %q", expected, out.Data["greeting"])
+		}
+	}
+	setGreeting := func(greeting string) storage.UpdateFunc {
+		return func(input runtime.Object, _ storage.ResponseMeta) (runtime.Object, *uint64, error) {
+			cm := input.(*corev1.ConfigMap)
+			cm.Data = map[string]string{"greeting": greeting}
+			return cm, nil, nil
+		}
+	}
+
+	in.SetName("my-config")
+	in.Data = map[string]string{"greeting": fmt.Sprintf("%128s", "Hello, world!")}
+	if err := store.Create(ctx, key, in, stored, 0); err != nil {
+		t.Fatalf("Set failed: %v", err)
+	}
+
+	// Every stored partition is committed, and the object is versioned by the manifest written last
+	manifest, partitions := committed()
+	if all, _, err := store.partitions(ctx, key); err != nil || len(all) != len(partitions) || len(partitions) < 2 {
+		t.Fatalf("expected %d partitions to be stored, got %d: %v", len(partitions), len(all), err)
+	}
+	if version := mustVersion(t, stored); fmt.Sprint(version) != manifest.GetResourceVersion() {
+		t.Errorf("expected version %s, got %d", manifest.GetResourceVersion(), version)
+	}
+
+	// Partitions of a write in progress aren't read until the manifest is swapped
+	pending, err := store.split(key, &corev1.ConfigMap{Data: map[string]string{"greeting": "Goodbye!"}}, time.Time{})
+	if err != nil {
+		t.Fatalf("failed to split object: %v", err)
+	}
+	for _, p := range pending {
+		if err := store.backend.Create(ctx, p); err != nil {
+			t.Fatalf("failed to create partition: %v", err)
+		}
+	}
+	get(in.Data["greeting"])
+
+	// Swapping a stale manifest rolls the new partitions back
+	if err := store.GuaranteedUpdate(ctx, key, &corev1.ConfigMap{}, false, nil, setGreeting("Hello again!")); err != nil {
+		t.Fatalf("GuaranteedUpdate failed: %v", err)
+	}
+	get("Hello again!")
+	updated, err := store.split(key, &corev1.ConfigMap{Data: map[string]string{"greeting": "Too late!"}}, time.Time{})
+	if err != nil {
+		t.Fatalf("failed to split object: %v", err)
+	}
+	if _, retry, err := store.commit(ctx, key, manifest, nil, updated); err != nil || !retry {
+		t.Errorf("expected a stale manifest to be retried, got %v", err)
+	}
+	get("Hello again!")
+
+	// Only the pending partitions of the abandoned write are left behind
+	manifest, partitions = committed()
+	remaining, _, err := store.partitions(ctx, key)
+	if err != nil {
+		t.Fatalf("failed to list partitions: %v", err)
+	}
+	if len(remaining) != len(partitions)+len(pending) {
+		t.Errorf("expected %d partitions, got %d", len(partitions)+len(pending), len(remaining))
+	}
+
+	// A partition that doesn't match its digest is never read
+	tampered := partitions[0].DeepCopy()
+	tampered.Data = append(tampered.Data, '!')
+	if err := store.backend.Update(ctx, tampered); err != nil {
+		t.Fatalf("failed to update partition: %v", err)
+	}
+	if err := store.Get(ctx, key, storage.GetOptions{}, &corev1.ConfigMap{}); !storage.IsInternalError(err) {
+		t.Errorf("expecting internal error, but get: %v", err)
+	}
+
+	// Deleting the manifest deletes the object
+	if err := store.backend.Delete(ctx, manifest); err != nil {
+		t.Fatalf("failed to delete manifest: %v", err)
+	}
+	if err := store.Get(ctx, key, storage.GetOptions{}, &corev1.ConfigMap{}); !storage.IsNotFound(err) {
+		t.Errorf("expecting not found error, but get: %v", err)
+	}
+	if count, err := store.Count("default"); err != nil || count != 0 {
+		t.Errorf("expected no objects to be counted, got %d: %v", count, err)
+	}
+}
@@ -0,0 +1,172 @@
+package cmstore
+
+import (
+	"context"
+	"sort"
+	"strconv"
+	"sync"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	utilrand "k8s.io/apimachinery/pkg/util/rand"
+	"k8s.io/apimachinery/pkg/util/uuid"
+	toolscache "k8s.io/client-go/tools/cache"
+)
+
+// MemoryBackend keeps blobs in memory.
+// Like the API server, it versions every write with a single, increasing revision.
+type MemoryBackend struct {
+	mu       sync.Mutex
+	revision uint64
+	blobs    map[string]*Blob
+	handlers []func(blob *Blob, deleted bool)
+}
+
+var _ Backend = &MemoryBackend{}
+
+// NewMemoryBackend returns an empty in-memory backend.
+func NewMemoryBackend() *MemoryBackend {
+	return &MemoryBackend{
+		blobs: map[string]*Blob{},
+	}
+}
+
+func (b *MemoryBackend) Create(_ context.Context, blob *Blob) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	created := blob.DeepCopy()
+	if created.GetName() == "" {
+		if created.GetGenerateName() == "" {
+			return apierrors.NewBadRequest("name or generateName is required")
+		}
+		created.SetName(created.GetGenerateName() + utilrand.String(5))
+	}
+	if _, ok := b.blobs[created.GetName()]; ok {
+		return apierrors.NewAlreadyExists(blobResource, created.GetName())
+	}
+
+	created.SetUID(uuid.NewUUID())
+	created.SetCreationTimestamp(metav1.Now())
+	b.write(created)
+	*blob = *created.DeepCopy()
+
+	return nil
+}
+
+func (b *MemoryBackend) Get(_ context.Context, name string) (*Blob, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	stored, ok := b.blobs[name]
+	if !ok {
+		return nil, apierrors.NewNotFound(blobResource, name)
+	}
+
+	return stored.DeepCopy(), nil
+}
+
+func (b *MemoryBackend) Update(_ context.Context, blob *Blob) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	stored, ok := b.blobs[blob.GetName()]
+	if !ok {
+		return apierrors.NewNotFound(blobResource, blob.GetName())
+	}
+	if rv := blob.GetResourceVersion(); rv != "" && rv != stored.GetResourceVersion() {
+		return apierrors.NewConflict(blobResource, blob.GetName(), errStaleBlob)
+	}
+
+	updated := blob.DeepCopy()
+	updated.SetUID(stored.GetUID())
+	updated.SetCreationTimestamp(stored.GetCreationTimestamp())
+	b.write(updated)
+	*blob = *updated.DeepCopy()
+
+	return nil
+}
+
+func (b *MemoryBackend) Delete(_ context.Context, blob *Blob) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	stored, ok := b.blobs[blob.GetName()]
+	if !ok {
+		return apierrors.NewNotFound(blobResource, blob.GetName())
+	}
+	if uid := blob.GetUID(); uid != "" && uid != stored.GetUID() {
+		return apierrors.NewConflict(blobResource, blob.GetName(), errStaleBlob)
+	}
+	if rv := blob.GetResourceVersion(); rv != "" && rv != stored.GetResourceVersion() {
+		return apierrors.NewConflict(blobResource, blob.GetName(), errStaleBlob)
+	}
+
+	// Like the API server, deletions are observed at the revision they were made at
+	b.revision++
+	stored.SetResourceVersion(strconv.FormatUint(b.revision, 10))
+	delete(b.blobs, stored.GetName())
+	for _, handler := range b.handlers {
+		handler(stored.DeepCopy(), true)
+	}
+
+	return nil
+}
+
+func (b *MemoryBackend) List(_ context.Context, selector labels.Selector) ([]Blob, string, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var blobs []Blob
+	for _, stored := range b.blobs {
+		if selector.Matches(labels.Set(stored.GetLabels())) {
+			blobs = append(blobs, *stored.DeepCopy())
+		}
+	}
+	sort.Slice(blobs, func(i, j int) bool {
+		return blobs[i].GetName() < blobs[j].GetName()
+	})
+
+	return blobs, strconv.FormatUint(b.revision, 10), nil
+}
+
+func (b *MemoryBackend) ListMetadata(ctx context.Context, selector labels.Selector) ([]Blob, string, error) {
+	blobs, resourceVersion, err := b.List(ctx, selector)
+	for i := range blobs {
+		blobs[i].Data = nil
+	}
+
+	return blobs, resourceVersion, err
+}
+
+// Watch calls handler with every change as it's made.
+// Handlers are called while writes are blocked, so they must not call back into the backend.
+func (b *MemoryBackend) Watch(_ context.Context, handler func(blob *Blob, deleted bool)) (toolscache.InformerSynced, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	names := make([]string, 0, len(b.blobs))
+	for name := range b.blobs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		handler(b.blobs[name].DeepCopy(), false)
+	}
+	b.handlers = append(b.handlers, handler)
+
+	return func() bool { return true }, nil
+}
+
+// write stores a blob at the next revision and tells every handler about it.
+// Callers must hold the lock.
+func (b *MemoryBackend) write(blob *Blob) {
+	b.revision++
+	blob.SetResourceVersion(strconv.FormatUint(b.revision, 10))
+	b.blobs[blob.GetName()] = blob
+
+	for _, handler := range b.handlers {
+		handler(blob.DeepCopy(), false)
+	}
+}
@@ -0,0 +1,29 @@
+package cmstore
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+)
+
+func TestMemoryBackend(t *testing.T) {
+	testBackend(t, NewMemoryBackend())
+}
+
+func TestMemoryStreamRoundTrip(t *testing.T) {
+	var (
+		stream = NewBackendStream(NewMemoryBackend(), "streamer")
+		in     = []byte("Hello, world!")
+	)
+	if _, err := stream.Write(in); err != nil {
+		t.Fatalf("failed to write data: %s", err)
+	}
+
+	out, err := ioutil.ReadAll(stream)
+	if err != nil {
+		t.Fatalf("failed to read data: %s", err)
+	}
+	if !bytes.Equal(out, in) {
+		t.Errorf("output %q doesn't match input %q", out, in)
+	}
+}
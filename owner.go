@@ -0,0 +1,71 @@
+package cmstore
+
+import (
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+// OwnerReferencesFunc maps the ownerReferences of a stored object onto the root blob of its key, so the cluster
+// garbage collector deletes every blob stored for the object along with its owners.
+// The garbage collector looks for namespaced owners in the storage namespace, and deletes the root blob, and with it
+// the stored object, when they aren't found there. So only references to cluster-scoped owners, or to owners known to
+// live in the storage namespace, may be returned.
+type OwnerReferencesFunc func(obj metav1.Object) []metav1.OwnerReference
+
+// CopyOwnerReferences returns an OwnerReferencesFunc that gives the root blob the stored object's ownerReferences to
+// owners the mapper knows to be cluster-scoped. References to namespaced owners are only copied when they're in the
+// storage namespace, as when the stored objects live there too; otherwise they're dropped, along with references to
+// kinds the mapper doesn't know.
+// Blobs shouldn't hold up the deletion of their owners, so BlockOwnerDeletion is dropped.
+func CopyOwnerReferences(mapper meta.RESTMapper, inStorageNamespace bool) OwnerReferencesFunc {
+	return func(obj metav1.Object) []metav1.OwnerReference {
+		var refs []metav1.OwnerReference
+		for _, ref := range obj.GetOwnerReferences() {
+			gv, err := schema.ParseGroupVersion(ref.APIVersion)
+			if err != nil {
+				continue
+			}
+			mapping, err := mapper.RESTMapping(schema.GroupKind{Group: gv.Group, Kind: ref.Kind}, gv.Version)
+			if err != nil {
+				continue
+			}
+			if mapping.Scope.Name() != meta.RESTScopeNameRoot && !inStorageNamespace {
+				continue
+			}
+
+			ref.BlockOwnerDeletion = nil
+			refs = append(refs, ref)
+		}
+
+		return refs
+	}
+}
+
+// SetOwnerReferences makes the store map the ownerReferences of the objects it writes onto their root blobs.
+func (s *ConfigMapStore) SetOwnerReferences(f OwnerReferencesFunc) {
+	s.ownerReferences = f
+}
+
+// owners returns the ownerReferences the root blob of obj should have.
+func (s *ConfigMapStore) owners(obj runtime.Object) []metav1.OwnerReference {
+	if s.ownerReferences == nil {
+		return nil
+	}
+
+	accessor, err := meta.Accessor(obj)
+	if err != nil {
+		return nil
+	}
+
+	return s.ownerReferences(accessor)
+}
+
+// ownedBy returns a reference to a blob for other blobs of the same backend to be owned by it.
+func ownedBy(owner *Blob) []metav1.OwnerReference {
+	return []metav1.OwnerReference{{
+		Name: owner.GetName(),
+		UID:  owner.GetUID(),
+	}}
+}
@@ -0,0 +1,126 @@
+package cmstore
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apiserver/pkg/storage"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+func TestOwnerReferences(t *testing.T) {
+	var (
+		ctx   = context.Background()
+		c     = newTestClient(t)
+		store = newTestStore(c)
+		key   = "default/my-config"
+		in    = &corev1.ConfigMap{}
+		block = true
+		owner = metav1.OwnerReference{
+			APIVersion:         "v1",
+			Kind:               "Namespace",
+			Name:               "owner",
+			UID:                "owner-uid",
+			BlockOwnerDeletion: &block,
+		}
+		namespaced = metav1.OwnerReference{APIVersion: "v1", Kind: "ConfigMap", Name: "namespaced", UID: "namespaced-uid"}
+		unknown    = metav1.OwnerReference{APIVersion: "example.com/v1", Kind: "Widget", Name: "unknown", UID: "unknown-uid"}
+		mapper     = meta.NewDefaultRESTMapper(nil)
+	)
+	mapper.Add(corev1.SchemeGroupVersion.WithKind("Namespace"), meta.RESTScopeRoot)
+	mapper.Add(corev1.SchemeGroupVersion.WithKind("ConfigMap"), meta.RESTScopeNamespace)
+	store.SetOwnerReferences(CopyOwnerReferences(mapper, false))
+
+	// Everything stored for the key is owned by the manifest, which is owned by the object's owners
+	check := func() {
+		stored := &corev1.ConfigMapList{}
+		if err := c.List(ctx, stored, client.InNamespace("storage"), client.MatchingLabels{labelKey: keyLabel(key)}); err != nil {
+			t.Fatalf("failed to list ConfigMaps: %v", err)
+		}
+
+		var partitions int
+		for _, cm := range stored.Items {
+			refs := cm.GetOwnerReferences()
+			if cm.GetName() == manifestName(key) {
+				expected := owner
+				expected.BlockOwnerDeletion = nil
+				if !reflect.DeepEqual(refs, []metav1.OwnerReference{expected}) {
+					t.Errorf("expected the manifest to be owned by %v, got %v", expected, refs)
+				}
+				continue
+			}
+
+			partitions++
+			if len(refs) != 1 || refs[0].APIVersion != "v1" || refs[0].Kind != "ConfigMap" || refs[0].Name != manifestName(key) {
+				t.Errorf("expected partition %s to be owned by the manifest, got %v", cm.GetName(), refs)
+			}
+		}
+		if partitions < 2 {
+			t.Errorf("expected several partitions, got %d", partitions)
+		}
+	}
+
+	in.SetName("my-config")
+	// Namespaced owners would be looked for in the storage namespace, so only cluster-scoped ones are copied
+	in.SetOwnerReferences([]metav1.OwnerReference{owner, namespaced, unknown})
+	in.Data = map[string]string{"greeting": fmt.Sprintf("%128s", "Hello, world!")}
+	if err := store.Create(ctx, key, in, nil, 0); err != nil {
+		t.Fatalf("Set failed: %v", err)
+	}
+	check()
+
+	if err := store.GuaranteedUpdate(ctx, key, &corev1.ConfigMap{}, false, nil, func(input runtime.Object, _ storage.ResponseMeta) (runtime.Object, *uint64, error) {
+		cm := input.(*corev1.ConfigMap)
+		cm.Data = map[string]string{"greeting": fmt.Sprintf("%128s", "Hello again!")}
+		return cm, nil, nil
+	}); err != nil {
+		t.Fatalf("GuaranteedUpdate failed: %v", err)
+	}
+	check()
+
+	// Unless they're known to be in the storage namespace
+	refs := CopyOwnerReferences(mapper, true)(in)
+	if len(refs) != 2 || refs[0].Name != owner.Name || refs[1].Name != namespaced.Name {
+		t.Errorf("expected owners in the storage namespace to be copied, got %v", refs)
+	}
+}
+
+func TestReservedKey(t *testing.T) {
+	var (
+		ctx   = context.Background()
+		store = NewBackendStore(NewMemoryBackend(), NewPartitioner(64), func() runtime.Object { return &corev1.ConfigMap{} })
+		key   = "default/my-config"
+		in    = &corev1.ConfigMap{}
+	)
+
+	// A key reserved by a writer that never committed holds nothing
+	if _, err := store.reserve(ctx, key); err != nil {
+		t.Fatalf("failed to reserve key: %v", err)
+	}
+	if err := store.Get(ctx, key, storage.GetOptions{}, &corev1.ConfigMap{}); !storage.IsNotFound(err) {
+		t.Errorf("expecting not found error, but get: %v", err)
+	}
+	if count, err := store.Count("default"); err != nil || count != 0 {
+		t.Errorf("expected no objects to be counted, got %d: %v", count, err)
+	}
+
+	// And is taken over by the next writer
+	in.SetName("my-config")
+	in.Data = map[string]string{"greeting": "Hello, world!"}
+	if err := store.Create(ctx, key, in, nil, 0); err != nil {
+		t.Fatalf("Set failed: %v", err)
+	}
+	out := &corev1.ConfigMap{}
+	if err := store.Get(ctx, key, storage.GetOptions{}, out); err != nil || out.Data["greeting"] != "Hello, world!" {
+		t.Errorf("expected the created object, got %v: %v", out.Data, err)
+	}
+	if count, err := store.Count("default"); err != nil || count != 1 {
+		t.Errorf("expected 1 object to be counted, got %d: %v", count, err)
+	}
+}
@@ -5,6 +5,11 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
+	"reflect"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/serializer"
 )
 
 type Partitioner interface {
@@ -16,6 +21,9 @@ type Partitioner interface {
 type SimpleSegment struct {
 	Position uint   `json:"position"`
 	Data     []byte `json:"data"`
+	// Compression records how the joined data of every segment was compressed, so it's detected on read.
+	// Streams that record it in their own metadata, like the store's partitions, have it there too.
+	Compression Compression `json:"compression,omitempty"`
 }
 
 func NewPartitioner(segmentSize int) *SimplePartitioner {
@@ -26,6 +34,13 @@ func NewPartitioner(segmentSize int) *SimplePartitioner {
 
 type SimplePartitioner struct {
 	segmentSize int
+	compression Compression
+}
+
+// SetCompression makes the partitioner compress encoded data before splitting it, so it takes fewer segments.
+// Data is decompressed on join regardless.
+func (p *SimplePartitioner) SetCompression(compression Compression) {
+	p.compression = compression
 }
 
 func (p *SimplePartitioner) Split(v interface{}, segments io.Writer) error {
@@ -34,12 +49,181 @@ func (p *SimplePartitioner) Split(v interface{}, segments io.Writer) error {
 		return fmt.Errorf("failed to encode v: %s", err)
 	}
 
+	return writeSegments(data, p.segmentSize, p.compression, segments)
+}
+
+func (p *SimplePartitioner) Join(v interface{}, segments io.Reader) error {
+	data, err := readSegments(segments)
+	if err != nil {
+		return err
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	if err := decoder.Decode(v); err != nil {
+		return fmt.Errorf("failed to decode joined segments: %s", err)
+	}
+
+	return nil
+}
+
+// NewCodecPartitioner returns a partitioner that encodes objects with the given codec, keeping their apiVersion and
+// kind, before splitting them into segments of at most segmentSize bytes.
+func NewCodecPartitioner(codec runtime.Codec, segmentSize int) *CodecPartitioner {
+	return &CodecPartitioner{
+		codec:       codec,
+		segmentSize: segmentSize,
+	}
+}
+
+// NewMediaTypePartitioner returns a partitioner that encodes objects as JSON, YAML or protobuf, per mediaType, using a
+// codec built from codecs by NewCodec.
+func NewMediaTypePartitioner(codecs serializer.CodecFactory, mediaType string, version runtime.GroupVersioner, segmentSize int) (*CodecPartitioner, error) {
+	codec, err := NewCodec(codecs, mediaType, version)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewCodecPartitioner(codec, segmentSize), nil
+}
+
+// NewCodec returns a codec that encodes objects as the given media type at the given version, keeping their apiVersion
+// and kind. It decodes any media type codecs supports, so stored objects stay readable when the media type changes.
+func NewCodec(codecs serializer.CodecFactory, mediaType string, version runtime.GroupVersioner) (runtime.Codec, error) {
+	info, ok := runtime.SerializerInfoForMediaType(codecs.SupportedMediaTypes(), mediaType)
+	if !ok {
+		return nil, fmt.Errorf("unsupported media type %q", mediaType)
+	}
+
+	return codecs.CodecForVersions(info.Serializer, codecs.UniversalDeserializer(), version, version), nil
+}
+
+// CodecPartitioner partitions runtime.Objects encoded with a codec.
+// Objects can be joined into a *runtime.Object or an unstructured.Unstructured without knowing their type in advance.
+type CodecPartitioner struct {
+	codec       runtime.Codec
+	segmentSize int
+	compression Compression
+}
+
+// SetCompression makes the partitioner compress encoded objects before splitting them, so they take fewer segments.
+// Objects are decompressed on join regardless.
+func (p *CodecPartitioner) SetCompression(compression Compression) {
+	p.compression = compression
+}
+
+func (p *CodecPartitioner) Split(v interface{}, segments io.Writer) error {
+	obj, ok := v.(runtime.Object)
+	if !ok {
+		return fmt.Errorf("can't encode %T, expected a runtime.Object", v)
+	}
+
+	data, err := runtime.Encode(p.codec, obj)
+	if err != nil {
+		return fmt.Errorf("failed to encode v: %s", err)
+	}
+
+	return writeSegments(data, p.segmentSize, p.compression, segments)
+}
+
+func (p *CodecPartitioner) Join(v interface{}, segments io.Reader) error {
+	data, err := readSegments(segments)
+	if err != nil {
+		return err
+	}
+
+	switch into := v.(type) {
+	case *runtime.Object:
+		// Let the codec pick the type from the encoded kind
+		out, _, err := p.codec.Decode(data, nil, nil)
+		if err != nil {
+			return fmt.Errorf("failed to decode joined segments: %s", err)
+		}
+		*into = out
+
+		return nil
+	case runtime.Unstructured:
+		return p.decodeUnstructured(data, into)
+	case runtime.Object:
+		return p.decode(data, into)
+	}
+
+	return fmt.Errorf("can't decode into %T, expected a runtime.Object", v)
+}
+
+// decode decodes data into the given object.
+func (p *CodecPartitioner) decode(data []byte, obj runtime.Object) error {
+	out, _, err := p.codec.Decode(data, nil, obj)
+	if err != nil {
+		return fmt.Errorf("failed to decode joined segments: %s", err)
+	}
+	if out != obj {
+		// The codec allocated its own object, copy it into the one we were given
+		if reflect.TypeOf(out) != reflect.TypeOf(obj) {
+			return fmt.Errorf("failed to decode joined segments: got %T, expected %T", out, obj)
+		}
+		reflect.ValueOf(obj).Elem().Set(reflect.ValueOf(out).Elem())
+	}
+
+	return nil
+}
+
+// decodeUnstructured decodes data into the given unstructured object.
+// Not every serializer decodes into unstructured objects (e.g. protobuf), so typed objects are converted.
+func (p *CodecPartitioner) decodeUnstructured(data []byte, obj runtime.Unstructured) error {
+	out, _, err := p.codec.Decode(data, nil, nil)
+	if err != nil {
+		// The kind may not be registered, fall back to decoding straight into the unstructured object
+		return p.decode(data, obj)
+	}
+	if u, ok := out.(runtime.Unstructured); ok {
+		obj.SetUnstructuredContent(u.UnstructuredContent())
+		return nil
+	}
+
+	content, err := runtime.DefaultUnstructuredConverter.ToUnstructured(out)
+	if err != nil {
+		return fmt.Errorf("failed to convert %T to unstructured: %s", out, err)
+	}
+	obj.SetUnstructuredContent(content)
+
+	// Typed objects don't always keep their kind through conversion
+	if u, ok := obj.(*unstructured.Unstructured); ok && u.GroupVersionKind().Empty() {
+		u.SetGroupVersionKind(out.GetObjectKind().GroupVersionKind())
+	}
+
+	return nil
+}
+
+// compressionRecorder is implemented by segment streams that record how the segments written to them are compressed in
+// their own metadata, so it can be seen without decoding them.
+type compressionRecorder interface {
+	RecordCompression(compression Compression)
+}
+
+// writeSegments compresses data, then splits it into segments of at most segmentSize bytes and writes them to a stream.
+// Streams that limit the size of segments have them packed with as much data as fits instead.
+func writeSegments(data []byte, segmentSize int, compression Compression, segments io.Writer) error {
+	if recorder, ok := segments.(compressionRecorder); ok {
+		recorder.RecordCompression(compression)
+	}
+	if limiter, ok := segments.(segmentLimiter); ok && limiter.SegmentLimit() > 0 {
+		var err error
+		if segmentSize, err = segmentCapacity(limiter.SegmentLimit(), compression); err != nil {
+			return err
+		}
+	}
+
+	data, err := compression.compress(data)
+	if err != nil {
+		return fmt.Errorf("failed to compress data: %s", err)
+	}
+
 	var (
-		segment SimpleSegment
+		segment = SimpleSegment{Compression: compression}
 		encoder = json.NewEncoder(segments)
 	)
 	for _, b := range data {
-		if len(segment.Data) == p.segmentSize {
+		if len(segment.Data) == segmentSize {
 			if err := encoder.Encode(segment); err != nil {
 				return fmt.Errorf("failed to write segment %v to stream: %s", segment, err)
 			}
@@ -61,7 +245,9 @@ func (p *SimplePartitioner) Split(v interface{}, segments io.Writer) error {
 	return nil
 }
 
-func (p *SimplePartitioner) Join(v interface{}, segments io.Reader) error {
+// readSegments reads segments from a stream, in any order, and returns the data they hold in position order,
+// decompressed.
+func readSegments(segments io.Reader) ([]byte, error) {
 	// TODO(njhale): handle async readers
 	var (
 		decoder = json.NewDecoder(segments)
@@ -69,12 +255,10 @@ func (p *SimplePartitioner) Join(v interface{}, segments io.Reader) error {
 		err     error
 	)
 	for {
-		fmt.Println("decoding next segment...")
 		segment := &SimpleSegment{}
 		if err = decoder.Decode(segment); err != nil {
 			break
 		}
-		fmt.Printf("decoded segment: %v\n", segment)
 
 		p := segment.Position
 		switch {
@@ -89,7 +273,7 @@ func (p *SimplePartitioner) Join(v interface{}, segments io.Reader) error {
 			fallthrough
 		default:
 			if ordered[p] != nil {
-				return fmt.Errorf("received duplicate segment at position %d", p)
+				return nil, fmt.Errorf("received duplicate segment at position %d", p)
 			}
 
 			// In-order insert
@@ -98,21 +282,30 @@ func (p *SimplePartitioner) Join(v interface{}, segments io.Reader) error {
 
 	}
 	if err != io.EOF {
-		return fmt.Errorf("failed to read segment from stream: %s", err)
+		return nil, fmt.Errorf("failed to read segment from stream: %s", err)
 	}
 
-	// Collect data and decode to the target interface
+	// Collect the data in order
 	var buf bytes.Buffer
-	for _, segment := range ordered {
+	for p, segment := range ordered {
+		if segment == nil {
+			return nil, fmt.Errorf("missing segment at position %d", p)
+		}
+		if segment.Compression != ordered[0].Compression {
+			return nil, fmt.Errorf("segment at position %d is compressed with %q, not %q", p, segment.Compression, ordered[0].Compression)
+		}
 		if _, err := buf.Write(segment.Data); err != nil {
-			return fmt.Errorf("failed to join segments %s", err)
+			return nil, fmt.Errorf("failed to join segments %s", err)
 		}
 	}
+	if len(ordered) < 1 {
+		return nil, nil
+	}
 
-	decoder = json.NewDecoder(&buf)
-	if err := decoder.Decode(v); err != nil {
-		return fmt.Errorf("failed to decode joined segments: %s", err)
+	data, err := ordered[0].Compression.decompress(buf.Bytes())
+	if err != nil {
+		return nil, fmt.Errorf("failed to decompress joined segments: %s", err)
 	}
 
-	return nil
+	return data, nil
 }
@@ -2,11 +2,18 @@ package cmstore
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"math/rand"
 	"reflect"
 	"testing"
 	"testing/quick"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/serializer"
 )
 
 type roundTripTC struct {
@@ -132,3 +139,138 @@ func TestSimplePartitioner(t *testing.T) {
 	// testPartitionerRoundTrip(t, &SimplePartitioner{segmentSize: 512})
 	// testStringRoundTrip(t, &SimplePartitioner{segmentSize: 3})
 }
+
+func TestCompression(t *testing.T) {
+	data := bytes.Repeat([]byte("apiVersion: v1\nkind: ConfigMap\n"), 256)
+	countSegments := func(split []byte) int {
+		return bytes.Count(split, []byte("\n"))
+	}
+
+	uncompressed := NewPartitioner(512)
+	var plain bytes.Buffer
+	if err := uncompressed.Split(data, &plain); err != nil {
+		t.Fatalf("failed to split data: %s", err)
+	}
+
+	for _, compression := range []Compression{Gzip, Zstd} {
+		partitioner := NewPartitioner(512)
+		partitioner.SetCompression(compression)
+		testRoundTrip(t, partitioner)
+
+		var split bytes.Buffer
+		if err := partitioner.Split(data, &split); err != nil {
+			t.Fatalf("%s: failed to split data: %s", compression, err)
+		}
+		if countSegments(split.Bytes()) >= countSegments(plain.Bytes()) {
+			t.Errorf("%s: expected fewer than %d segments, got %d", compression, countSegments(plain.Bytes()), countSegments(split.Bytes()))
+		}
+
+		// Compression is detected without being configured
+		var joined []byte
+		if err := uncompressed.Join(&joined, &split); err != nil {
+			t.Fatalf("%s: failed to join data: %s", compression, err)
+		}
+		if !bytes.Equal(joined, data) {
+			t.Errorf("%s: joined data does not match", compression)
+		}
+	}
+
+	unsupported := NewPartitioner(512)
+	unsupported.SetCompression(Compression("lz4"))
+	if err := unsupported.Split(data, &bytes.Buffer{}); err == nil {
+		t.Errorf("expected an unsupported compression to be rejected")
+	}
+
+	// Stored partitions record their compression where it's seen without decoding them, like stream elements
+	partitioner := NewPartitioner(512)
+	partitioner.SetCompression(Zstd)
+	store := NewBackendStore(NewMemoryBackend(), partitioner, func() runtime.Object { return &corev1.ConfigMap{} })
+	in := &corev1.ConfigMap{Data: map[string]string{"data": string(data)}}
+	in.SetName("my-config")
+	if err := store.Create(context.Background(), "default/my-config", in, nil, 0); err != nil {
+		t.Fatalf("Set failed: %v", err)
+	}
+	partitions, _, err := store.partitions(context.Background(), "default/my-config")
+	if err != nil {
+		t.Fatalf("failed to list partitions: %v", err)
+	}
+	for _, p := range partitions {
+		if compression := p.GetAnnotations()[compressionAnnotationKey]; compression != string(Zstd) {
+			t.Errorf("expected partition %s to record its compression, got %q", p.GetName(), compression)
+		}
+	}
+}
+
+func TestMediaTypePartitioner(t *testing.T) {
+	scheme := runtime.NewScheme()
+	if err := corev1.AddToScheme(scheme); err != nil {
+		t.Fatalf("failed to build scheme: %s", err)
+	}
+	codecs := serializer.NewCodecFactory(scheme)
+
+	obj := &corev1.Namespace{
+		ObjectMeta: metav1.ObjectMeta{Name: "stored"},
+		Spec:       corev1.NamespaceSpec{Finalizers: []corev1.FinalizerName{corev1.FinalizerKubernetes}},
+	}
+	gvk := corev1.SchemeGroupVersion.WithKind("Namespace")
+
+	for _, mediaType := range []string{runtime.ContentTypeJSON, runtime.ContentTypeYAML, runtime.ContentTypeProtobuf} {
+		partitioner, err := NewMediaTypePartitioner(codecs, mediaType, corev1.SchemeGroupVersion, 16)
+		if err != nil {
+			t.Fatalf("%s: failed to build partitioner: %s", mediaType, err)
+		}
+
+		var split bytes.Buffer
+		if err := partitioner.Split(obj.DeepCopy(), &split); err != nil {
+			t.Fatalf("%s: failed to split object: %s", mediaType, err)
+		}
+		data := split.Bytes()
+
+		typed := &corev1.Namespace{}
+		if err := partitioner.Join(typed, bytes.NewReader(data)); err != nil {
+			t.Fatalf("%s: failed to join typed object: %s", mediaType, err)
+		}
+		if typed.GetName() != obj.GetName() || !reflect.DeepEqual(typed.Spec, obj.Spec) {
+			t.Errorf("%s: joined %v, expected %v", mediaType, typed, obj)
+		}
+
+		// The type is picked from the stored kind
+		var anything runtime.Object
+		if err := partitioner.Join(&anything, bytes.NewReader(data)); err != nil {
+			t.Fatalf("%s: failed to join object of unknown type: %s", mediaType, err)
+		}
+		if decoded, ok := anything.(*corev1.Namespace); !ok || !reflect.DeepEqual(decoded.Spec, obj.Spec) {
+			t.Errorf("%s: joined %#v, expected a Namespace", mediaType, anything)
+		}
+
+		u := &unstructured.Unstructured{}
+		if err := partitioner.Join(u, bytes.NewReader(data)); err != nil {
+			t.Fatalf("%s: failed to join unstructured object: %s", mediaType, err)
+		}
+		if u.GroupVersionKind() != gvk {
+			t.Errorf("%s: joined unstructured %s, expected %s", mediaType, u.GroupVersionKind(), gvk)
+		}
+		if finalizers, _, _ := unstructured.NestedStringSlice(u.Object, "spec", "finalizers"); !reflect.DeepEqual(finalizers, []string{string(corev1.FinalizerKubernetes)}) {
+			t.Errorf("%s: joined unstructured %v, expected the spec to be kept", mediaType, u.Object)
+		}
+	}
+
+	// Objects stay readable after switching media types
+	jsonPartitioner, _ := NewMediaTypePartitioner(codecs, runtime.ContentTypeJSON, corev1.SchemeGroupVersion, 16)
+	protobufPartitioner, _ := NewMediaTypePartitioner(codecs, runtime.ContentTypeProtobuf, corev1.SchemeGroupVersion, 16)
+	var split bytes.Buffer
+	if err := jsonPartitioner.Split(obj.DeepCopy(), &split); err != nil {
+		t.Fatalf("failed to split object: %s", err)
+	}
+	joined := &corev1.Namespace{}
+	if err := protobufPartitioner.Join(joined, &split); err != nil {
+		t.Fatalf("failed to join JSON with a protobuf partitioner: %s", err)
+	}
+	if !reflect.DeepEqual(joined.Spec, obj.Spec) {
+		t.Errorf("joined %v, expected %v", joined, obj)
+	}
+
+	if _, err := NewMediaTypePartitioner(codecs, "application/xml", corev1.SchemeGroupVersion, 16); err == nil {
+		t.Errorf("expected an unsupported media type to be rejected")
+	}
+}
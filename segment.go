@@ -0,0 +1,226 @@
+package cmstore
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"strconv"
+	"strings"
+	"time"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/selection"
+)
+
+// segmentPrefix prefixes the names of content-addressed segments.
+const segmentPrefix = "segment-"
+
+// sealingAnnotations are the annotations a sealed partition needs to be opened again, so they're carried over to the
+// segment storing it.
+// Sealed data is bound to the key, position and generation it was written for, so sealed segments are never shared.
+var sealingAnnotations = []string{keyIDAnnotationKey, positionAnnotationKey, generationAnnotationKey}
+
+// SetContentAddressable makes the store keep partitions in segments named by the digest of their data, shared by
+// every object, generation and stream element storing the same data.
+// Segments are reference counted, and are only deleted by CollectGarbage once nothing refers to them.
+// Objects written before are still read, and are stored in segments the next time they're written.
+func (s *ConfigMapStore) SetContentAddressable(enabled bool) {
+	s.contentAddressable = enabled
+}
+
+// SetContentAddressable makes the stream keep what's written to it in segments shared with other streams and objects
+// storing the same data.
+func (s *ConfigMapStream) SetContentAddressable(enabled bool) {
+	s.contentAddressable = enabled
+}
+
+// segmentName returns the name of the segment storing data.
+// Names are derived from the data itself, so the same data is only ever stored once.
+func segmentName(data []byte) string {
+	sum := sha256.Sum256(data)
+	return segmentPrefix + hex.EncodeToString(sum[:])
+}
+
+// isSegment returns true if the given blob is a content-addressed segment.
+func isSegment(blobMeta metav1.Object) bool {
+	_, ok := blobMeta.GetLabels()[segmentLabelKey]
+	return ok
+}
+
+// segmentSelector selects every content-addressed segment.
+func segmentSelector() (labels.Selector, error) {
+	segment, err := labels.NewRequirement(segmentLabelKey, selection.Exists, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return labels.NewSelector().Add(*segment), nil
+}
+
+// segmentRefs returns the number of references held to a segment.
+func segmentRefs(segmentMeta metav1.Object) int {
+	refs, err := strconv.Atoi(segmentMeta.GetAnnotations()[refsAnnotationKey])
+	if err != nil {
+		return 0
+	}
+
+	return refs
+}
+
+// segmentAcquired returns when a reference to a segment was last acquired.
+func segmentAcquired(segmentMeta metav1.Object) time.Time {
+	acquired, err := time.Parse(time.RFC3339, segmentMeta.GetAnnotations()[acquiredAnnotationKey])
+	if err != nil {
+		return segmentMeta.GetCreationTimestamp().Time
+	}
+
+	return acquired
+}
+
+// setRefs annotates a segment with the number of references held to it.
+func setRefs(segment metav1.Object, refs int) {
+	annotations := segment.GetAnnotations()
+	if annotations == nil {
+		annotations = map[string]string{}
+	}
+
+	annotations[refsAnnotationKey] = strconv.Itoa(refs)
+	segment.SetAnnotations(annotations)
+}
+
+// acquireSegment takes a reference to the segment storing the data of blob, creating it if it doesn't exist yet, and
+// returns the segment.
+// References are counted before they're held, so a segment is never counted short of what refers to it.
+func acquireSegment(ctx context.Context, backend Backend, blob *Blob, now time.Time) (*Blob, error) {
+	name := segmentName(blob.Data)
+	for {
+		segment, err := backend.Get(ctx, name)
+		switch {
+		case apierrors.IsNotFound(err):
+			segment = &Blob{Data: blob.Data}
+			segment.SetName(name)
+			segment.SetLabels(map[string]string{
+				segmentLabelKey: "true",
+			})
+			annotations := map[string]string{}
+			if _, sealed := blob.GetAnnotations()[keyIDAnnotationKey]; sealed {
+				for _, k := range sealingAnnotations {
+					annotations[k] = blob.GetAnnotations()[k]
+				}
+			}
+			segment.SetAnnotations(annotations)
+			setRefs(segment, 1)
+			segment.Annotations[acquiredAnnotationKey] = now.UTC().Format(time.RFC3339)
+
+			err = backend.Create(ctx, segment)
+			if apierrors.IsAlreadyExists(err) {
+				// Another writer stored the same data first, share theirs
+				continue
+			}
+		case err == nil:
+			setRefs(segment, segmentRefs(segment)+1)
+			segment.Annotations[acquiredAnnotationKey] = now.UTC().Format(time.RFC3339)
+
+			err = backend.Update(ctx, segment)
+			if apierrors.IsConflict(err) || apierrors.IsNotFound(err) {
+				// Referenced, released or collected in the meantime, count again
+				continue
+			}
+		}
+
+		return segment, err
+	}
+}
+
+// releaseSegment drops a reference to the named segment.
+// Segments nothing refers to are left for the garbage collector, which deletes them unless they're acquired again
+// in the meantime.
+func releaseSegment(ctx context.Context, backend Backend, name string) error {
+	for {
+		segment, err := backend.Get(ctx, name)
+		if apierrors.IsNotFound(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		refs := segmentRefs(segment)
+		if refs < 1 {
+			return nil
+		}
+		setRefs(segment, refs-1)
+
+		err = backend.Update(ctx, segment)
+		if apierrors.IsConflict(err) {
+			continue
+		}
+		if apierrors.IsNotFound(err) {
+			return nil
+		}
+
+		return err
+	}
+}
+
+// missingSegments returns the names of the segments committed by the manifest among the blobs stored for a key that
+// aren't among them.
+// Segments aren't labelled with the keys referring to them, so they're never listed along with a key.
+func missingSegments(blobs []Blob) []string {
+	var missing []string
+	for _, name := range missingPartitions(blobs) {
+		if strings.HasPrefix(name, segmentPrefix) {
+			missing = append(missing, name)
+		}
+	}
+
+	return missing
+}
+
+// withSegments adds the segments committed by the manifest among the blobs stored for a key to them.
+// Missing segments are left out, for committed to report the object missing.
+func (s *ConfigMapStore) withSegments(ctx context.Context, blobs []Blob) ([]Blob, error) {
+	for _, name := range missingSegments(blobs) {
+		segment, err := s.backend.Get(ctx, name)
+		if apierrors.IsNotFound(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		blobs = append(blobs, *segment)
+	}
+
+	return blobs, nil
+}
+
+// withKeyedSegments adds the segments committed by the manifests among keyed blobs to them, getting each segment at
+// most once.
+// Only the segments that are committed are fetched, so the data of objects that weren't selected is never read.
+func (s *ConfigMapStore) withKeyedSegments(ctx context.Context, keyed map[string][]Blob) error {
+	segments := map[string]*Blob{}
+	for key, blobs := range keyed {
+		for _, name := range missingSegments(blobs) {
+			segment, fetched := segments[name]
+			if !fetched {
+				var err error
+				segment, err = s.backend.Get(ctx, name)
+				if err != nil && !apierrors.IsNotFound(err) {
+					return err
+				}
+				segments[name] = segment
+			}
+
+			if segment != nil {
+				// Missing segments are left out, for committed to report the object missing
+				blobs = append(blobs, *segment)
+			}
+		}
+		keyed[key] = blobs
+	}
+
+	return nil
+}
@@ -0,0 +1,247 @@
+package cmstore
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/clock"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/apiserver/pkg/storage"
+)
+
+func TestContentAddressable(t *testing.T) {
+	var (
+		ctx     = context.Background()
+		backend = NewMemoryBackend()
+		store   = NewBackendStore(backend, NewPartitioner(64), func() runtime.Object { return &corev1.ConfigMap{} })
+		fake    = clock.NewFakeClock(time.Now())
+		padding = fmt.Sprintf("%512s", "")
+	)
+	store.clock = fake
+	store.SetContentAddressable(true)
+
+	segments := func() map[string]int {
+		selector, err := segmentSelector()
+		if err != nil {
+			t.Fatalf("failed to select segments: %v", err)
+		}
+		listed, _, err := backend.List(ctx, selector)
+		if err != nil {
+			t.Fatalf("failed to list segments: %v", err)
+		}
+
+		refs := map[string]int{}
+		for i := range listed {
+			refs[listed[i].GetName()] = segmentRefs(&listed[i])
+		}
+
+		return refs
+	}
+	create := func(name, greeting string) {
+		in := &corev1.ConfigMap{}
+		in.SetName(name)
+		in.SetUID("shared-uid")
+		in.Data = map[string]string{"greeting": greeting, "padding": padding}
+		if err := store.Create(ctx, "default/"+name, in, nil, 0); err != nil {
+			t.Fatalf("Set failed: %v", err)
+		}
+	}
+	get := func(name, expected string) {
+		out := &corev1.ConfigMap{}
+		if err := store.Get(ctx, "default/"+name, storage.GetOptions{}, out); err != nil {
+			t.Fatalf("Get failed: %v", err)
+		}
+		if out.Data["greeting"] != expected || out.Data["padding"] != padding {
+			t.Errorf("expected greeting %q, got %q", expected, out.Data["greeting"])
+		}
+	}
+
+	// Objects differing in small fields share the segments holding the rest
+	create("config-a", "Hello, a!")
+	shared := segments()
+	create("config-b", "Hello, b!")
+	stored := segments()
+	if len(stored) >= 2*len(shared) {
+		t.Errorf("expected objects to share segments, got %d segments for %d each", len(stored), len(shared))
+	}
+	var references int
+	for _, refs := range stored {
+		references += refs
+	}
+	if references != 2*len(shared) {
+		t.Errorf("expected %d references, got %d", 2*len(shared), references)
+	}
+	get("config-a", "Hello, a!")
+	get("config-b", "Hello, b!")
+
+	// So do generations, and replaced segments are released
+	if err := store.GuaranteedUpdate(ctx, "default/config-a", &corev1.ConfigMap{}, false, nil, func(input runtime.Object, _ storage.ResponseMeta) (runtime.Object, *uint64, error) {
+		cm := input.(*corev1.ConfigMap)
+		cm.Data["greeting"] = "Hello, b!"
+		return cm, nil, nil
+	}); err != nil {
+		t.Fatalf("GuaranteedUpdate failed: %v", err)
+	}
+	get("config-a", "Hello, b!")
+	references = 0
+	for name, refs := range segments() {
+		if _, ok := stored[name]; !ok {
+			t.Errorf("expected an update to reuse segments, created %s", name)
+		}
+		references += refs
+	}
+	if references != 2*len(shared) {
+		t.Errorf("expected %d references after the update, got %d", 2*len(shared), references)
+	}
+
+	// Streams share them too
+	stream := NewBackendStream(backend, "my-stream")
+	stream.SetContentAddressable(true)
+	for i := 0; i < 2; i++ {
+		if _, err := stream.Write([]byte("Hello, stream!")); err != nil {
+			t.Fatalf("failed to write to stream: %v", err)
+		}
+	}
+	if refs := segments()[segmentName([]byte("Hello, stream!"))]; refs != 2 {
+		t.Errorf("expected the stream elements to share a segment, got %d references", refs)
+	}
+	data, err := ioutil.ReadAll(NewBackendStream(backend, "my-stream"))
+	if err != nil || string(data) != "Hello, stream!Hello, stream!" {
+		t.Errorf("expected to read the stream back, got %q: %v", data, err)
+	}
+
+	// Leak a reference, as a writer that crashed before committing would
+	leaked, err := acquireSegment(ctx, backend, &Blob{Data: []byte("Goodbye!")}, fake.Now())
+	if err != nil {
+		t.Fatalf("failed to acquire segment: %v", err)
+	}
+
+	// Only released segments are collected within the grace period
+	released := map[string]bool{}
+	for name, refs := range segments() {
+		if refs < 1 {
+			released[name] = true
+		}
+	}
+	if len(released) < 1 {
+		t.Fatalf("expected segments to be released by the update")
+	}
+	opts := GCOptions{GracePeriod: time.Minute}
+	report, err := store.CollectGarbage(ctx, opts)
+	if err != nil {
+		t.Fatalf("CollectGarbage failed: %v", err)
+	}
+	if len(report.Removed) != len(released) {
+		t.Errorf("expected %d segments to be removed, got %v", len(released), report.Removed)
+	}
+	for _, removed := range report.Removed {
+		if !released[removed.Name] || removed.Key != "" {
+			t.Errorf("expected only released segments to be removed, removed %s of %q", removed.Name, removed.Key)
+		}
+	}
+
+	// Leaked references expire with the grace period
+	fake.Step(2 * time.Minute)
+	if report, err = store.CollectGarbage(ctx, opts); err != nil {
+		t.Fatalf("CollectGarbage failed: %v", err)
+	}
+	if len(report.Removed) != 1 || report.Removed[0].Name != leaked.GetName() {
+		t.Errorf("expected the leaked segment to be removed, got %v", report.Removed)
+	}
+	get("config-a", "Hello, b!")
+	get("config-b", "Hello, b!")
+
+	// Segments outlive the objects referring to them until all of them are deleted
+	if err := store.Delete(ctx, "default/config-a", &corev1.ConfigMap{}, nil, storage.ValidateAllObjectFunc); err != nil {
+		t.Fatalf("Delete failed: %v", err)
+	}
+	if report, err = store.CollectGarbage(ctx, opts); err != nil || len(report.Removed) < 1 || len(report.Removed) >= len(shared) {
+		t.Errorf("expected only the segments holding the name of the deleted object to be removed, removed %v: %v", report.Removed, err)
+	}
+	get("config-b", "Hello, b!")
+	if err := store.Delete(ctx, "default/config-b", &corev1.ConfigMap{}, nil, storage.ValidateAllObjectFunc); err != nil {
+		t.Fatalf("Delete failed: %v", err)
+	}
+	if _, err = store.CollectGarbage(ctx, opts); err != nil {
+		t.Fatalf("CollectGarbage failed: %v", err)
+	}
+	if remaining := segments(); len(remaining) != 1 {
+		t.Errorf("expected only the stream's segment to be left, got %v", remaining)
+	}
+}
+
+func TestContentAddressableList(t *testing.T) {
+	var (
+		ctx     = context.Background()
+		backend = &selectingBackend{Backend: NewMemoryBackend()}
+		store   = NewBackendStore(backend, NewPartitioner(64), func() runtime.Object { return &corev1.ConfigMap{} })
+	)
+	store.SetContentAddressable(true)
+	for _, key := range []string{"/registry/widgets/ns1/a", "/registry/widgets/ns2/b"} {
+		in := &corev1.ConfigMap{}
+		in.SetName(key[len(key)-1:])
+		in.Data = map[string]string{"greeting": fmt.Sprintf("%128s", "Hello, "+in.GetName()+"!")}
+		if err := store.Create(ctx, key, in, nil, 0); err != nil {
+			t.Fatalf("Set failed: %v", err)
+		}
+	}
+
+	// Only the segments of the objects below the prefix are read, not every segment in the backend
+	backend.listed = nil
+	list := &corev1.ConfigMapList{}
+	if err := store.List(ctx, "/registry/widgets/ns1/", storage.ListOptions{Predicate: storage.Everything}, list); err != nil {
+		t.Fatalf("List failed: %v", err)
+	}
+	if len(list.Items) != 1 || list.Items[0].Data["greeting"] != fmt.Sprintf("%128s", "Hello, a!") {
+		t.Errorf("expected the object below the prefix to be listed, got %v", list.Items)
+	}
+	for i := range backend.listed {
+		if isSegment(&backend.listed[i]) {
+			t.Errorf("expected segments not to be listed, got %s", backend.listed[i].GetName())
+		}
+	}
+}
+
+func TestContentAddressableWatch(t *testing.T) {
+	var (
+		ctx     = context.Background()
+		backend = NewMemoryBackend()
+		store   = NewBackendStore(backend, NewPartitioner(64), func() runtime.Object { return &corev1.ConfigMap{} })
+		in      = &corev1.ConfigMap{}
+	)
+	store.SetContentAddressable(true)
+
+	w, err := store.Watch(ctx, "default/my-config", storage.ListOptions{ResourceVersion: "0", Predicate: storage.Everything})
+	if err != nil {
+		t.Fatalf("Watch failed: %v", err)
+	}
+	defer w.Stop()
+
+	in.SetName("my-config")
+	in.Data = map[string]string{"greeting": fmt.Sprintf("%128s", "Hello, world!")}
+	if err := store.Create(ctx, "default/my-config", in, nil, 0); err != nil {
+		t.Fatalf("Set failed: %v", err)
+	}
+	expectEvent(t, w, watch.Added, in.Data["greeting"])
+
+	// Other objects acquiring the same segments don't change the watched one
+	in.SetName("my-other-config")
+	if err := store.Create(ctx, "default/my-other-config", in, nil, 0); err != nil {
+		t.Fatalf("Set failed: %v", err)
+	}
+	expectNoEvent(t, w)
+
+	// Objects are joined once their segments are observed, in whatever order they're replayed
+	replayed := NewBackendStore(backend, NewPartitioner(64), func() runtime.Object { return &corev1.ConfigMap{} })
+	rw, err := replayed.Watch(ctx, "default/my-config", storage.ListOptions{ResourceVersion: "0", Predicate: storage.Everything})
+	if err != nil {
+		t.Fatalf("Watch failed: %v", err)
+	}
+	defer rw.Stop()
+	expectEvent(t, rw, watch.Added, in.Data["greeting"])
+}
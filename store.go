@@ -1,351 +1,899 @@
 package cmstore
 
 import (
+	"bytes"
 	"context"
-	"hash/fnv"
-
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/conversion"
+	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/runtime"
-	"k8s.io/apimachinery/pkg/util/rand"
+	"k8s.io/apimachinery/pkg/selection"
+	"k8s.io/apimachinery/pkg/util/clock"
+	"k8s.io/apimachinery/pkg/util/uuid"
 	"k8s.io/apimachinery/pkg/watch"
 	"k8s.io/apiserver/pkg/storage"
+	"sigs.k8s.io/controller-runtime/pkg/cache"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 )
 
-// const (
-// 	prefix   = "cmstore"
-// 	objKey   = prefix + ".obj"
-// 	labelKey = prefix + "/key"
-// )
-
-// type Partitioner interface {
-// 	Partition(obj runtime.Object) (partitions <-chan runtime.Object, err error)
-// 	Join(partitions chan<- runtime.Object) (obj runtime.Object, err error)
-// }
-
-// type Partitions interface {
-// 	Push(partitions ...runtime.Object) error
-// 	Pop() (partition runtime.Object, err error)
-// }
-
-// type simplePartitions struct {
-// 	partitions []runtime.Object
-//     top int
-// }
+var errMissingPartition = errors.New("missing partition")
 
 type Object interface {
 	runtime.Object
 	metav1.Object
 }
 
-// type Partitioner interface {
-// 	Partition(ctx context.Context, from Object) (partitions []Object, err error)
-// 	Join(ctx context.Context, into Object, partitions ...Object) error
-// 	NewPartition() Unstructured
-// 	NewPartitionList() Object
-// }
-
-// type ConfigMapPartitioner struct {
-// 	codec runtime.Codec
-// }
-
-// func (p *ConfigMapPartitioner) Partition(_ context.Context, from Object) (partitions []Object, err error) {
-// 	// TODO(njhale): partition across several configmaps
-// 	var data []byte
-// 	if data, err = runtime.Encode(p.codec, from); err != nil {
-// 		return
-// 	}
-
-// 	cm := &corev1.ConfigMap{
-// 		BinaryData: map[string][]byte{
-// 			objKey: data,
-// 		},
-// 	}
-// 	cm.SetGenerateName("partition-")
-
-// 	partitions = append(partitions, cm)
-
-// 	return
-// }
-
-// func (p *ConfigMapPartitioner) Join(_ context.Context, into Object, partitions ...Object) error {
-// 	// Sort partitions by
-// 	sorted, err := sortPartitions(partitions)
-// 	if err != nil {
-// 		return fmt.Errorf("error joining partitions: %s", err)
-// 	}
-
-// 	if len(sorted) < 1 {
-// 		return fmt.Errorf("no partitions to join")
-// 	}
-
-// 	// Join partitions
-// 	var (
-// 		rvBuilder strings.Builder
-// 		data      []byte
-// 	)
-// 	for i, partition := range sorted {
-// 		fmt.Fprintf(&rvBuilder, partition.GetResourceVersion())
-// 		cm, ok := partition.(*corev1.ConfigMap)
-// 		if !ok {
-// 			return fmt.Errorf("failed to join partition %d, expected ConfigMap got %t", i, partition)
-// 		}
-// 		data = append(data, partition)
-// 	}
-
-// 	decoded, _, err := p.codec.Decode(data, nil, into)
-// 	if err != nil {
-// 		return fmt.Errorf("error decoding joined partitions: %s", err)
-// 	}
-
-// 	if decoded == nil {
-// 		return fmt.Errorf("failed to decode joined partitions")
-// 	}
-
-// 	// TODO(njhale): Make the combined resource version more standard looking
-// 	decoded.SetResourceVersion(safeHash32(rvBuilder.String()))
-// 	// TODO(njhale): Hash UID to reduce chance of GC collision
-// 	decoded.SetUID(sorted[0].GetUID())
-
-// 	reflect.ValueOf(into).Elem().Set(reflect.ValueOf(decoded).Elem())
-
-// 	return nil
-// }
-
-// func sortPartitions(partitions []Object) ([]Object, error) {
-// 	var (
-// 		length = len(partitions)
-// 		sorted = make([]Object, len(partitions))
-// 	)
-// 	for _, partition := range partitions {
-// 		// Panic, indicating programmer error
-// 		if partition == nil {
-// 			panic("programmer error: nil partition found")
-// 		}
-
-// 		position, found := paritionPosition(partition)
-// 		if !found {
-// 			return nil, fmt.Errorf("couldn't locate partition position: %v", partition)
-// 		}
-
-// 		if position < 0 || position >= length {
-// 			return nil, fmt.Errorf("partition position %d out of bounds [0, %d)", position, length)
-// 		}
-
-// 		if sorted[position] != nil {
-// 			return nil, fmt.Errorf("duplicate partition at position %d: %v", position, partition)
-// 		}
-
-// 		sorted[position] = position
-// 	}
-
-// 	return sorted, nil
-// }
-
-// func partitionPosition(paritionMeta metav1.Object) (position int, found bool) {
-// 	annotations := partitionMeta.GetAnnotations()
-// 	if len(annotations) < 1 {
-// 		return
-// 	}
-
-// 	var p string
-// 	if p, found = annotations[partitionAnnotationKey]; !found {
-// 		return
-// 	}
-
-// 	var err error
-// 	if position, err = strconv.Atoi(p); err != nil {
-// 		found = false
-// 	}
-
-// 	return
-// }
-
-func safeHash32(s string) (string, error) {
-	hasher := fnv.New32a()
-	if _, err := hasher.Write([]byte(s)); err != nil {
-		return "", nil
-	}
-
-	var sum []byte
-	sum = hasher.Sum(sum)
-
-	return rand.SafeEncodeString(string(sum)), nil
+// sortPartitions orders partitions by position, returning an error if any are missing or duplicated.
+// Partitions from different generations mean a write is in progress, so the partitions of the latest generation are
+// considered missing.
+func sortPartitions(partitions []Blob) ([]*Blob, error) {
+	var (
+		sorted     []*Blob
+		generation string
+	)
+	for i := range partitions {
+		partition := &partitions[i]
+		position, count, err := partitionPosition(partition)
+		if err != nil {
+			return nil, err
+		}
+
+		if sorted == nil {
+			sorted = make([]*Blob, count)
+			generation = partition.GetAnnotations()[generationAnnotationKey]
+		}
+		if g := partition.GetAnnotations()[generationAnnotationKey]; g != generation {
+			return nil, fmt.Errorf("partition %s is from generation %q, not %q: %w", partition.GetName(), g, generation, errMissingPartition)
+		}
+		if count != len(sorted) {
+			return nil, fmt.Errorf("partition %s disagrees on partition count: %d != %d", partition.GetName(), count, len(sorted))
+		}
+
+		if position < 0 || position >= count {
+			return nil, fmt.Errorf("partition position %d out of bounds [0, %d)", position, count)
+		}
+
+		if sorted[position] != nil {
+			return nil, fmt.Errorf("duplicate partition at position %d: %s", position, partition.GetName())
+		}
+
+		sorted[position] = partition
+	}
+
+	for position, partition := range sorted {
+		if partition == nil {
+			return nil, fmt.Errorf("partition at position %d: %w", position, errMissingPartition)
+		}
+	}
+
+	return sorted, nil
+}
+
+// partitionPosition returns the position of a partition and the total number of partitions for its key.
+func partitionPosition(partitionMeta metav1.Object) (position, count int, err error) {
+	annotations := partitionMeta.GetAnnotations()
+	if position, err = strconv.Atoi(annotations[positionAnnotationKey]); err != nil {
+		err = fmt.Errorf("couldn't locate position of partition %s: %v", partitionMeta.GetName(), err)
+		return
+	}
+	if count, err = strconv.Atoi(annotations[countAnnotationKey]); err != nil {
+		err = fmt.Errorf("couldn't locate partition count of partition %s: %v", partitionMeta.GetName(), err)
+	}
+
+	return
+}
+
+// NewStore returns a store that partitions objects across ConfigMaps in the storage namespace.
+// The informers must serve ConfigMaps in the storage namespace and newFunc must return new instances of the stored type.
+func NewStore(client client.Client, informers cache.Informers, storageNamespace string, partitioner Partitioner, newFunc func() runtime.Object) *ConfigMapStore {
+	return NewBackendStore(NewConfigMapBackend(client, informers, storageNamespace), partitioner, newFunc)
+}
+
+// NewSecretStore returns a store that partitions objects across Secrets in the storage namespace, for objects that
+// should be guarded like Secrets are.
+// The informers must serve Secrets in the storage namespace and newFunc must return new instances of the stored type.
+func NewSecretStore(client client.Client, informers cache.Informers, storageNamespace string, partitioner Partitioner, newFunc func() runtime.Object) *ConfigMapStore {
+	return NewBackendStore(NewSecretBackend(client, informers, storageNamespace), partitioner, newFunc)
+}
+
+// NewBackendStore returns a store that partitions objects across the blobs of the given backend.
+// newFunc must return new instances of the stored type.
+func NewBackendStore(backend Backend, partitioner Partitioner, newFunc func() runtime.Object) *ConfigMapStore {
+	s := &ConfigMapStore{
+		backend:     backend,
+		versioner:   Versioner{},
+		partitioner: partitioner,
+		newFunc:     newFunc,
+		clock:       clock.RealClock{},
+		reapPeriod:  defaultReapPeriod,
+	}
+	s.watchers = newBroadcaster(s)
+
+	return s
+}
+
+// partitionWriter collects each write as the data of a new partition.
+type partitionWriter struct {
+	partitions []*Blob
+	// limit bounds the bytes each partition may take when set.
+	limit int
+	// compression is how the data of the partitions written is compressed.
+	compression Compression
+}
+
+// SegmentLimit returns the most bytes each partition written may take, or zero if they're unbounded.
+func (w *partitionWriter) SegmentLimit() int {
+	return w.limit
+}
+
+// RecordCompression records how the partitions written are compressed, so it's annotated on each of them.
+func (w *partitionWriter) RecordCompression(compression Compression) {
+	w.compression = compression
 }
 
+func (w *partitionWriter) Write(p []byte) (int, error) {
+	// Writers may reuse p after returning, so hold onto a copy
+	data := make([]byte, len(p))
+	copy(data, p)
+
+	partition := &Blob{Data: data}
+	partition.SetGenerateName("partition-")
+	w.partitions = append(w.partitions, partition)
+
+	return len(p), nil
+}
+
+// setPosition annotates a partition with its position, the total number of partitions for its key, and the generation
+// it was written with.
+func setPosition(partition metav1.Object, position, count int, generation string) {
+	annotations := partition.GetAnnotations()
+	if annotations == nil {
+		annotations = map[string]string{}
+	}
+
+	annotations[positionAnnotationKey] = strconv.Itoa(position)
+	annotations[countAnnotationKey] = strconv.Itoa(count)
+	annotations[generationAnnotationKey] = generation
+	partition.SetAnnotations(annotations)
+}
+
+// ConfigMapStore is a storage.Interface that partitions objects across the blobs of a Backend, ConfigMaps by default.
 type ConfigMapStore struct {
-	client           client.Client
-	versioner        storage.Versioner
-	storageNamespace string
+	backend     Backend
+	versioner   storage.Versioner
+	partitioner Partitioner
+	transformer Transformer
+	newFunc     func() runtime.Object
+	watchers    *broadcaster
+	clock       clock.Clock
+	reapPeriod  time.Duration
+	gc          *GCOptions
+
+	ownerReferences OwnerReferencesFunc
+	// contentAddressable keeps partitions in shared segments when set.
+	contentAddressable bool
+	// budget is the most bytes each stored blob may take, if partitions are packed to fit it.
+	budget int
+	// prefix is the directory the keys of the store's objects are below, or empty if every key is the store's.
+	prefix string
 }
 
-// Stamp applies the store labels and namespace to a predicate.
-func (s *ConfigMapStore) stamp(key string, predicate Object) {
-	labels := predicate.GetLabels()
-	if labels == nil {
-		labels = map[string]string{}
+// SetPrefix scopes the store to the keys below prefix, e.g. the resource prefix of the objects it stores.
+// Its reaper and watches then leave the keys of other stores sharing the backend alone, rather than decoding their
+// objects as its own.
+func (s *ConfigMapStore) SetPrefix(prefix string) {
+	if prefix != "" && !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
 	}
+	s.prefix = prefix
+}
+
+// owns returns true if key is below the store's prefix.
+func (s *ConfigMapStore) owns(key string) bool {
+	return strings.HasPrefix(key, s.prefix)
+}
+
+// Stamp applies the store labels and annotations for key to a predicate.
+func (s *ConfigMapStore) stamp(key string, predicate metav1.Object) {
+	stampKey(key, predicate)
+}
 
-	labels[labelKey] = key
-	predicate.SetLabels(labels)
+// blobs lists the manifest and partitions stored for the given key, along with the segments the manifest commits, and
+// the version they were listed at.
+func (s *ConfigMapStore) blobs(ctx context.Context, key string) ([]Blob, uint64, error) {
+	blobs, resourceVersion, err := s.backend.List(ctx, keySelector(key))
+	if err != nil {
+		return nil, 0, err
+	}
+	if blobs, err = s.withSegments(ctx, forKey(key, blobs)); err != nil {
+		return nil, 0, err
+	}
 
-	predicate.SetNamespace(s.storageNamespace)
+	return blobs, listVersion(resourceVersion), nil
 }
 
-func (s *ConfigMapStore) labelSelector(key string) *metav1.LabelSelector {
-	return &metav1.LabelSelector{
-		MatchLabels: map[string]string{
-			labelKey: key,
-		},
+// partitions lists the partitions stored for the given key, committed or not, and the version they were listed at.
+func (s *ConfigMapStore) partitions(ctx context.Context, key string) ([]Blob, uint64, error) {
+	blobs, current, err := s.blobs(ctx, key)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var partitions []Blob
+	for _, blob := range blobs {
+		if !isManifest(&blob) {
+			partitions = append(partitions, blob)
+		}
 	}
+
+	return partitions, current, nil
 }
 
-// var _ storage.Interface = &ConfigMapStore{}
+// split partitions obj into blobs stamped for key, expiring at the given time unless it's zero.
+func (s *ConfigMapStore) split(key string, obj runtime.Object, expires time.Time) ([]*Blob, error) {
+	w := partitionWriter{limit: s.segmentLimit(s.budget, s.transformer, key)}
+	if err := s.partitioner.Split(obj, &w); err != nil {
+		return nil, storage.NewInternalErrorf("failed to partition %s: %v", key, err)
+	}
+
+	partitions := w.partitions
+	if len(partitions) < 1 {
+		return nil, storage.NewInternalErrorf("failed to partition %s: no segments written", key)
+	}
+
+	// Partitions written together share a generation so readers can tell when they're looking at a mix of writes
+	generation := string(uuid.NewUUID())
+	for i, p := range partitions {
+		s.stamp(key, p)
+		setPosition(p, i, len(partitions), generation)
+		setExpiry(p, expires)
+		if w.compression != NoCompression {
+			p.Annotations[compressionAnnotationKey] = string(w.compression)
+		}
+	}
+
+	return partitions, nil
+}
+
+// read joins the partitions committed for key into objPtr, returning the manifest, the partitions in order, and the
+// version they were read at.
+func (s *ConfigMapStore) read(ctx context.Context, key string, objPtr runtime.Object) (*Blob, []*Blob, uint64, error) {
+	blobs, current, err := s.blobs(ctx, key)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+
+	committed, sorted, err := s.join(key, blobs, objPtr)
+	if storage.IsNotFound(err) {
+		return nil, nil, current, storage.NewKeyNotFoundError(key, int64(current))
+	}
+	if err != nil {
+		return nil, nil, current, err
+	}
+	if s.expired(committed) {
+		return nil, nil, current, storage.NewKeyNotFoundError(key, int64(current))
+	}
+
+	if version, err := s.versioner.ObjectResourceVersion(objPtr); err == nil && version > current {
+		current = version
+	}
+
+	return committed, sorted, current, nil
+}
+
+// join reassembles the object committed among the blobs stored for key into objPtr, returning the manifest and the
+// partitions in order.
+func (s *ConfigMapStore) join(key string, blobs []Blob, objPtr runtime.Object) (*Blob, []*Blob, error) {
+	committed, sorted, err := s.committed(key, blobs)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	segments := make([]io.Reader, len(sorted))
+	for i, partition := range sorted {
+		data, _, err := s.open(key, partition)
+		if err != nil {
+			return nil, nil, storage.NewInternalErrorf("failed to transform partitions of %s: %v", key, err)
+		}
+		segments[i] = bytes.NewReader(data)
+	}
+
+	if err := runtime.SetZeroValue(objPtr); err != nil {
+		return nil, nil, err
+	}
+	if err := s.partitioner.Join(objPtr, io.MultiReader(segments...)); err != nil {
+		return nil, nil, storage.NewInternalErrorf("failed to join partitions of %s: %v", key, err)
+	}
+
+	version, err := committedVersion(committed, sorted)
+	if err != nil {
+		return nil, nil, storage.NewInternalErrorf("failed to version %s: %v", key, err)
+	}
+	if err := s.versioner.UpdateObject(objPtr, version); err != nil {
+		return nil, nil, err
+	}
+
+	return committed, sorted, nil
+}
+
+// validateResourceVersion checks that data read at the current version satisfies the requested resourceVersion.
+// Only the latest data is ever available, so an exact match is only served when the newest version read is no newer
+// than the one requested. Anything else is reported as expired.
+func (s *ConfigMapStore) validateResourceVersion(resourceVersion string, match metav1.ResourceVersionMatch, newest, current uint64) error {
+	requested, err := s.versioner.ParseResourceVersion(resourceVersion)
+	if err != nil {
+		return apierrors.NewBadRequest(fmt.Sprintf("invalid resource version: %v", err))
+	}
+
+	switch match {
+	case "", metav1.ResourceVersionMatchNotOlderThan, metav1.ResourceVersionMatchExact:
+	default:
+		return apierrors.NewBadRequest(fmt.Sprintf("unknown ResourceVersionMatch value: %v", match))
+	}
+
+	switch {
+	case requested > current:
+		return storage.NewTooLargeResourceVersionError(requested, current, 0)
+	case match == metav1.ResourceVersionMatchExact && requested < newest:
+		return apierrors.NewResourceExpired(fmt.Sprintf("too old resource version: %d (%d)", requested, newest))
+	}
+
+	return nil
+}
+
+var _ storage.Interface = &ConfigMapStore{}
 
 func (s *ConfigMapStore) Versioner() storage.Versioner {
 	return s.versioner
 }
 
-func (s *ConfigMapStore) Create(ctx context.Context, key string, obj, out runtime.Object, _ uint64) error {
-	// if version, err := s.versioner.ObjectResourceVersion(obj); err == nil && version != 0 {
-	// 	return errors.New("resourceVersion should not be set on objects to be created")
-	// }
-	// if err := s.versioner.PrepareObjectForStorage(obj); err != nil {
-	// 	return fmt.Errorf("PrepareObjectForStorage failed: %v", err)
-	// }
-
-	// o, ok := obj.(Object)
-	// if !ok {
-	// 	// TODO(njhale): return appropriate storage error
-	// 	return fmt.Errorf("assertion failed: %t is not an Object", obj)
-	// }
-
-	// existing := o.DeepCopyObject().(Object)
-	// if err := s.Get(ctx, key, "", existing, true); err != nil {
-	// 	// TODO(njhale): return appropriate storage error
-	// 	return err
-	// }
-	// if existing.GetUID() != "" {
-	// 	// TODO(njhale): return appropriate storage error
-	// 	return fmt.Errorf("resource already exists")
-	// }
-
-	// partitions, err := s.partitioner.Partition(ctx, o)
-	// if err != nil {
-	// 	// TODO(njhale): convert to appropriate storage error
-	// 	return err
-	// }
-
-	// if len(partitions) < 1 {
-	// 	// TODO(njhale): convert to appropriate storage error
-	// 	return fmt.Errorf("failed to partition")
-	// }
-
-	// // TODO(njhale): parallelize
-	// defer func() {
-	// 	if err == nil {
-	// 		// Transaction was successful!
-	// 		return
-	// 	}
-
-	// 	// Cancel transaction
-	// 	for _, p := range partitions {
-	// 		if p.GetUID() == "" {
-	// 			// Since paritions are created sequentially, we know later elements were never created, so we can bail out early
-	// 			return
-	// 		}
-
-	// 		// TODO(njhale): log errors
-	// 		s.client.Delete(ctx, p)
-	// 	}
-
-	// 	return
-	// }()
-
-	// for i, p := range partitions {
-	// 	s.stamp(key, p)
-	// 	// TODO(njhale): chain OwnerReferences
-	// 	if err = s.client.Create(ctx, p); err != nil {
-	// 		// TODO(njhale): return appropriate storage error
-	// 		break
-	// 	}
-
-	// 	partitions[i] = p
-	// }
-
-	// // Project metadata from the first partition onto the result
-	// // We already know that more than one partition exists, so it's okay to index directly
-	// var accessor metav1.Object
-	// accessor, err = meta.Accessor(obj)
-	// if err != nil {
-	// 	// TODO(njhale): return appropriate storage error
-	// 	return err
-	// }
-	// ProjectMeta(partitions[0], accessor)
-
-	// reflect.ValueOf(out).Elem().Set(reflect.ValueOf(obj).Elem())
-
-	// return err
-	return nil
+func (s *ConfigMapStore) Create(ctx context.Context, key string, obj, out runtime.Object, ttl uint64) (err error) {
+	accessor, err := meta.Accessor(obj)
+	if err != nil {
+		return storage.NewInternalErrorf("can't enforce metadata on un-introspectable object %v: %v", obj, err)
+	}
+	if accessor.GetResourceVersion() != "" {
+		return errors.New("resourceVersion should not be set on objects to be created")
+	}
+	if err = s.versioner.PrepareObjectForStorage(obj); err != nil {
+		return fmt.Errorf("PrepareObjectForStorage failed: %v", err)
+	}
+	if accessor.GetUID() == "" {
+		// Partitions are replaced on update, so the object carries its own UID instead of borrowing one from a partition
+		accessor.SetUID(uuid.NewUUID())
+	}
+
+	blobs, _, err := s.blobs(ctx, key)
+	if err != nil {
+		return err
+	}
+	// A key reserved by a writer that never committed is taken over
+	reserved := findManifest(blobs)
+	var expired []*Blob
+	if reserved != nil && isCommitted(reserved) {
+		if !s.expired(reserved) {
+			return storage.NewKeyExistsError(key, 0)
+		}
+
+		// Expired objects are already gone to readers, so they're written over in place
+		_, expired, _ = s.committed(key, blobs)
+	}
+
+	var partitions []*Blob
+	if partitions, err = s.split(key, obj, s.expiry(ttl)); err != nil {
+		return err
+	}
+	if err = s.seal(key, partitions); err != nil {
+		return err
+	}
+
+	committed, exists, err := s.commit(ctx, key, reserved, s.owners(obj), partitions)
+	if exists {
+		// Another writer created it first
+		return storage.NewKeyExistsError(key, 0)
+	}
+	if err != nil {
+		return err
+	}
+	s.discard(ctx, expired)
+
+	if out == nil {
+		return nil
+	}
+
+	version, err := committedVersion(committed, partitions)
+	if err != nil {
+		return storage.NewInternalErrorf("failed to version %s: %v", key, err)
+	}
+	reflect.ValueOf(out).Elem().Set(reflect.ValueOf(obj.DeepCopyObject()).Elem())
+
+	return s.versioner.UpdateObject(out, version)
 }
 
 func (s *ConfigMapStore) Delete(ctx context.Context, key string, out runtime.Object, preconditions *storage.Preconditions, validateDeletion storage.ValidateObjectFunc) error {
-	// TODO(njhale): implement
-	panic("not implemented")
-	return nil
+	for {
+		committed, partitions, _, err := s.read(ctx, key, out)
+		switch {
+		case storage.IsInternalError(err):
+			// An object missing partitions can never be read again, so there's nothing to check its deletion against.
+			// It's deleted as it is, like a corrupt object in etcd, leaving the key free to be written again
+			var incomplete bool
+			if committed, partitions, incomplete, err = s.incomplete(ctx, key, err); !incomplete {
+				return err
+			}
+		case err != nil:
+			return err
+		default:
+			if err := preconditions.Check(key, out); err != nil {
+				return err
+			}
+			if validateDeletion != nil {
+				if err := validateDeletion(ctx, out); err != nil {
+					return err
+				}
+			}
+		}
+
+		retry, err := s.remove(ctx, committed, partitions)
+		if retry {
+			// Another writer beat us to it, start over with the latest state
+			continue
+		}
+
+		return err
+	}
 }
 
-func (s *ConfigMapStore) Watch(ctx context.Context, key, resourceVersion string, p storage.SelectionPredicate) (watch.Interface, error) {
-	// TODO(njhale): implement
-	panic("not implemented")
-	return nil, nil
+func (s *ConfigMapStore) Watch(ctx context.Context, key string, opts storage.ListOptions) (watch.Interface, error) {
+	return s.watchers.watch(ctx, key, false, opts.ResourceVersion, opts.Predicate)
 }
 
-func (s *ConfigMapStore) WatchList(ctx context.Context, key, resourceVersion string, p storage.SelectionPredicate) (watch.Interface, error) {
-	// TODO(njhale): implement
-	panic("not implemented")
-	return nil, nil
+// WatchList watches every object below key. Objects are filtered by key as they're observed, rather than selected on
+// the prefix labels of key, since every watch is served from a single watch of the whole backend.
+func (s *ConfigMapStore) WatchList(ctx context.Context, key string, opts storage.ListOptions) (watch.Interface, error) {
+	return s.watchers.watch(ctx, key, true, opts.ResourceVersion, opts.Predicate)
 }
 
-func (s *ConfigMapStore) Get(ctx context.Context, key, resourceVersion string, obj runtime.Object, ignoreNotFound bool) error {
-	// partitionList := s.partitioner.NewPartitionList()
-	// if err := s.client.List(ctx, partitionList, client.InNamespace(s.storageNamespace), client.MatchingLabelsSelector{s.labelSelector(key)}); err != nil {
-	// 	// TODO(njhale): return appropriate storage error
-	// 	return err
-	// }
+func (s *ConfigMapStore) Get(ctx context.Context, key string, opts storage.GetOptions, objPtr runtime.Object) error {
+	_, _, current, err := s.read(ctx, key, objPtr)
+	if err != nil && !storage.IsNotFound(err) {
+		return err
+	}
 
-	// var partitions []Object
-	// for _, obj := range partitionList.Items {
-	// 	partitions = append(partitions, obj.Object)
-	// }
-	return nil
+	if err := s.validateResourceVersion(opts.ResourceVersion, "", current, current); err != nil {
+		return err
+	}
+
+	if storage.IsNotFound(err) && opts.IgnoreNotFound {
+		return runtime.SetZeroValue(objPtr)
+	}
+
+	return err
 }
 
-func (s *ConfigMapStore) GetToList(ctx context.Context, key, resourceVersion string, p storage.SelectionPredicate, list runtime.Object) error {
-	// TODO(njhale): implement
-	panic("not implemented")
-	return nil
+func (s *ConfigMapStore) GetToList(ctx context.Context, key string, opts storage.ListOptions, listObj runtime.Object) error {
+	newItem, err := newListItemFunc(listObj)
+	if err != nil {
+		return err
+	}
+
+	var items []runtime.Object
+	obj := newItem()
+	_, _, current, err := s.read(ctx, key, obj)
+	if err != nil && !storage.IsNotFound(err) {
+		return err
+	}
+
+	// The object is all that's read, so an exact match holds as long as it hasn't changed since
+	newest, _ := s.versioner.ObjectResourceVersion(obj)
+	if err := s.validateResourceVersion(opts.ResourceVersion, opts.ResourceVersionMatch, newest, current); err != nil {
+		return err
+	}
+
+	if err == nil {
+		matches, err := opts.Predicate.Matches(obj)
+		if err != nil {
+			return err
+		}
+		if matches {
+			items = append(items, obj)
+		}
+	}
+
+	if err := meta.SetList(listObj, items); err != nil {
+		return err
+	}
+
+	return s.versioner.UpdateList(listObj, current, "", nil)
 }
 
-func (s *ConfigMapStore) List(ctx context.Context, key, resourceVersion string, p storage.SelectionPredicate, list runtime.Object) error {
-	// TODO(njhale): implement
-	panic("not implemented")
-	return nil
+func (s *ConfigMapStore) List(ctx context.Context, key string, opts storage.ListOptions, listObj runtime.Object) error {
+	newItem, err := newListItemFunc(listObj)
+	if err != nil {
+		return err
+	}
+
+	// Only list objects below the key, treating it as a directory
+	prefix := key
+	if !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+
+	pred := opts.Predicate
+	var after string
+	if pred.Continue != "" {
+		if after, err = decodeContinue(pred.Continue, prefix); err != nil {
+			return apierrors.NewBadRequest(fmt.Sprintf("invalid continue token: %v", err))
+		}
+		if opts.ResourceVersion != "" && opts.ResourceVersion != "0" {
+			return apierrors.NewBadRequest("specifying resource version is not allowed when using continue")
+		}
+	}
+
+	keyed, current, err := s.keyedPartitions(ctx, prefix)
+	if err != nil {
+		return err
+	}
+
+	// Deletions leave nothing behind to compare against, so only an exact match for the current version holds
+	if err := s.validateResourceVersion(opts.ResourceVersion, opts.ResourceVersionMatch, current, current); err != nil {
+		return err
+	}
+
+	var keys []string
+	for k := range keyed {
+		if strings.HasPrefix(k, prefix) && k > after {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+
+	var (
+		items     []runtime.Object
+		next      string
+		remaining *int64
+	)
+	for i, k := range keys {
+		if pred.Limit > 0 && int64(len(items)) >= pred.Limit {
+			// There's more to list, tell the caller where to pick up
+			if next, err = encodeContinue(keys[i-1], prefix); err != nil {
+				return err
+			}
+
+			if pred.Empty() {
+				// Counting what's left is only possible when nothing is filtered out
+				count := int64(len(keys) - i)
+				remaining = &count
+			}
+			break
+		}
+
+		obj := newItem()
+		committed, _, err := s.join(k, keyed[k], obj)
+		if storage.IsNotFound(err) {
+			// Nothing's committed for the key, likely in the middle of being created or deleted
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if s.expired(committed) {
+			continue
+		}
+
+		matches, err := pred.Matches(obj)
+		if err != nil {
+			return err
+		}
+		if matches {
+			items = append(items, obj)
+		}
+	}
+
+	if err := meta.SetList(listObj, items); err != nil {
+		return err
+	}
+
+	return s.versioner.UpdateList(listObj, current, next, remaining)
+}
+
+// keyedPartitions returns the manifests and partitions stored below a directory, or every one when the prefix is
+// empty, grouped by key along with the segments their manifests commit, and the version they were listed at.
+// Keys below the directory are selected by label, so callers only need to drop those of colliding directories.
+func (s *ConfigMapStore) keyedPartitions(ctx context.Context, prefix string) (map[string][]Blob, uint64, error) {
+	selector, err := prefixSelector(prefix)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	partitions, resourceVersion, err := s.backend.List(ctx, selector)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var (
+		current = listVersion(resourceVersion)
+		keyed   = map[string][]Blob{}
+	)
+	for i, partition := range partitions {
+		key := blobKey(&partitions[i])
+		keyed[key] = append(keyed[key], partition)
+
+		if version, err := partitionsVersion([]*Blob{&partitions[i]}); err == nil && version > current {
+			current = version
+		}
+	}
+	if err := s.withKeyedSegments(ctx, keyed); err != nil {
+		return nil, 0, err
+	}
+
+	return keyed, current, nil
+}
+
+// newListItemFunc returns a func that allocates new items for the given list.
+func newListItemFunc(listObj runtime.Object) (func() runtime.Object, error) {
+	itemsPtr, err := meta.GetItemsPtr(listObj)
+	if err != nil {
+		return nil, err
+	}
+	items, err := conversion.EnforcePtr(itemsPtr)
+	if err != nil || items.Kind() != reflect.Slice {
+		return nil, fmt.Errorf("need ptr to slice: %v", err)
+	}
+
+	elemType := items.Type().Elem()
+	if elemType.Kind() == reflect.Ptr {
+		elemType = elemType.Elem()
+	}
+
+	return func() runtime.Object {
+		return reflect.New(elemType).Interface().(runtime.Object)
+	}, nil
+}
+
+// continueToken marks where a paginated list left off.
+type continueToken struct {
+	APIVersion string `json:"v"`
+	Prefix     string `json:"prefix"`
+	After      string `json:"after"`
+}
+
+const continueTokenAPIVersion = "cmstore.x-k8s.io/v1alpha1"
+
+// encodeContinue returns an opaque token that resumes listing prefix after the given key.
+func encodeContinue(after, prefix string) (string, error) {
+	data, err := json.Marshal(continueToken{
+		APIVersion: continueTokenAPIVersion,
+		Prefix:     prefix,
+		After:      after,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(data), nil
+}
+
+// decodeContinue returns the key to resume listing prefix after.
+func decodeContinue(token, prefix string) (string, error) {
+	data, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return "", fmt.Errorf("continue key is not valid: %v", err)
+	}
+
+	var c continueToken
+	if err := json.Unmarshal(data, &c); err != nil {
+		return "", fmt.Errorf("continue key is not valid: %v", err)
+	}
+
+	switch {
+	case c.APIVersion != continueTokenAPIVersion:
+		return "", fmt.Errorf("continue key is not valid: server does not recognize this encoded key")
+	case c.Prefix != prefix:
+		return "", fmt.Errorf("continue key is not valid: it was issued for a different prefix")
+	case !strings.HasPrefix(c.After, prefix):
+		return "", fmt.Errorf("continue key is not valid: it does not belong to the listed prefix")
+	}
+
+	return c.After, nil
 }
 
 func (s *ConfigMapStore) GuaranteedUpdate(ctx context.Context, key string, ptrToType runtime.Object, ignoreNotFound bool, preconditions *storage.Preconditions, tryUpdate storage.UpdateFunc, suggestion ...runtime.Object) error {
-	// TODO(njhale): implement
-	panic("not implemented")
-	return nil
+	var suggested runtime.Object
+	if len(suggestion) == 1 && suggestion[0] != nil {
+		suggested = suggestion[0]
+	}
+
+	for {
+		current := ptrToType.DeepCopyObject()
+		committed, partitions, err := s.readForUpdate(ctx, key, current, ignoreNotFound, suggested)
+		if err != nil {
+			return err
+		}
+		// Only trust the suggestion once, a retry means it's stale
+		suggested = nil
+
+		if err := preconditions.Check(key, current); err != nil {
+			return err
+		}
+
+		version, err := s.versioner.ObjectResourceVersion(current)
+		if err != nil {
+			return err
+		}
+
+		ret, ttl, err := tryUpdate(current.DeepCopyObject(), storage.ResponseMeta{
+			TTL:             s.remainingTTL(committed),
+			ResourceVersion: version,
+		})
+		if err != nil {
+			return err
+		}
+
+		// Keep the current expiry unless given a new ttl
+		var expires time.Time
+		if ttl != nil {
+			expires = s.expiry(*ttl)
+		} else if len(partitions) > 0 && !s.expired(committed) {
+			expires = partitionExpiry(committed)
+		}
+		if err := s.versioner.PrepareObjectForStorage(ret); err != nil {
+			return fmt.Errorf("PrepareObjectForStorage failed: %v", err)
+		}
+
+		updated, err := s.split(key, ret, expires)
+		if err != nil {
+			return err
+		}
+
+		if s.unchanged(key, committed, partitions, updated) {
+			// Nothing to write, hand back what's already stored
+			reflect.ValueOf(ptrToType).Elem().Set(reflect.ValueOf(current).Elem())
+			return nil
+		}
+		if err := s.seal(key, updated); err != nil {
+			return err
+		}
+
+		swapped, retry, err := s.commit(ctx, key, committed, s.owners(ret), updated)
+		if retry {
+			// Another writer beat us to it, try again against the latest state
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		s.discard(ctx, partitions)
+
+		if version, err = committedVersion(swapped, updated); err != nil {
+			return storage.NewInternalErrorf("failed to version %s: %v", key, err)
+		}
+		reflect.ValueOf(ptrToType).Elem().Set(reflect.ValueOf(ret).Elem())
+
+		return s.versioner.UpdateObject(ptrToType, version)
+	}
 }
 
-func (s *ConfigMapStore) Count(key string) (int64, error) {
-	// TODO(njhale): implement
-	panic("not implemented")
-	return 0, nil
+// readForUpdate reads the current state of key into obj, returning the manifest and the partitions in order.
+// A suggested object is used in place of joining the partitions when its resourceVersion is current.
+// Missing objects are returned as zero values, along with the manifest reserving the key if any, when ignoring not
+// found. So are expired objects, along with their manifest and partitions.
+func (s *ConfigMapStore) readForUpdate(ctx context.Context, key string, obj runtime.Object, ignoreNotFound bool, suggested runtime.Object) (*Blob, []*Blob, error) {
+	blobs, _, err := s.blobs(ctx, key)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if reserved := findManifest(blobs); reserved == nil || !isCommitted(reserved) {
+		if !ignoreNotFound {
+			return nil, nil, storage.NewKeyNotFoundError(key, 0)
+		}
+
+		return reserved, nil, runtime.SetZeroValue(obj)
+	}
+
+	committed, sorted, err := s.suggest(key, blobs, obj, suggested)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if s.expired(committed) {
+		if !ignoreNotFound {
+			return nil, nil, storage.NewKeyNotFoundError(key, 0)
+		}
+
+		// Write over the expired object in place
+		return committed, sorted, runtime.SetZeroValue(obj)
+	}
+
+	return committed, sorted, nil
+}
+
+// suggest sets obj to the suggested object if it's up to date with the committed partitions, joining them otherwise.
+func (s *ConfigMapStore) suggest(key string, blobs []Blob, obj, suggested runtime.Object) (*Blob, []*Blob, error) {
+	if suggested == nil {
+		return s.join(key, blobs, obj)
+	}
+
+	committed, sorted, err := s.committed(key, blobs)
+	if err != nil {
+		return s.join(key, blobs, obj)
+	}
+
+	version, err := committedVersion(committed, sorted)
+	if err != nil {
+		return nil, nil, storage.NewInternalErrorf("failed to version %s: %v", key, err)
+	}
+
+	if suggestedVersion, err := s.versioner.ObjectResourceVersion(suggested); err == nil && suggestedVersion == version {
+		reflect.ValueOf(obj).Elem().Set(reflect.ValueOf(suggested.DeepCopyObject()).Elem())
+		return committed, sorted, nil
+	}
+
+	return s.join(key, blobs, obj)
+}
+
+// unchanged returns true if the partitions committed by a manifest hold the same data as the updated ones, expire at
+// the same time, and aren't stale.
+func (s *ConfigMapStore) unchanged(key string, committed *Blob, current, updated []*Blob) bool {
+	if len(current) < 1 || len(current) != len(updated) {
+		return false
+	}
+	if !partitionExpiry(committed).Equal(partitionExpiry(updated[0])) {
+		return false
+	}
+
+	for i := range current {
+		data, stale, err := s.open(key, current[i])
+		if err != nil || stale || !bytes.Equal(data, updated[i].Data) {
+			return false
+		}
+	}
+
+	return true
 }
 
-func ProjectMeta(from, to metav1.Object) {
-	to.SetUID(from.GetUID())
-	to.SetResourceVersion(from.GetResourceVersion())
+// Count returns the number of objects stored below key.
+// Only manifest metadata is listed, so stored data is never transferred.
+func (s *ConfigMapStore) Count(key string) (int64, error) {
+	prefix := key
+	if !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+
+	below, err := prefixSelector(prefix)
+	if err != nil {
+		return 0, err
+	}
+	committed, err := labels.NewRequirement(manifestLabelKey, selection.Exists, nil)
+	if err != nil {
+		return 0, err
+	}
+
+	manifests, _, err := s.backend.ListMetadata(context.TODO(), below.Add(*committed))
+	if err != nil {
+		return 0, err
+	}
+
+	keys := map[string]struct{}{}
+	for i := range manifests {
+		if k := blobKey(&manifests[i]); strings.HasPrefix(k, prefix) && isCommitted(&manifests[i]) && !s.lapsed(&manifests[i]) {
+			keys[k] = struct{}{}
+		}
+	}
+
+	return int64(len(keys)), nil
 }
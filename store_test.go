@@ -2,20 +2,186 @@ package cmstore
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"reflect"
 	"testing"
+	"time"
 
 	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
 	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/apiserver/pkg/storage"
+	toolscache "k8s.io/client-go/tools/cache"
+	"sigs.k8s.io/controller-runtime/pkg/cache"
+	"sigs.k8s.io/controller-runtime/pkg/cache/informertest"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/apiutil"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllertest"
 )
 
+func newTestClient(t *testing.T) client.Client {
+	scheme := runtime.NewScheme()
+	if err := corev1.AddToScheme(scheme); err != nil {
+		t.Fatalf("failed to add types to fake client scheme: %s", err)
+	}
+
+	// Watches resume from resourceVersions, so they must be comparable across objects like the API server's
+	return &revisionedClient{
+		Client:    fake.NewFakeClientWithScheme(scheme),
+		revisions: map[types.NamespacedName]revision{},
+	}
+}
+
+func newTestStore(c client.Client) *ConfigMapStore {
+	return newTestStoreFor(c, func() runtime.Object {
+		return &corev1.ConfigMap{}
+	})
+}
+
+// newTestStoreFor returns a store for the objects allocated by newFunc, watching the ConfigMaps written through it.
+func newTestStoreFor(c client.Client, newFunc func() runtime.Object) *ConfigMapStore {
+	c, informers := newTestInformers(c)
+
+	return NewStore(c, informers, "storage", NewPartitioner(64), newFunc)
+}
+
+// newTestInformers returns ConfigMap and Secret informers fed by every write made through the returned client.
+func newTestInformers(c client.Client) (client.Client, cache.Informers) {
+	informing := &informingClient{
+		Client: c,
+		informers: map[schema.GroupVersionKind]*replayingInformer{
+			corev1.SchemeGroupVersion.WithKind("ConfigMap"): newReplayingInformer(c, &corev1.ConfigMapList{}),
+			corev1.SchemeGroupVersion.WithKind("Secret"):    newReplayingInformer(c, &corev1.SecretList{}),
+		},
+	}
+	informers := &informertest.FakeInformers{
+		Scheme:         c.Scheme(),
+		InformersByGVK: map[schema.GroupVersionKind]toolscache.SharedIndexInformer{},
+	}
+	for gvk, informer := range informing.informers {
+		informers.InformersByGVK[gvk] = informer
+	}
+
+	return informing, informers
+}
+
+// replayingInformer delivers existing objects to new handlers, like a real informer does.
+type replayingInformer struct {
+	*controllertest.FakeInformer
+	client client.Client
+	list   client.ObjectList
+}
+
+func newReplayingInformer(c client.Client, list client.ObjectList) *replayingInformer {
+	return &replayingInformer{
+		FakeInformer: &controllertest.FakeInformer{Synced: true},
+		client:       c,
+		list:         list,
+	}
+}
+
+func (i *replayingInformer) AddEventHandler(handler toolscache.ResourceEventHandler) {
+	i.FakeInformer.AddEventHandler(handler)
+
+	list := i.list.DeepCopyObject().(client.ObjectList)
+	if err := i.client.List(context.Background(), list); err != nil {
+		panic(fmt.Errorf("failed to list objects to replay: %s", err))
+	}
+	if err := meta.EachListItem(list, func(obj runtime.Object) error {
+		handler.OnAdd(obj)
+		return nil
+	}); err != nil {
+		panic(fmt.Errorf("failed to replay objects: %s", err))
+	}
+}
+
+// informingClient feeds every write made through it to the fake informer for its kind.
+type informingClient struct {
+	client.Client
+	informers map[schema.GroupVersionKind]*replayingInformer
+}
+
+func (c *informingClient) informer(obj client.Object) *replayingInformer {
+	gvk, err := apiutil.GVKForObject(obj, c.Scheme())
+	if err != nil {
+		panic(fmt.Errorf("failed to find kind of written object: %s", err))
+	}
+
+	return c.informers[gvk]
+}
+
+func (c *informingClient) Create(ctx context.Context, obj client.Object, opts ...client.CreateOption) error {
+	if err := c.Client.Create(ctx, obj, opts...); err != nil {
+		return err
+	}
+	c.informer(obj).Add(obj.DeepCopyObject().(client.Object))
+
+	return nil
+}
+
+func (c *informingClient) Update(ctx context.Context, obj client.Object, opts ...client.UpdateOption) error {
+	old := obj.DeepCopyObject().(client.Object)
+	if err := c.Client.Get(ctx, client.ObjectKeyFromObject(obj), old); err != nil {
+		return err
+	}
+	if err := c.Client.Update(ctx, obj, opts...); err != nil {
+		return err
+	}
+	c.informer(obj).Update(old, obj.DeepCopyObject().(client.Object))
+
+	return nil
+}
+
+func (c *informingClient) Delete(ctx context.Context, obj client.Object, opts ...client.DeleteOption) error {
+	old := obj.DeepCopyObject().(client.Object)
+	if err := c.Client.Get(ctx, client.ObjectKeyFromObject(obj), old); err != nil {
+		return err
+	}
+	if err := c.Client.Delete(ctx, obj, opts...); err != nil {
+		return err
+	}
+	// Deletions are observed at the revision the client reports them at
+	if rv := obj.GetResourceVersion(); rv != "" {
+		old.SetResourceVersion(rv)
+	}
+	c.informer(obj).Delete(old)
+
+	return nil
+}
+
+// failingClient fails every create after the first n.
+type failingClient struct {
+	client.Client
+	n int
+}
+
+func (c *failingClient) Create(ctx context.Context, obj client.Object, opts ...client.CreateOption) error {
+	if c.n < 1 {
+		return errors.New("injected failure")
+	}
+	c.n--
+
+	return c.Client.Create(ctx, obj, opts...)
+}
+
 func TestCreate(t *testing.T) {
-	store := &ConfigMapStore{}
+	store := newTestStore(newTestClient(t))
 
 	// Nested ConfigMaps, oh my!
 	nsn := &types.NamespacedName{Namespace: "default", Name: "my-config"}
 	in, out := &corev1.ConfigMap{}, &corev1.ConfigMap{}
 	in.SetNamespace(nsn.Namespace)
 	in.SetName(nsn.Name)
+	in.Data = map[string]string{"greeting": "Hello, world!"}
 
 	ctx := context.Background()
 	err := store.Create(ctx, nsn.String(), in, out, 0)
@@ -26,34 +192,651 @@ func TestCreate(t *testing.T) {
 	if out.ObjectMeta.Name != in.ObjectMeta.Name {
 		t.Errorf("pod name want=%s, get=%s", in.ObjectMeta.Name, out.ObjectMeta.Name)
 	}
+	if out.UID == "" {
+		t.Errorf("output should have non-empty uid")
+	}
 	if out.ResourceVersion == "" {
 		t.Errorf("output should have non-empty resource version")
 	}
 	if out.SelfLink != "" {
 		t.Errorf("output should have empty self link")
 	}
+
+	partitions, _, err := store.partitions(ctx, nsn.String())
+	if err != nil {
+		t.Fatalf("failed to list partitions: %v", err)
+	}
+	if len(partitions) < 2 {
+		t.Errorf("expected object to be split across several partitions, got %d", len(partitions))
+	}
+
+	// Creating the same key again should fail
+	again := &corev1.ConfigMap{}
+	again.SetName(nsn.Name)
+	err = store.Create(ctx, nsn.String(), again, nil, 0)
+	if !storage.IsNodeExist(err) {
+		t.Errorf("expecting key exists error, but get: %v", err)
+	}
+}
+
+func TestCreateRollback(t *testing.T) {
+	store := newTestStore(&failingClient{Client: newTestClient(t), n: 1})
+
+	in := &corev1.ConfigMap{}
+	in.SetName("my-config")
+	in.Data = map[string]string{"greeting": fmt.Sprintf("%64s", "Hello, world!")}
+
+	ctx := context.Background()
+	if err := store.Create(ctx, "default/my-config", in, nil, 0); err == nil {
+		t.Fatalf("expected create to fail")
+	}
+
+	partitions, _, err := store.partitions(ctx, "default/my-config")
+	if err != nil {
+		t.Fatalf("failed to list partitions: %v", err)
+	}
+	if len(partitions) > 0 {
+		t.Errorf("expected partitions to be rolled back, found %d", len(partitions))
+	}
 }
 
 func TestDelete(t *testing.T) {
+	var (
+		ctx    = context.Background()
+		store  = newTestStore(newTestClient(t))
+		key    = "default/my-config"
+		in     = &corev1.ConfigMap{}
+		stored = &corev1.ConfigMap{}
+	)
+	in.SetName("my-config")
+	in.Data = map[string]string{"greeting": fmt.Sprintf("%128s", "Hello, world!")}
+	if err := store.Create(ctx, key, in, stored, 0); err != nil {
+		t.Fatalf("Set failed: %v", err)
+	}
+
+	out := &corev1.ConfigMap{}
+	err := store.Delete(ctx, key, out, storage.NewUIDPreconditions("some-other-uid"), storage.ValidateAllObjectFunc)
+	if !storage.IsInvalidObj(err) {
+		t.Errorf("expecting invalid object error, but get: %v", err)
+	}
+
+	invalid := errors.New("invalid deletion")
+	err = store.Delete(ctx, key, out, nil, func(context.Context, runtime.Object) error {
+		return invalid
+	})
+	if err != invalid {
+		t.Errorf("expecting validation error, but get: %v", err)
+	}
+
+	err = store.Delete(ctx, key, out, storage.NewUIDPreconditions(string(stored.UID)), storage.ValidateAllObjectFunc)
+	if err != nil {
+		t.Fatalf("Delete failed: %v", err)
+	}
+	if !reflect.DeepEqual(stored, out) {
+		t.Errorf("Delete returned %#v, expected %#v", out, stored)
+	}
+
+	partitions, _, err := store.partitions(ctx, key)
+	if err != nil {
+		t.Fatalf("failed to list partitions: %v", err)
+	}
+	if len(partitions) > 0 {
+		t.Errorf("expected all partitions to be deleted, found %d", len(partitions))
+	}
+
+	err = store.Delete(ctx, key, out, nil, storage.ValidateAllObjectFunc)
+	if !storage.IsNotFound(err) {
+		t.Errorf("expecting not found error, but get: %v", err)
+	}
 }
 
 func TestWatch(t *testing.T) {
+	var (
+		ctx   = context.Background()
+		store = newTestStore(newTestClient(t))
+		key   = "default/my-config"
+		in    = &corev1.ConfigMap{}
+	)
+	in.SetName("my-config")
+	in.Data = map[string]string{"greeting": "Hello, world!"}
+	if err := store.Create(ctx, key, in, nil, 0); err != nil {
+		t.Fatalf("Set failed: %v", err)
+	}
+
+	w, err := store.Watch(ctx, key, storage.ListOptions{ResourceVersion: "0", Predicate: storage.Everything})
+	if err != nil {
+		t.Fatalf("Watch failed: %v", err)
+	}
+	defer w.Stop()
+	expectEvent(t, w, watch.Added, "Hello, world!")
+
+	// Updates that change the number of partitions are only seen once complete
+	updated := &corev1.ConfigMap{}
+	err = store.GuaranteedUpdate(ctx, key, updated, false, nil, func(input runtime.Object, _ storage.ResponseMeta) (runtime.Object, *uint64, error) {
+		cm := input.(*corev1.ConfigMap)
+		cm.Data["greeting"] = fmt.Sprintf("%256s", "Hello, world!")
+		return cm, nil, nil
+	})
+	if err != nil {
+		t.Fatalf("GuaranteedUpdate failed: %v", err)
+	}
+	expectEvent(t, w, watch.Modified, updated.Data["greeting"])
+
+	if err := store.Delete(ctx, key, &corev1.ConfigMap{}, nil, storage.ValidateAllObjectFunc); err != nil {
+		t.Fatalf("Delete failed: %v", err)
+	}
+	expectEvent(t, w, watch.Deleted, updated.Data["greeting"])
+
+	// Resuming from an up to date resourceVersion doesn't replay anything
+	if err := store.Create(ctx, key, in.DeepCopy(), in, 0); err != nil {
+		t.Fatalf("Set failed: %v", err)
+	}
+	resumed, err := store.Watch(ctx, key, storage.ListOptions{ResourceVersion: in.ResourceVersion, Predicate: storage.Everything})
+	if err != nil {
+		t.Fatalf("Watch failed: %v", err)
+	}
+	defer resumed.Stop()
+	expectNoEvent(t, resumed)
+
+	// Only the latest state is known, so resuming from before it can't replay what happened since
+	if err := store.Delete(ctx, key, &corev1.ConfigMap{}, nil, storage.ValidateAllObjectFunc); err != nil {
+		t.Fatalf("Delete failed: %v", err)
+	}
+	expectEvent(t, resumed, watch.Deleted, "Hello, world!")
+	if _, err := store.WatchList(ctx, "default", storage.ListOptions{ResourceVersion: in.ResourceVersion, Predicate: storage.Everything}); !apierrors.IsResourceExpired(err) {
+		t.Errorf("expected a watch from before the deletion to be expired, got %v", err)
+	}
+
+	// Blobs that aren't the store's own don't expire watches, nor does cleaning up after an update
+	in.ResourceVersion = ""
+	if err := store.Create(ctx, key, in.DeepCopy(), nil, 0); err != nil {
+		t.Fatalf("Set failed: %v", err)
+	}
+	err = store.GuaranteedUpdate(ctx, key, updated, false, nil, func(input runtime.Object, _ storage.ResponseMeta) (runtime.Object, *uint64, error) {
+		cm := input.(*corev1.ConfigMap)
+		cm.Data["greeting"] = "Hello again, world!"
+		return cm, nil, nil
+	})
+	if err != nil {
+		t.Fatalf("GuaranteedUpdate failed: %v", err)
+	}
+	unrelated := &Blob{}
+	unrelated.SetName("leader-election")
+	if err := store.backend.Create(ctx, unrelated); err != nil {
+		t.Fatalf("failed to create an unrelated blob: %v", err)
+	}
+	if err := wait.PollImmediate(10*time.Millisecond, wait.ForeverTestTimeout, func() (bool, error) {
+		store.watchers.mu.Lock()
+		defer store.watchers.mu.Unlock()
+		return store.watchers.version >= listVersion(unrelated.GetResourceVersion()), nil
+	}); err != nil {
+		t.Fatalf("timed out waiting for the unrelated blob to be observed: %v", err)
+	}
+	resumed, err = store.Watch(ctx, key, storage.ListOptions{ResourceVersion: updated.ResourceVersion, Predicate: storage.Everything})
+	if err != nil {
+		t.Fatalf("Watch failed: %v", err)
+	}
+	defer resumed.Stop()
+	expectNoEvent(t, resumed)
 }
 
 func TestWatchList(t *testing.T) {
+	var (
+		ctx   = context.Background()
+		store = newTestStore(newTestClient(t))
+	)
+
+	pred := storage.SelectionPredicate{
+		Label:    mustParseSelector(t, "app=greeter"),
+		Field:    fields.Everything(),
+		GetAttrs: storage.DefaultNamespaceScopedAttr,
+	}
+	w, err := store.WatchList(ctx, "default", storage.ListOptions{ResourceVersion: "0", Predicate: pred})
+	if err != nil {
+		t.Fatalf("WatchList failed: %v", err)
+	}
+	defer w.Stop()
+
+	for _, key := range []string{"other/a", "default/b", "default/c"} {
+		in := &corev1.ConfigMap{}
+		in.SetName(key)
+		in.SetLabels(map[string]string{"app": "greeter"})
+		in.Data = map[string]string{"greeting": key}
+		if err := store.Create(ctx, key, in, nil, 0); err != nil {
+			t.Fatalf("Set failed: %v", err)
+		}
+	}
+	expectEvent(t, w, watch.Added, "default/b")
+	expectEvent(t, w, watch.Added, "default/c")
+
+	// Objects that stop matching the predicate look deleted
+	err = store.GuaranteedUpdate(ctx, "default/b", &corev1.ConfigMap{}, false, nil, func(input runtime.Object, _ storage.ResponseMeta) (runtime.Object, *uint64, error) {
+		cm := input.(*corev1.ConfigMap)
+		cm.SetLabels(map[string]string{"app": "farewell"})
+		return cm, nil, nil
+	})
+	if err != nil {
+		t.Fatalf("GuaranteedUpdate failed: %v", err)
+	}
+	expectEvent(t, w, watch.Deleted, "default/b")
+	expectNoEvent(t, w)
+}
+
+func expectEvent(t *testing.T, w watch.Interface, eventType watch.EventType, greeting string) {
+	t.Helper()
+	select {
+	case event, ok := <-w.ResultChan():
+		if !ok {
+			t.Fatalf("expected %s event, watch closed", eventType)
+		}
+		if event.Type != eventType {
+			t.Errorf("expected %s event, got %s", eventType, event.Type)
+		}
+		if got := event.Object.(*corev1.ConfigMap).Data["greeting"]; got != greeting {
+			t.Errorf("expected %s event for %q, got %q", eventType, greeting, got)
+		}
+	case <-time.After(wait.ForeverTestTimeout):
+		t.Fatalf("timed out waiting for %s event", eventType)
+	}
+}
+
+func expectNoEvent(t *testing.T, w watch.Interface) {
+	t.Helper()
+	select {
+	case event := <-w.ResultChan():
+		t.Errorf("unexpected %s event: %#v", event.Type, event.Object)
+	case <-time.After(100 * time.Millisecond):
+	}
 }
 
 func TestGet(t *testing.T) {
+	var (
+		ctx    = context.Background()
+		c      = newTestClient(t)
+		store  = newTestStore(c)
+		key    = "default/my-config"
+		in     = &corev1.ConfigMap{}
+		stored = &corev1.ConfigMap{}
+	)
+	in.SetName("my-config")
+	in.Data = map[string]string{"greeting": fmt.Sprintf("%128s", "Hello, world!")}
+	if err := store.Create(ctx, key, in, stored, 0); err != nil {
+		t.Fatalf("Set failed: %v", err)
+	}
+
+	out := &corev1.ConfigMap{}
+	if err := store.Get(ctx, key, storage.GetOptions{}, out); err != nil {
+		t.Fatalf("Get failed: %v", err)
+	}
+	if !reflect.DeepEqual(stored, out) {
+		t.Errorf("Get returned %#v, expected %#v", out, stored)
+	}
+
+	// Reads can't be served from the future
+	future := fmt.Sprint(mustVersion(t, stored) + 1)
+	if err := store.Get(ctx, key, storage.GetOptions{ResourceVersion: future}, out); !storage.IsTooLargeResourceVersion(err) {
+		t.Errorf("expecting too large resource version error, but get: %v", err)
+	}
+
+	// Missing keys are only an error when not ignored
+	missing := &corev1.ConfigMap{}
+	if err := store.Get(ctx, "default/missing", storage.GetOptions{}, missing); !storage.IsNotFound(err) {
+		t.Errorf("expecting not found error, but get: %v", err)
+	}
+	missing.SetName("stale")
+	if err := store.Get(ctx, "default/missing", storage.GetOptions{IgnoreNotFound: true}, missing); err != nil {
+		t.Errorf("Get failed: %v", err)
+	}
+	if !reflect.DeepEqual(missing, &corev1.ConfigMap{}) {
+		t.Errorf("expecting zero value, but get: %#v", missing)
+	}
+
+	// A missing partition makes the whole object unreadable, but it can still be deleted
+	partitions, _, err := store.partitions(ctx, key)
+	if err != nil {
+		t.Fatalf("failed to list partitions: %v", err)
+	}
+	if err := store.backend.Delete(ctx, &partitions[len(partitions)-1]); err != nil {
+		t.Fatalf("failed to delete partition: %v", err)
+	}
+	if err := store.Get(ctx, key, storage.GetOptions{}, out); !storage.IsInternalError(err) {
+		t.Errorf("expecting internal error, but get: %v", err)
+	}
+	if err := store.Delete(ctx, key, &corev1.ConfigMap{}, &storage.Preconditions{}, storage.ValidateAllObjectFunc); err != nil {
+		t.Fatalf("Delete failed: %v", err)
+	}
+	if err := store.Get(ctx, key, storage.GetOptions{}, out); !storage.IsNotFound(err) {
+		t.Errorf("expecting not found error, but get: %v", err)
+	}
+	if left, _, err := store.partitions(ctx, key); err != nil || len(left) != 0 {
+		t.Errorf("expected the partitions left to be deleted along with the object, got %d: %v", len(left), err)
+	}
+	if err := store.Create(ctx, key, in, nil, 0); err != nil {
+		t.Errorf("expected the key to be free to write again, got %v", err)
+	}
 }
 
 func TestGetToList(t *testing.T) {
+	var (
+		ctx   = context.Background()
+		store = newTestStore(newTestClient(t))
+		key   = "default/my-config"
+		in    = &corev1.ConfigMap{}
+	)
+	in.SetName("my-config")
+	in.SetLabels(map[string]string{"app": "greeter"})
+	if err := store.Create(ctx, key, in, nil, 0); err != nil {
+		t.Fatalf("Set failed: %v", err)
+	}
+
+	for _, tt := range []struct {
+		name     string
+		key      string
+		selector string
+		expected int
+	}{
+		{name: "match", key: key, selector: "app=greeter", expected: 1},
+		{name: "filtered", key: key, selector: "app=farewell", expected: 0},
+		{name: "missing", key: "default/missing", selector: "", expected: 0},
+	} {
+		pred := storage.SelectionPredicate{
+			Label:    mustParseSelector(t, tt.selector),
+			Field:    fields.Everything(),
+			GetAttrs: storage.DefaultNamespaceScopedAttr,
+		}
+
+		list := &corev1.ConfigMapList{}
+		if err := store.GetToList(ctx, tt.key, storage.ListOptions{Predicate: pred}, list); err != nil {
+			t.Fatalf("%s: GetToList failed: %v", tt.name, err)
+		}
+		if len(list.Items) != tt.expected {
+			t.Errorf("%s: expected %d items, got %d", tt.name, tt.expected, len(list.Items))
+		}
+	}
 }
 
 func TestList(t *testing.T) {
+	var (
+		ctx   = context.Background()
+		store = newTestStore(newTestClient(t))
+	)
+	for _, key := range []string{"default/a", "default/b", "default/c", "other/d"} {
+		in := &corev1.ConfigMap{}
+		in.SetName(key)
+		in.SetLabels(map[string]string{"app": "greeter"})
+		if key == "default/b" {
+			in.SetLabels(map[string]string{"app": "farewell"})
+		}
+		if err := store.Create(ctx, key, in, nil, 0); err != nil {
+			t.Fatalf("Set failed: %v", err)
+		}
+	}
+
+	names := func(list *corev1.ConfigMapList) []string {
+		var names []string
+		for _, item := range list.Items {
+			names = append(names, item.GetName())
+		}
+		return names
+	}
+
+	// Everything under the prefix
+	list := &corev1.ConfigMapList{}
+	if err := store.List(ctx, "default", storage.ListOptions{Predicate: storage.Everything}, list); err != nil {
+		t.Fatalf("List failed: %v", err)
+	}
+	if got, expected := names(list), []string{"default/a", "default/b", "default/c"}; !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected %v, got %v", expected, got)
+	}
+
+	// Filtered by label
+	pred := storage.SelectionPredicate{
+		Label:    mustParseSelector(t, "app=greeter"),
+		Field:    fields.Everything(),
+		GetAttrs: storage.DefaultNamespaceScopedAttr,
+	}
+	list = &corev1.ConfigMapList{}
+	if err := store.List(ctx, "default/", storage.ListOptions{Predicate: pred}, list); err != nil {
+		t.Fatalf("List failed: %v", err)
+	}
+	if got, expected := names(list), []string{"default/a", "default/c"}; !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected %v, got %v", expected, got)
+	}
+
+	// Paginated
+	pred = storage.Everything
+	pred.Limit = 2
+	list = &corev1.ConfigMapList{}
+	if err := store.List(ctx, "default", storage.ListOptions{Predicate: pred}, list); err != nil {
+		t.Fatalf("List failed: %v", err)
+	}
+	if got, expected := names(list), []string{"default/a", "default/b"}; !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected %v, got %v", expected, got)
+	}
+	if list.Continue == "" {
+		t.Fatalf("expected a continue token")
+	}
+	if list.RemainingItemCount == nil || *list.RemainingItemCount != 1 {
+		t.Errorf("expected 1 remaining item, got %v", list.RemainingItemCount)
+	}
+
+	pred.Continue = list.Continue
+	list = &corev1.ConfigMapList{}
+	if err := store.List(ctx, "default", storage.ListOptions{Predicate: pred}, list); err != nil {
+		t.Fatalf("List failed: %v", err)
+	}
+	if got, expected := names(list), []string{"default/c"}; !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected %v, got %v", expected, got)
+	}
+	if list.Continue != "" {
+		t.Errorf("expected no continue token, got %q", list.Continue)
+	}
+
+	// Tokens are bound to their prefix
+	err := store.List(ctx, "other", storage.ListOptions{Predicate: pred}, list)
+	if !apierrors.IsBadRequest(err) {
+		t.Errorf("expecting bad request error, but get: %v", err)
+	}
+}
+
+func mustVersion(t *testing.T, obj runtime.Object) uint64 {
+	version, err := Versioner{}.ObjectResourceVersion(obj)
+	if err != nil {
+		t.Fatalf("failed to get object version: %v", err)
+	}
+
+	return version
+}
+
+func mustParseSelector(t *testing.T, selector string) labels.Selector {
+	parsed, err := labels.Parse(selector)
+	if err != nil {
+		t.Fatalf("failed to parse selector %q: %v", selector, err)
+	}
+
+	return parsed
 }
 
 func TestGuaranteedUpdate(t *testing.T) {
+	var (
+		ctx   = context.Background()
+		store = newTestStore(newTestClient(t))
+		key   = "default/my-config"
+	)
+
+	setGreeting := func(greeting string) storage.UpdateFunc {
+		return func(input runtime.Object, _ storage.ResponseMeta) (runtime.Object, *uint64, error) {
+			cm := input.(*corev1.ConfigMap)
+			cm.SetName("my-config")
+			cm.Data = map[string]string{"greeting": greeting}
+			return cm, nil, nil
+		}
+	}
+
+	out := &corev1.ConfigMap{}
+	err := store.GuaranteedUpdate(ctx, key, out, false, nil, setGreeting("Hello, world!"))
+	if !storage.IsNotFound(err) {
+		t.Errorf("expecting not found error, but get: %v", err)
+	}
+
+	// Ignoring not found creates the object
+	if err := store.GuaranteedUpdate(ctx, key, out, true, nil, setGreeting("Hello, world!")); err != nil {
+		t.Fatalf("GuaranteedUpdate failed: %v", err)
+	}
+
+	for _, tt := range []struct {
+		name     string
+		greeting string
+	}{
+		{name: "grow", greeting: fmt.Sprintf("%512s", "Hello, world!")},
+		{name: "shrink", greeting: "Goodbye, world!"},
+	} {
+		previous := out.DeepCopy()
+		if err := store.GuaranteedUpdate(ctx, key, out, false, nil, setGreeting(tt.greeting)); err != nil {
+			t.Fatalf("%s: GuaranteedUpdate failed: %v", tt.name, err)
+		}
+		if before, after := mustVersion(t, previous), mustVersion(t, out); after <= before {
+			t.Errorf("%s: expected resource version to increase, %d <= %d", tt.name, after, before)
+		}
+
+		got := &corev1.ConfigMap{}
+		if err := store.Get(ctx, key, storage.GetOptions{}, got); err != nil {
+			t.Fatalf("%s: Get failed: %v", tt.name, err)
+		}
+		if !reflect.DeepEqual(out, got) {
+			t.Errorf("%s: Get returned %#v, expected %#v", tt.name, got, out)
+		}
+	}
+
+	// No-op updates don't touch storage
+	previous := out.DeepCopy()
+	if err := store.GuaranteedUpdate(ctx, key, out, false, nil, setGreeting("Goodbye, world!"), previous); err != nil {
+		t.Fatalf("GuaranteedUpdate failed: %v", err)
+	}
+	if !reflect.DeepEqual(out, previous) {
+		t.Errorf("no-op update returned %#v, expected %#v", out, previous)
+	}
+
+	err = store.GuaranteedUpdate(ctx, key, out, false, storage.NewUIDPreconditions("some-other-uid"), setGreeting("Hello again!"))
+	if !storage.IsInvalidObj(err) {
+		t.Errorf("expecting invalid object error, but get: %v", err)
+	}
+
+	// Concurrent writers force a retry against the latest state
+	var attempts int
+	err = store.GuaranteedUpdate(ctx, key, out, false, nil, func(input runtime.Object, res storage.ResponseMeta) (runtime.Object, *uint64, error) {
+		attempts++
+		if attempts == 1 {
+			if err := store.GuaranteedUpdate(ctx, key, &corev1.ConfigMap{}, false, nil, setGreeting("Sneaky!")); err != nil {
+				t.Fatalf("concurrent GuaranteedUpdate failed: %v", err)
+			}
+		}
+
+		cm := input.(*corev1.ConfigMap)
+		cm.Data["greeting"] += " (again)"
+		return cm, nil, nil
+	})
+	if err != nil {
+		t.Fatalf("GuaranteedUpdate failed: %v", err)
+	}
+	if attempts != 2 {
+		t.Errorf("expected 2 attempts, got %d", attempts)
+	}
+	if greeting := out.Data["greeting"]; greeting != "Sneaky! (again)" {
+		t.Errorf("expected update to apply on top of concurrent write, got %q", greeting)
+	}
 }
 
 func TestCount(t *testing.T) {
+	var (
+		ctx   = context.Background()
+		store = newTestStore(newTestClient(t))
+	)
+	for _, key := range []string{"default/a", "default/b", "defaulted/c", "other/d"} {
+		in := &corev1.ConfigMap{}
+		in.SetName(key)
+		in.Data = map[string]string{"greeting": fmt.Sprintf("%128s", "Hello, world!")}
+		if err := store.Create(ctx, key, in, nil, 0); err != nil {
+			t.Fatalf("Set failed: %v", err)
+		}
+	}
+
+	for _, tt := range []struct {
+		key      string
+		expected int64
+	}{
+		{key: "default", expected: 2},
+		{key: "default/", expected: 2},
+		{key: "other", expected: 1},
+		{key: "missing", expected: 0},
+	} {
+		count, err := store.Count(tt.key)
+		if err != nil {
+			t.Fatalf("Count failed: %v", err)
+		}
+		if count != tt.expected {
+			t.Errorf("expected %d objects under %q, got %d", tt.expected, tt.key, count)
+		}
+	}
+}
+
+func TestSecretStore(t *testing.T) {
+	var (
+		ctx          = context.Background()
+		c, informers = newTestInformers(newTestClient(t))
+		store        = NewSecretStore(c, informers, "storage", NewPartitioner(64), func() runtime.Object { return &corev1.ConfigMap{} })
+		key          = "default/my-config"
+		in           = &corev1.ConfigMap{}
+		stored       = &corev1.ConfigMap{}
+	)
+	in.SetName("my-config")
+	in.Data = map[string]string{"greeting": fmt.Sprintf("%128s", "Hello, world!")}
+	if err := store.Create(ctx, key, in, stored, 0); err != nil {
+		t.Fatalf("Set failed: %v", err)
+	}
+
+	// Partitions are kept in Secrets alone
+	secrets := &corev1.SecretList{}
+	if err := c.List(ctx, secrets, client.InNamespace("storage")); err != nil {
+		t.Fatalf("failed to list Secrets: %v", err)
+	}
+	if len(secrets.Items) < 2 {
+		t.Errorf("expected object to be split across several Secrets, got %d", len(secrets.Items))
+	}
+	for _, secret := range secrets.Items {
+		if secret.Type != corev1.SecretTypeOpaque || len(secret.Data[streamObjKey]) < 1 {
+			t.Errorf("expected an opaque Secret holding a segment, got %#v", secret)
+		}
+	}
+	configMaps := &corev1.ConfigMapList{}
+	if err := c.List(ctx, configMaps, client.InNamespace("storage")); err != nil {
+		t.Fatalf("failed to list ConfigMaps: %v", err)
+	}
+	if len(configMaps.Items) > 0 {
+		t.Errorf("expected no ConfigMaps to be written, found %d", len(configMaps.Items))
+	}
+
+	out := &corev1.ConfigMap{}
+	if err := store.Get(ctx, key, storage.GetOptions{}, out); err != nil {
+		t.Fatalf("Get failed: %v", err)
+	}
+	if !reflect.DeepEqual(stored, out) {
+		t.Errorf("object want=%#v, get=%#v", stored, out)
+	}
+
+	w, err := store.Watch(ctx, key, storage.ListOptions{ResourceVersion: "0", Predicate: storage.Everything})
+	if err != nil {
+		t.Fatalf("Watch failed: %v", err)
+	}
+	defer w.Stop()
+	expectEvent(t, w, watch.Added, in.Data["greeting"])
+
+	if err := store.Delete(ctx, key, out, nil, storage.ValidateAllObjectFunc); err != nil {
+		t.Fatalf("Delete failed: %v", err)
+	}
+	expectEvent(t, w, watch.Deleted, in.Data["greeting"])
+
+	if count, err := store.Count("default"); err != nil || count != 0 {
+		t.Errorf("expected no objects to be counted, got %d: %v", count, err)
+	}
 }
@@ -3,10 +3,14 @@ package cmstore
 import (
 	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"io"
+	"time"
 
-	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/labels"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 )
@@ -15,6 +19,27 @@ const (
 	streamPrefix = "stream.x-k8s.io"
 	streamObjKey = streamPrefix + ".obj"
 	labelKey     = streamPrefix + "/key"
+	// manifestLabelKey marks the manifest committing the partitions of a key.
+	manifestLabelKey = streamPrefix + "/manifest"
+	// rootLabelKey marks the root blob owning the elements of a stream.
+	rootLabelKey = streamPrefix + "/root"
+	// segmentLabelKey marks a content-addressed segment shared by everything storing its data.
+	segmentLabelKey = streamPrefix + "/segment"
+
+	positionAnnotationKey    = streamPrefix + "/position"
+	countAnnotationKey       = streamPrefix + "/count"
+	generationAnnotationKey  = streamPrefix + "/generation"
+	expiresAnnotationKey     = streamPrefix + "/expires"
+	keyIDAnnotationKey       = streamPrefix + "/key-id"
+	compressionAnnotationKey = streamPrefix + "/compression"
+	// keyAnnotationKey holds the key a blob is stored for, which its key label only holds a hash of.
+	keyAnnotationKey = streamPrefix + "/storage-key"
+	// refsAnnotationKey counts the references held to a segment.
+	refsAnnotationKey = streamPrefix + "/refs"
+	// acquiredAnnotationKey records when a reference to a segment was last acquired.
+	acquiredAnnotationKey = streamPrefix + "/acquired"
+	// contentAnnotationKey names the segment holding the content of a stream element.
+	contentAnnotationKey = streamPrefix + "/content"
 )
 
 func NewStream(client client.Client, namespace, label string) *ConfigMapStream {
@@ -25,14 +50,46 @@ func NewStream(client client.Client, namespace, label string) *ConfigMapStream {
 	}
 }
 
+// NewSecretStream returns a stream kept in Secrets instead of ConfigMaps.
+func NewSecretStream(client client.Client, namespace, label string) *ConfigMapStream {
+	return NewBackendStream(NewSecretBackend(client, nil, namespace), label)
+}
+
+// NewBackendStream returns a stream kept in the blobs of the given backend.
+func NewBackendStream(backend Backend, label string) *ConfigMapStream {
+	return &ConfigMapStream{
+		label:   label,
+		backend: backend,
+	}
+}
+
 type ConfigMapStream struct {
 	Client client.Client
 
-	elements  []corev1.ConfigMap
-	current   int
-	offset    int64
-	label     string
-	namespace string
+	elements    []Blob
+	current     int
+	offset      int64
+	label       string
+	namespace   string
+	backend     Backend
+	compression Compression
+	// contentAddressable keeps written data in shared segments when set.
+	contentAddressable bool
+}
+
+// SetCompression makes the stream compress what's written to it.
+// Elements are decompressed on read regardless.
+func (s *ConfigMapStream) SetCompression(compression Compression) {
+	s.compression = compression
+}
+
+// blobs returns the backend the stream is kept in, ConfigMaps in the stream namespace unless given another.
+func (s *ConfigMapStream) blobs() Backend {
+	if s.backend != nil {
+		return s.backend
+	}
+
+	return NewConfigMapBackend(s.Client, nil, s.namespace)
 }
 
 // Write adds a ConfigMap containing p to the stream.
@@ -42,30 +99,79 @@ func (s *ConfigMapStream) Write(p []byte) (n int, err error) {
 		return 0, fmt.Errorf("no bytes to write")
 	}
 
-	cm := &corev1.ConfigMap{
-		BinaryData: map[string][]byte{
-			streamObjKey: p,
-		},
+	data, err := s.compression.compress(p)
+	if err != nil {
+		return 0, err
 	}
-	// Note: consider making these ConfigMaps content-addressable to avoid creating duplicates.
-	cm.SetGenerateName("stream-")
-	s.stamp(cm)
 
-	if err = s.Client.Create(context.TODO(), cm); err != nil {
+	root, err := s.root(context.TODO())
+	if err != nil {
+		return 0, err
+	}
+
+	element := &Blob{Data: data}
+	element.SetGenerateName("stream-")
+	element.SetOwnerReferences(ownedBy(root))
+	annotations := map[string]string{}
+	if s.compression != NoCompression {
+		annotations[compressionAnnotationKey] = string(s.compression)
+	}
+
+	var segment *Blob
+	if s.contentAddressable {
+		// The element only refers to the segment holding its content
+		if segment, err = acquireSegment(context.TODO(), s.blobs(), element, time.Now()); err != nil {
+			return 0, err
+		}
+		element.Data = nil
+		annotations[contentAnnotationKey] = segment.GetName()
+	}
+	element.SetAnnotations(annotations)
+	s.stamp(element)
+
+	if err = s.blobs().Create(context.TODO(), element); err != nil {
+		if segment != nil {
+			// TODO(njhale): log errors
+			releaseSegment(context.TODO(), s.blobs(), segment.GetName())
+		}
 		return 0, err
 	}
 
 	return len(p), nil
 }
 
+// root returns the blob owning every element of the stream, creating it if it doesn't exist yet.
+// Deleting it has the cluster garbage collector delete the whole stream.
+func (s *ConfigMapStream) root(ctx context.Context) (*Blob, error) {
+	sum := sha256.Sum256([]byte(s.label))
+	name := "stream-root-" + hex.EncodeToString(sum[:])
+
+	root, err := s.blobs().Get(ctx, name)
+	if !apierrors.IsNotFound(err) {
+		return root, err
+	}
+
+	root = &Blob{}
+	root.SetName(name)
+	root.SetLabels(map[string]string{
+		rootLabelKey: keyLabel(s.label),
+	})
+	err = s.blobs().Create(ctx, root)
+	if apierrors.IsAlreadyExists(err) {
+		// Another writer beat us to it
+		return s.blobs().Get(ctx, name)
+	}
+
+	return root, err
+}
+
 // Read fills p with up to len(p) content of the next ConfigMap in the stream.
 func (s *ConfigMapStream) Read(p []byte) (int, error) {
-	var elements []corev1.ConfigMap
+	var elements []Blob
 	elements, err := s.cache(context.TODO())
 	if err != nil {
 		return 0, err
 	}
-	fmt.Printf("|elements|: %d\n", len(elements))
 	if s.current >= len(elements) {
 		// End of stream, conform to io.Reader behavior (see https://golang.org/pkg/io/#Reader)
 		return 0, io.EOF
@@ -75,14 +181,13 @@ func (s *ConfigMapStream) Read(p []byte) (int, error) {
 	for _, element := range elements[s.current:] {
 		// FIXME(njhale): Something's wrong here
 		var (
-			data   = element.BinaryData[streamObjKey]
+			data   = element.Data
 			reader = bytes.NewReader(data)
 			m, err = reader.ReadAt(p[n:], s.offset)
 		)
 		if err != nil && err != io.EOF {
 			return n, err
 		}
-		fmt.Printf("m: %d\n", m)
 
 		s.offset += int64(m)
 		n += m
@@ -91,7 +196,6 @@ func (s *ConfigMapStream) Read(p []byte) (int, error) {
 		}
 
 		if err == io.EOF {
-			fmt.Println("EOF")
 			s.offset = 0
 			s.current++
 		}
@@ -100,22 +204,34 @@ func (s *ConfigMapStream) Read(p []byte) (int, error) {
 	return n, io.EOF
 }
 
-func (s *ConfigMapStream) cache(ctx context.Context) ([]corev1.ConfigMap, error) {
+func (s *ConfigMapStream) cache(ctx context.Context) ([]Blob, error) {
 	if len(s.elements) > 0 {
 		// FIXME(njhale): If we cache before all configmaps exists we'll never be able to get all the data.
 		return s.elements, nil
 	}
 
-	var (
-		err  error
-		list = &corev1.ConfigMapList{}
-	)
-	err = s.Client.List(ctx, list, client.InNamespace(s.namespace), client.MatchingLabelsSelector{s.labelSelector()})
+	elements, _, err := s.blobs().List(ctx, s.labelSelector())
 	if err != nil {
 		return nil, err
 	}
+	elements = forKey(s.label, elements)
+
+	for i, element := range elements {
+		if name, ok := element.GetAnnotations()[contentAnnotationKey]; ok {
+			segment, err := s.blobs().Get(ctx, name)
+			if err != nil {
+				return nil, fmt.Errorf("failed to read content of element %s: %v", element.GetName(), err)
+			}
+			element.Data = segment.Data
+		}
 
-	s.elements = list.Items
+		compression := Compression(element.GetAnnotations()[compressionAnnotationKey])
+		if elements[i].Data, err = compression.decompress(element.Data); err != nil {
+			return nil, fmt.Errorf("failed to decompress element %s: %v", element.GetName(), err)
+		}
+	}
+
+	s.elements = elements
 	if len(s.elements) < 1 {
 		return nil, fmt.Errorf("no elements of stream found")
 	}
@@ -124,19 +240,10 @@ func (s *ConfigMapStream) cache(ctx context.Context) ([]corev1.ConfigMap, error)
 }
 
 func (s *ConfigMapStream) labelSelector() labels.Selector {
-	return labels.Set{
-		labelKey: s.label,
-	}.AsSelector()
+	return keySelector(s.label)
 }
 
-// stamp applies the stream label and namespace to a resource.
-func (s *ConfigMapStream) stamp(obj Object) {
-	labels := obj.GetLabels()
-	if labels == nil {
-		labels = map[string]string{}
-	}
-
-	labels[labelKey] = s.label
-	obj.SetLabels(labels)
-	obj.SetNamespace(s.namespace)
+// stamp applies the stream label and annotation to a resource.
+func (s *ConfigMapStream) stamp(obj metav1.Object) {
+	stampKey(s.label, obj)
 }
@@ -1,8 +1,11 @@
 package cmstore
 
 import (
+	"bytes"
+	"context"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"math/rand"
 	"reflect"
 	"testing"
@@ -11,6 +14,7 @@ import (
 	"github.com/stretchr/testify/assert"
 	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/client/fake"
 )
 
@@ -90,3 +94,75 @@ func TestConfigMapStreamRoundTrip(t *testing.T) {
 		t.Error(err)
 	}
 }
+
+func TestSecretStreamRoundTrip(t *testing.T) {
+	scheme := runtime.NewScheme()
+	if err := corev1.AddToScheme(scheme); err != nil {
+		panic(fmt.Errorf("failed to add types to fake client scheme: %s", err))
+	}
+
+	var (
+		ctx    = context.Background()
+		c      = fake.NewFakeClientWithScheme(scheme)
+		stream = NewSecretStream(c, "default", "streamer")
+		in     = []byte("Hello, world!")
+	)
+	if _, err := stream.Write(in); err != nil {
+		t.Fatalf("failed to write data: %s", err)
+	}
+
+	secrets := &corev1.SecretList{}
+	if err := c.List(ctx, secrets, client.InNamespace("default"), client.MatchingLabels{labelKey: keyLabel("streamer")}); err != nil {
+		t.Fatalf("failed to list Secrets: %s", err)
+	}
+	if len(secrets.Items) != 1 || !bytes.Equal(secrets.Items[0].Data[streamObjKey], in) {
+		t.Errorf("expected a single Secret holding the written data, got %v", secrets.Items)
+	}
+
+	// Elements are owned by the root of the stream
+	root, err := stream.root(ctx)
+	if err != nil {
+		t.Fatalf("failed to get stream root: %s", err)
+	}
+	if refs := secrets.Items[0].GetOwnerReferences(); len(refs) != 1 || refs[0].Kind != "Secret" || refs[0].Name != root.GetName() {
+		t.Errorf("expected the element to be owned by Secret %s, got %v", root.GetName(), refs)
+	}
+
+	out, err := ioutil.ReadAll(stream)
+	if err != nil {
+		t.Fatalf("failed to read data: %s", err)
+	}
+	if !bytes.Equal(out, in) {
+		t.Errorf("output %q doesn't match input %q", out, in)
+	}
+}
+
+func TestCompressedStreamRoundTrip(t *testing.T) {
+	var (
+		ctx     = context.Background()
+		backend = NewMemoryBackend()
+		stream  = NewBackendStream(backend, "streamer")
+		in      = bytes.Repeat([]byte("Hello, world!"), 64)
+	)
+	stream.SetCompression(Zstd)
+	if _, err := stream.Write(in); err != nil {
+		t.Fatalf("failed to write data: %s", err)
+	}
+
+	elements, _, err := backend.List(ctx, stream.labelSelector())
+	if err != nil {
+		t.Fatalf("failed to list elements: %s", err)
+	}
+	if len(elements) != 1 || elements[0].GetAnnotations()[compressionAnnotationKey] != string(Zstd) || len(elements[0].Data) >= len(in) {
+		t.Errorf("expected a single compressed element, got %v", elements)
+	}
+
+	// Reads detect compression on their own
+	out, err := ioutil.ReadAll(NewBackendStream(backend, "streamer"))
+	if err != nil {
+		t.Fatalf("failed to read data: %s", err)
+	}
+	if !bytes.Equal(out, in) {
+		t.Errorf("output %q doesn't match input %q", out, in)
+	}
+}
@@ -0,0 +1,103 @@
+package cmstore
+
+import (
+	"context"
+	"fmt"
+
+	"k8s.io/apimachinery/pkg/runtime"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+	"k8s.io/apiserver/pkg/storage"
+)
+
+// Transformer transforms segments on their way to and from storage, e.g. to encrypt them.
+type Transformer interface {
+	// TransformToStorage returns data as it should be stored and the ID of the key it was transformed with.
+	// The context must be given back to TransformFromStorage for the data to be transformed back.
+	TransformToStorage(data, context []byte) (out []byte, keyID string, err error)
+	// TransformFromStorage returns the data that was transformed into the stored data with the given key.
+	// It's stale when the stored data should be rewritten with a newer key.
+	TransformFromStorage(data, context []byte, keyID string) (out []byte, stale bool, err error)
+}
+
+// SetTransformer makes the store transform segments with the given transformer.
+// Partitions written without one stay readable, and are transformed the next time they're written.
+// It's rejected if partitions transformed with it can't be fit to the store's budget.
+func (s *ConfigMapStore) SetTransformer(transformer Transformer) error {
+	if err := s.fits(s.budget, transformer); err != nil {
+		return err
+	}
+
+	s.transformer = transformer
+	return nil
+}
+
+// transformContext binds the stored data of a partition to where it belongs, so it can't be moved to another key,
+// position or generation without failing to transform back.
+func transformContext(key string, partition *Blob) []byte {
+	annotations := partition.GetAnnotations()
+	return []byte(fmt.Sprintf("%s#%s#%s", key, annotations[positionAnnotationKey], annotations[generationAnnotationKey]))
+}
+
+// seal transforms the data of positioned partitions into the form they're stored in.
+func (s *ConfigMapStore) seal(key string, partitions []*Blob) error {
+	if s.transformer == nil {
+		return nil
+	}
+
+	for _, p := range partitions {
+		data, keyID, err := s.transformer.TransformToStorage(p.Data, transformContext(key, p))
+		if err != nil {
+			return storage.NewInternalErrorf("failed to transform %s: %v", key, err)
+		}
+
+		p.Data = data
+		annotations := p.GetAnnotations()
+		annotations[keyIDAnnotationKey] = keyID
+		p.SetAnnotations(annotations)
+	}
+
+	return nil
+}
+
+// open returns the data a stored partition was sealed from, and whether it should be sealed again with a newer key.
+func (s *ConfigMapStore) open(key string, partition *Blob) ([]byte, bool, error) {
+	keyID, sealed := partition.GetAnnotations()[keyIDAnnotationKey]
+	switch {
+	case sealed && s.transformer == nil:
+		return nil, false, fmt.Errorf("partition %s is transformed with key %s, but there's no transformer", partition.GetName(), keyID)
+	case !sealed:
+		// Untransformed data is stale once there's a transformer
+		return partition.Data, s.transformer != nil, nil
+	}
+
+	return s.transformer.TransformFromStorage(partition.Data, transformContext(key, partition), keyID)
+}
+
+// Rewrite rewrites every object below the store's prefix whose partitions aren't transformed with the newest key.
+// Run it after adding a key to the transformer to stop depending on older keys.
+// Objects of other stores sharing the backend are left alone, since they'd lose whatever their type has that the
+// store's doesn't, so each store must rewrite its own.
+func (s *ConfigMapStore) Rewrite(ctx context.Context) error {
+	keyed, _, err := s.keyedPartitions(ctx, s.prefix)
+	if err != nil {
+		return err
+	}
+
+	var errs []error
+	for key := range keyed {
+		if !s.owns(key) {
+			// Stored below a directory whose hash collides with the prefix
+			continue
+		}
+
+		// Unchanged objects are only written when their partitions are stale
+		err := s.GuaranteedUpdate(ctx, key, s.newFunc(), false, nil, func(input runtime.Object, _ storage.ResponseMeta) (runtime.Object, *uint64, error) {
+			return input, nil, nil
+		})
+		if err != nil && !storage.IsNotFound(err) {
+			errs = append(errs, err)
+		}
+	}
+
+	return utilerrors.NewAggregate(errs)
+}
@@ -0,0 +1,174 @@
+package cmstore
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/apiserver/pkg/storage"
+)
+
+func TestTransform(t *testing.T) {
+	var (
+		ctx     = context.Background()
+		backend = NewMemoryBackend()
+		store   = NewBackendStore(backend, NewPartitioner(64), func() runtime.Object { return &corev1.ConfigMap{} })
+		key     = "default/my-config"
+		in      = &corev1.ConfigMap{}
+		stored  = &corev1.ConfigMap{}
+		key1    = Key{Name: "key1", Secret: []byte("abcdefghijklmnop")}
+		key2    = Key{Name: "key2", Secret: []byte("12345678901234567890123456789012")}
+	)
+	keyIDs := func() []string {
+		partitions, _, err := store.partitions(ctx, key)
+		if err != nil {
+			t.Fatalf("failed to list partitions: %v", err)
+		}
+
+		var ids []string
+		for _, p := range partitions {
+			if bytes.Contains(p.Data, []byte("Hello")) {
+				t.Errorf("expected partition %s not to hold plain data", p.GetName())
+			}
+			ids = append(ids, p.GetAnnotations()[keyIDAnnotationKey])
+		}
+
+		return ids
+	}
+	get := func() *corev1.ConfigMap {
+		out := &corev1.ConfigMap{}
+		if err := store.Get(ctx, key, storage.GetOptions{}, out); err != nil {
+			t.Fatalf("Get failed: %v", err)
+		}
+		if out.Data["greeting"] != in.Data["greeting"] {
+			t.Errorf("expected greeting %q, got %q", in.Data["greeting"], out.Data["greeting"])
+		}
+
+		return out
+	}
+
+	// Objects written before there's a transformer are picked up by a rewrite
+	in.SetName("my-config")
+	in.Data = map[string]string{"greeting": fmt.Sprintf("%128s", "Hello, world!")}
+	if err := store.Create(ctx, key, in, stored, 0); err != nil {
+		t.Fatalf("Set failed: %v", err)
+	}
+
+	keyring, err := NewKeyring(key1)
+	if err != nil {
+		t.Fatalf("NewKeyring failed: %v", err)
+	}
+	if err := store.SetTransformer(keyring); err != nil {
+		t.Fatalf("SetTransformer failed: %v", err)
+	}
+	get()
+
+	if err := store.Rewrite(ctx); err != nil {
+		t.Fatalf("Rewrite failed: %v", err)
+	}
+	for _, id := range keyIDs() {
+		if id != "key1" {
+			t.Errorf("expected every partition to be encrypted with key1, got %s", id)
+		}
+	}
+	rewritten := get()
+	if rewritten.ResourceVersion == stored.ResourceVersion {
+		t.Errorf("expected the rewrite to change the resource version")
+	}
+
+	w, err := store.Watch(ctx, key, storage.ListOptions{ResourceVersion: "0", Predicate: storage.Everything})
+	if err != nil {
+		t.Fatalf("Watch failed: %v", err)
+	}
+	defer w.Stop()
+	expectEvent(t, w, watch.Added, in.Data["greeting"])
+
+	// Fresh objects aren't rewritten
+	if err := store.Rewrite(ctx); err != nil {
+		t.Fatalf("Rewrite failed: %v", err)
+	}
+	if get().ResourceVersion != rewritten.ResourceVersion {
+		t.Errorf("expected an up to date object not to be rewritten")
+	}
+	expectNoEvent(t, w)
+
+	// Rotating keys leaves existing objects readable until they're rewritten with the newest key
+	if keyring, err = NewKeyring(key2, key1); err != nil {
+		t.Fatalf("NewKeyring failed: %v", err)
+	}
+	if err := store.SetTransformer(keyring); err != nil {
+		t.Fatalf("SetTransformer failed: %v", err)
+	}
+	get()
+
+	if err := store.Rewrite(ctx); err != nil {
+		t.Fatalf("Rewrite failed: %v", err)
+	}
+	for _, id := range keyIDs() {
+		if id != "key2" {
+			t.Errorf("expected every partition to be encrypted with key2, got %s", id)
+		}
+	}
+	expectEvent(t, w, watch.Modified, in.Data["greeting"])
+
+	// The old key can go once nothing depends on it
+	if keyring, err = NewKeyring(key2); err != nil {
+		t.Fatalf("NewKeyring failed: %v", err)
+	}
+	if err := store.SetTransformer(keyring); err != nil {
+		t.Fatalf("SetTransformer failed: %v", err)
+	}
+	get()
+
+	// Without the transformer, encrypted objects can't be read
+	if err := store.SetTransformer(nil); err != nil {
+		t.Fatalf("SetTransformer failed: %v", err)
+	}
+	if err := store.Get(ctx, key, storage.GetOptions{}, &corev1.ConfigMap{}); !storage.IsInternalError(err) {
+		t.Errorf("expecting internal error, but get: %v", err)
+	}
+}
+
+func TestRewritePrefix(t *testing.T) {
+	var (
+		ctx        = context.Background()
+		backend    = NewMemoryBackend()
+		configMaps = NewBackendStore(backend, NewPartitioner(64), func() runtime.Object { return &corev1.ConfigMap{} })
+		namespaces = NewBackendStore(backend, NewPartitioner(64), func() runtime.Object { return &corev1.Namespace{} })
+		key        = "/configmaps/default/a"
+		in         = &corev1.ConfigMap{}
+		stored     = &corev1.ConfigMap{}
+	)
+	configMaps.SetPrefix("/configmaps")
+	namespaces.SetPrefix("/namespaces")
+
+	in.SetName("a")
+	in.Data = map[string]string{"greeting": "Hello, world!"}
+	if err := configMaps.Create(ctx, key, in, stored, 0); err != nil {
+		t.Fatalf("Set failed: %v", err)
+	}
+
+	// Another store's objects would lose the fields its type doesn't have, so they're never rewritten
+	keyring, err := NewKeyring(Key{Name: "key1", Secret: []byte("abcdefghijklmnop")})
+	if err != nil {
+		t.Fatalf("NewKeyring failed: %v", err)
+	}
+	if err := namespaces.SetTransformer(keyring); err != nil {
+		t.Fatalf("SetTransformer failed: %v", err)
+	}
+	if err := namespaces.Rewrite(ctx); err != nil {
+		t.Fatalf("Rewrite failed: %v", err)
+	}
+
+	out := &corev1.ConfigMap{}
+	if err := configMaps.Get(ctx, key, storage.GetOptions{}, out); err != nil {
+		t.Fatalf("Get failed: %v", err)
+	}
+	if out.Data["greeting"] != "Hello, world!" || out.GetResourceVersion() != stored.GetResourceVersion() {
+		t.Errorf("expected another store's object to be left alone, got %v at %s", out.Data, out.GetResourceVersion())
+	}
+}
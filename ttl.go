@@ -0,0 +1,136 @@
+package cmstore
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/selection"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+// defaultReapPeriod is how often expired objects are reaped.
+const defaultReapPeriod = 30 * time.Second
+
+// expiry returns when an object written now with the given ttl, in seconds, expires.
+// A zero ttl never expires.
+func (s *ConfigMapStore) expiry(ttl uint64) time.Time {
+	if ttl == 0 {
+		return time.Time{}
+	}
+
+	return s.clock.Now().Add(time.Duration(ttl) * time.Second)
+}
+
+// expired returns true if the object committed by a manifest has expired.
+func (s *ConfigMapStore) expired(committed *Blob) bool {
+	return committed != nil && s.lapsed(committed)
+}
+
+// lapsed returns true if the object a manifest or partition belongs to has expired.
+func (s *ConfigMapStore) lapsed(partitionMeta metav1.Object) bool {
+	expires := partitionExpiry(partitionMeta)
+
+	return !expires.IsZero() && !s.clock.Now().Before(expires)
+}
+
+// remainingTTL returns the number of seconds left before the object committed by a manifest expires, or zero if it
+// never does.
+func (s *ConfigMapStore) remainingTTL(committed *Blob) int64 {
+	if committed == nil {
+		return 0
+	}
+
+	expires := partitionExpiry(committed)
+	if expires.IsZero() {
+		return 0
+	}
+
+	return int64(expires.Sub(s.clock.Now()).Seconds())
+}
+
+// setExpiry annotates a partition with when the object it belongs to expires.
+func setExpiry(partition metav1.Object, expires time.Time) {
+	annotations := partition.GetAnnotations()
+	if expires.IsZero() {
+		delete(annotations, expiresAnnotationKey)
+		partition.SetAnnotations(annotations)
+		return
+	}
+
+	if annotations == nil {
+		annotations = map[string]string{}
+	}
+
+	annotations[expiresAnnotationKey] = expires.UTC().Format(time.RFC3339)
+	partition.SetAnnotations(annotations)
+}
+
+// partitionExpiry returns when the object a partition belongs to expires, or the zero time if it never does.
+func partitionExpiry(partitionMeta metav1.Object) time.Time {
+	expires, err := time.Parse(time.RFC3339, partitionMeta.GetAnnotations()[expiresAnnotationKey])
+	if err != nil {
+		return time.Time{}
+	}
+
+	return expires
+}
+
+// Start reaps expired objects, and collects garbage when enabled, until the context is done.
+func (s *ConfigMapStore) Start(ctx context.Context) error {
+	wait.UntilWithContext(ctx, func(ctx context.Context) {
+		if err := s.reap(ctx); err != nil {
+			utilruntime.HandleError(fmt.Errorf("failed to reap expired objects: %v", err))
+		}
+		s.collect(ctx)
+	}, s.reapPeriod)
+
+	return nil
+}
+
+// reap deletes every expired object below the store's prefix.
+// Manifests tell when objects expire, so only their metadata is listed, and only expired objects are read in full.
+// Deletions are conditional on the manifest read, so objects given a new lease in the meantime survive.
+func (s *ConfigMapStore) reap(ctx context.Context) error {
+	below, err := prefixSelector(s.prefix)
+	if err != nil {
+		return err
+	}
+	committed, err := labels.NewRequirement(manifestLabelKey, selection.Exists, nil)
+	if err != nil {
+		return err
+	}
+
+	manifests, _, err := s.backend.ListMetadata(ctx, below.Add(*committed))
+	if err != nil {
+		return err
+	}
+
+	var errs []error
+	for i := range manifests {
+		key := blobKey(&manifests[i])
+		if !s.owns(key) || !isCommitted(&manifests[i]) || !s.expired(&manifests[i]) {
+			continue
+		}
+
+		blobs, _, err := s.blobs(ctx, key)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		committed, sorted, err := s.committed(key, blobs)
+		if err != nil || !s.expired(committed) {
+			continue
+		}
+
+		if _, err := s.remove(ctx, committed, sorted); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	return utilerrors.NewAggregate(errs)
+}
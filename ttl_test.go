@@ -0,0 +1,202 @@
+package cmstore
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/clock"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/apiserver/pkg/storage"
+)
+
+func TestTTL(t *testing.T) {
+	var (
+		ctx   = context.Background()
+		store = newTestStore(newTestClient(t))
+		fake  = clock.NewFakeClock(time.Now())
+		key   = "default/my-config"
+		in    = &corev1.ConfigMap{}
+	)
+	store.clock = fake
+
+	in.SetName("my-config")
+	in.Data = map[string]string{"greeting": "Hello, world!"}
+	if err := store.Create(ctx, key, in, nil, 10); err != nil {
+		t.Fatalf("Set failed: %v", err)
+	}
+	if err := store.Create(ctx, "default/forever", in.DeepCopy(), nil, 0); err != nil {
+		t.Fatalf("Set failed: %v", err)
+	}
+
+	// Updates keep the current ttl unless given a new one
+	var remaining int64
+	err := store.GuaranteedUpdate(ctx, key, &corev1.ConfigMap{}, false, nil, func(input runtime.Object, res storage.ResponseMeta) (runtime.Object, *uint64, error) {
+		remaining = res.TTL
+		cm := input.(*corev1.ConfigMap)
+		cm.Data["greeting"] = "Hello again!"
+		return cm, nil, nil
+	})
+	if err != nil {
+		t.Fatalf("GuaranteedUpdate failed: %v", err)
+	}
+	if remaining < 9 || remaining > 10 {
+		t.Errorf("expected about 10 seconds left, got %d", remaining)
+	}
+
+	w, err := store.Watch(ctx, key, storage.ListOptions{ResourceVersion: "0", Predicate: storage.Everything})
+	if err != nil {
+		t.Fatalf("Watch failed: %v", err)
+	}
+	defer w.Stop()
+	expectEvent(t, w, watch.Added, "Hello again!")
+
+	fake.Step(11 * time.Second)
+
+	// Expired objects disappear from reads right away
+	if err := store.Get(ctx, key, storage.GetOptions{}, &corev1.ConfigMap{}); !storage.IsNotFound(err) {
+		t.Errorf("expecting not found error, but get: %v", err)
+	}
+	list := &corev1.ConfigMapList{}
+	if err := store.List(ctx, "default", storage.ListOptions{Predicate: storage.Everything}, list); err != nil {
+		t.Fatalf("List failed: %v", err)
+	}
+	if len(list.Items) != 1 || list.Items[0].GetName() != "my-config" || list.Items[0].Data["greeting"] != "Hello, world!" {
+		t.Errorf("expected only the object without a ttl to be listed, got %v", list.Items)
+	}
+	if count, err := store.Count("default"); err != nil || count != 1 {
+		t.Errorf("expected 1 object to be counted, got %d: %v", count, err)
+	}
+
+	// The reaper deletes them for good
+	if err := store.reap(ctx); err != nil {
+		t.Fatalf("reap failed: %v", err)
+	}
+	expectEvent(t, w, watch.Deleted, "Hello again!")
+
+	partitions, _, err := store.partitions(ctx, key)
+	if err != nil {
+		t.Fatalf("failed to list partitions: %v", err)
+	}
+	if len(partitions) > 0 {
+		t.Errorf("expected expired partitions to be reaped, found %d", len(partitions))
+	}
+	if err := store.Get(ctx, "default/forever", storage.GetOptions{}, &corev1.ConfigMap{}); err != nil {
+		t.Errorf("Get failed: %v", err)
+	}
+}
+
+func TestTTLOverwrite(t *testing.T) {
+	var (
+		ctx   = context.Background()
+		store = newTestStore(newTestClient(t))
+		fake  = clock.NewFakeClock(time.Now())
+		key   = "default/my-config"
+		in    = &corev1.ConfigMap{}
+	)
+	store.clock = fake
+
+	in.SetName("my-config")
+	if err := store.Create(ctx, key, in, nil, 10); err != nil {
+		t.Fatalf("Set failed: %v", err)
+	}
+	fake.Step(11 * time.Second)
+
+	setGreeting := func(input runtime.Object, _ storage.ResponseMeta) (runtime.Object, *uint64, error) {
+		cm := input.(*corev1.ConfigMap)
+		cm.SetName("my-config")
+		cm.Data = map[string]string{"greeting": "Hello, world!"}
+		return cm, nil, nil
+	}
+	if err := store.GuaranteedUpdate(ctx, key, &corev1.ConfigMap{}, false, nil, setGreeting); !storage.IsNotFound(err) {
+		t.Errorf("expecting not found error, but get: %v", err)
+	}
+
+	// Expired objects are replaced, without inheriting the lapsed ttl
+	out := &corev1.ConfigMap{}
+	if err := store.GuaranteedUpdate(ctx, key, out, true, nil, setGreeting); err != nil {
+		t.Fatalf("GuaranteedUpdate failed: %v", err)
+	}
+	if greeting := out.Data["greeting"]; greeting != "Hello, world!" {
+		t.Errorf("expected object to be replaced, got %q", greeting)
+	}
+
+	fake.Step(time.Hour)
+	if err := store.Get(ctx, key, storage.GetOptions{}, &corev1.ConfigMap{}); err != nil {
+		t.Errorf("Get failed: %v", err)
+	}
+
+	// So are they when created again
+	if err := store.GuaranteedUpdate(ctx, key, &corev1.ConfigMap{}, false, nil, func(input runtime.Object, _ storage.ResponseMeta) (runtime.Object, *uint64, error) {
+		ttl := uint64(10)
+		return input, &ttl, nil
+	}); err != nil {
+		t.Fatalf("GuaranteedUpdate failed: %v", err)
+	}
+	fake.Step(11 * time.Second)
+	if err := store.Get(ctx, key, storage.GetOptions{}, &corev1.ConfigMap{}); !storage.IsNotFound(err) {
+		t.Errorf("expecting not found error, but get: %v", err)
+	}
+	in = &corev1.ConfigMap{}
+	in.SetName("my-config")
+	in.Data = map[string]string{"greeting": "Hello again!"}
+	if err := store.Create(ctx, key, in, nil, 0); err != nil {
+		t.Fatalf("Set failed: %v", err)
+	}
+	fake.Step(time.Hour)
+	_, committed, _, err := store.read(ctx, key, out)
+	if err != nil || out.Data["greeting"] != "Hello again!" {
+		t.Errorf("expected the expired object to be created over, got %q: %v", out.Data["greeting"], err)
+	}
+	partitions, _, err := store.partitions(ctx, key)
+	if err != nil {
+		t.Fatalf("failed to list partitions: %v", err)
+	}
+	if len(partitions) != len(committed) {
+		t.Errorf("expected the expired partitions to be discarded, found %d partitions for %d committed", len(partitions), len(committed))
+	}
+}
+
+func TestReapMetadata(t *testing.T) {
+	var (
+		ctx     = context.Background()
+		backend = &selectingBackend{Backend: NewMemoryBackend()}
+		store   = NewBackendStore(backend, NewPartitioner(64), func() runtime.Object { return &corev1.ConfigMap{} })
+		fake    = clock.NewFakeClock(time.Now())
+	)
+	store.clock = fake
+	for name, ttl := range map[string]uint64{"expiring": 10, "forever": 0} {
+		in := &corev1.ConfigMap{}
+		in.SetName(name)
+		in.Data = map[string]string{"greeting": fmt.Sprintf("%128s", "Hello, world!")}
+		if err := store.Create(ctx, "default/"+name, in, nil, ttl); err != nil {
+			t.Fatalf("Set failed: %v", err)
+		}
+	}
+	fake.Step(11 * time.Second)
+
+	// Only the data of expired objects is read
+	backend.listed = nil
+	if err := store.reap(ctx); err != nil {
+		t.Fatalf("reap failed: %v", err)
+	}
+	for _, blob := range backend.listed {
+		if key := blobKey(&blob); blob.Data != nil && key != "default/expiring" {
+			t.Errorf("expected only expired objects to be read, read %s of %q", blob.GetName(), key)
+		}
+	}
+
+	if err := store.Get(ctx, "default/forever", storage.GetOptions{}, &corev1.ConfigMap{}); err != nil {
+		t.Errorf("Get failed: %v", err)
+	}
+	partitions, _, err := store.partitions(ctx, "default/expiring")
+	if err != nil {
+		t.Fatalf("failed to list partitions: %v", err)
+	}
+	if len(partitions) > 0 {
+		t.Errorf("expected expired partitions to be reaped, found %d", len(partitions))
+	}
+}
@@ -0,0 +1,125 @@
+package cmstore
+
+import (
+	"fmt"
+	"strconv"
+
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	"k8s.io/apiserver/pkg/storage"
+)
+
+// Versioner implements storage.Versioner for objects kept by a ConfigMapStore.
+//
+// An object's version is the newest resourceVersion among its manifest and the partitions it commits. Every write
+// swaps the manifest after creating new partitions, so its version strictly increases with each write and is
+// comparable with the versions of other objects in the storage namespace.
+type Versioner struct{}
+
+var _ storage.Versioner = Versioner{}
+
+// UpdateObject implements storage.Versioner.
+func (Versioner) UpdateObject(obj runtime.Object, resourceVersion uint64) error {
+	accessor, err := meta.Accessor(obj)
+	if err != nil {
+		return err
+	}
+
+	accessor.SetResourceVersion(formatResourceVersion(resourceVersion))
+
+	return nil
+}
+
+// UpdateList implements storage.Versioner.
+func (Versioner) UpdateList(obj runtime.Object, resourceVersion uint64, nextKey string, count *int64) error {
+	listAccessor, err := meta.ListAccessor(obj)
+	if err != nil || listAccessor == nil {
+		return err
+	}
+
+	listAccessor.SetResourceVersion(formatResourceVersion(resourceVersion))
+	listAccessor.SetContinue(nextKey)
+	listAccessor.SetRemainingItemCount(count)
+
+	return nil
+}
+
+// PrepareObjectForStorage implements storage.Versioner.
+func (Versioner) PrepareObjectForStorage(obj runtime.Object) error {
+	accessor, err := meta.Accessor(obj)
+	if err != nil {
+		return err
+	}
+
+	accessor.SetResourceVersion("")
+	accessor.SetSelfLink("")
+
+	return nil
+}
+
+// ObjectResourceVersion implements storage.Versioner.
+func (Versioner) ObjectResourceVersion(obj runtime.Object) (uint64, error) {
+	accessor, err := meta.Accessor(obj)
+	if err != nil {
+		return 0, err
+	}
+
+	version := accessor.GetResourceVersion()
+	if len(version) == 0 {
+		return 0, nil
+	}
+
+	return strconv.ParseUint(version, 10, 64)
+}
+
+// ParseResourceVersion implements storage.Versioner.
+func (Versioner) ParseResourceVersion(resourceVersion string) (uint64, error) {
+	if resourceVersion == "" || resourceVersion == "0" {
+		return 0, nil
+	}
+
+	version, err := strconv.ParseUint(resourceVersion, 10, 64)
+	if err != nil {
+		return 0, storage.NewInvalidError(field.ErrorList{
+			field.Invalid(field.NewPath("resourceVersion"), resourceVersion, err.Error()),
+		})
+	}
+
+	return version, nil
+}
+
+func formatResourceVersion(resourceVersion uint64) string {
+	if resourceVersion == 0 {
+		return ""
+	}
+
+	return strconv.FormatUint(resourceVersion, 10)
+}
+
+// partitionsVersion returns the version of the object stored in a set of partitions.
+func partitionsVersion(partitions []*Blob) (uint64, error) {
+	var version uint64
+	for _, p := range partitions {
+		v, err := strconv.ParseUint(p.GetResourceVersion(), 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("partition %s has an unorderable resourceVersion %q: %v", p.GetName(), p.GetResourceVersion(), err)
+		}
+
+		if v > version {
+			version = v
+		}
+	}
+
+	return version, nil
+}
+
+// listVersion returns the version a list of partitions was served at, or zero if it wasn't given one.
+func listVersion(resourceVersion string) uint64 {
+	version, err := strconv.ParseUint(resourceVersion, 10, 64)
+	if err != nil {
+		return 0
+	}
+
+	return version
+}
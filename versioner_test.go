@@ -0,0 +1,76 @@
+package cmstore
+
+import (
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apiserver/pkg/storage"
+)
+
+func TestVersionerRoundTrip(t *testing.T) {
+	var (
+		versioner = Versioner{}
+		obj       = &corev1.ConfigMap{}
+		list      = &corev1.ConfigMapList{}
+	)
+
+	for _, version := range []uint64{1, 42, 1<<64 - 1} {
+		if err := versioner.UpdateObject(obj, version); err != nil {
+			t.Fatalf("UpdateObject failed: %v", err)
+		}
+		got, err := versioner.ObjectResourceVersion(obj)
+		if err != nil {
+			t.Fatalf("ObjectResourceVersion failed: %v", err)
+		}
+		if got != version {
+			t.Errorf("expected version %d, got %d", version, got)
+		}
+
+		parsed, err := versioner.ParseResourceVersion(obj.GetResourceVersion())
+		if err != nil {
+			t.Fatalf("ParseResourceVersion failed: %v", err)
+		}
+		if parsed != version {
+			t.Errorf("expected parsed version %d, got %d", version, parsed)
+		}
+
+		if err := versioner.UpdateList(list, version, "next", nil); err != nil {
+			t.Fatalf("UpdateList failed: %v", err)
+		}
+		if parsed, err = versioner.ParseResourceVersion(list.GetResourceVersion()); err != nil || parsed != version {
+			t.Errorf("expected list version %d, got %d: %v", version, parsed, err)
+		}
+	}
+
+	if err := versioner.PrepareObjectForStorage(obj); err != nil {
+		t.Fatalf("PrepareObjectForStorage failed: %v", err)
+	}
+	if obj.GetResourceVersion() != "" {
+		t.Errorf("expected resource version to be cleared, got %q", obj.GetResourceVersion())
+	}
+
+	if _, err := versioner.ParseResourceVersion("a1b2c3"); !storage.IsInvalidError(err) {
+		t.Errorf("expecting invalid error, but get: %v", err)
+	}
+}
+
+func TestPartitionsVersion(t *testing.T) {
+	partitions := make([]*Blob, 3)
+	for i, rv := range []string{"7", "12", "9"} {
+		partitions[i] = &Blob{}
+		partitions[i].SetResourceVersion(rv)
+	}
+
+	version, err := partitionsVersion(partitions)
+	if err != nil {
+		t.Fatalf("partitionsVersion failed: %v", err)
+	}
+	if version != 12 {
+		t.Errorf("expected the newest partition version 12, got %d", version)
+	}
+
+	partitions[1].SetResourceVersion("opaque")
+	if _, err := partitionsVersion(partitions); err == nil {
+		t.Errorf("expected an error for an unorderable resource version")
+	}
+}
@@ -0,0 +1,482 @@
+package cmstore
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/apiserver/pkg/storage"
+	toolscache "k8s.io/client-go/tools/cache"
+)
+
+const (
+	// incomingBufSize is the number of changes buffered for a watcher before it's considered too slow and stopped.
+	incomingBufSize = 100
+	// outgoingBufSize is the number of events buffered for the consumer of a watcher.
+	outgoingBufSize = 100
+)
+
+// change describes the transition of the object stored at a key.
+// A nil prev means the object was added, a nil cur means it was deleted.
+type change struct {
+	key       string
+	prev, cur runtime.Object
+	// committed is the manifest committing cur.
+	committed *Blob
+	// version is the version the change was observed at.
+	version uint64
+	// err is why the object committed at key can't be read, when it can't. Neither prev nor cur are set.
+	err error
+}
+
+// subscriber is told about every change a broadcaster makes, and about the version it has observed up to, while the
+// broadcaster's lock is held. Objects that can't be read aren't changes to it, so it keeps what it knew of them.
+type subscriber interface {
+	changed(c change)
+	observed(version uint64)
+}
+
+// broadcaster assembles partition events from the backend into changes to whole objects and fans them out to
+// watchers.
+// Unlike lists, watches aren't selected on the prefix labels of their key: every watch shares a single watch of the
+// whole backend, and changes are filtered by key here. Segments aren't labelled with the keys referring to them, so a
+// watch selecting a prefix would never see them anyway, and one backend watch per watcher would cost the cluster far
+// more than the events it saves.
+type broadcaster struct {
+	store *ConfigMapStore
+
+	startMu sync.Mutex
+	synced  toolscache.InformerSynced
+
+	mu       sync.Mutex
+	objects  map[string]*object
+	segments map[string]Blob
+	// watchers are sent the changes observed after the version they started from.
+	watchers map[*watcher]uint64
+	// version is the latest version of the blobs observed.
+	version uint64
+	// changed is the version of the latest change broadcast. Watches can resume from it, since nothing's been missed,
+	// however many blobs that aren't the store's own have been observed after it.
+	changed     uint64
+	subscribers []subscriber
+}
+
+// object tracks the manifest and partitions observed for a key and the last committed object they were joined into.
+type object struct {
+	partitions map[string]Blob
+	version    uint64
+	obj        runtime.Object
+	committed  *Blob
+	// waiting is set while some of what the manifest commits hasn't been observed yet.
+	waiting bool
+}
+
+func newBroadcaster(store *ConfigMapStore) *broadcaster {
+	return &broadcaster{
+		store:    store,
+		objects:  map[string]*object{},
+		segments: map[string]Blob{},
+		watchers: map[*watcher]uint64{},
+	}
+}
+
+// start starts watching the backend, if it isn't already, and waits for the partitions that exist to be observed.
+func (b *broadcaster) start(ctx context.Context) error {
+	b.startMu.Lock()
+	defer b.startMu.Unlock()
+
+	if b.synced == nil {
+		synced, err := b.store.backend.Watch(ctx, b.observe)
+		if err != nil {
+			return err
+		}
+		b.synced = synced
+	}
+
+	if !toolscache.WaitForCacheSync(ctx.Done(), b.synced) {
+		return storage.NewInternalError("timed out waiting for partitions to sync")
+	}
+
+	return nil
+}
+
+// observe records a manifest, partition or segment event, broadcasting a change once every partition a manifest commits
+// is present.
+func (b *broadcaster) observe(partition *Blob, deleted bool) {
+	if isSegment(partition) {
+		b.observeSegment(partition, deleted)
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.advance(partition)
+	defer b.progress()
+
+	if _, ok := partition.GetLabels()[labelKey]; !ok {
+		return
+	}
+	key := blobKey(partition)
+	if !b.store.owns(key) {
+		// Another store's object, which may not even decode into ours
+		return
+	}
+
+	o, ok := b.objects[key]
+	if !ok {
+		o = &object{partitions: map[string]Blob{}}
+		b.objects[key] = o
+	}
+
+	if deleted {
+		delete(o.partitions, partition.GetName())
+	} else {
+		o.partitions[partition.GetName()] = *partition
+	}
+
+	partitions := make([]Blob, 0, len(o.partitions))
+	for _, p := range o.partitions {
+		partitions = append(partitions, p)
+	}
+	if len(partitions) < 1 {
+		delete(b.objects, key)
+	}
+
+	b.update(key, o, partitions)
+}
+
+// observeSegment records a segment event, joining the objects that were waiting for it.
+func (b *broadcaster) observeSegment(segment *Blob, deleted bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.advance(segment)
+	defer b.progress()
+
+	if deleted {
+		delete(b.segments, segment.GetName())
+		return
+	}
+
+	_, known := b.segments[segment.GetName()]
+	b.segments[segment.GetName()] = *segment
+	if known {
+		// Only its references changed
+		return
+	}
+
+	for key, o := range b.objects {
+		if !o.waiting {
+			continue
+		}
+
+		partitions := make([]Blob, 0, len(o.partitions))
+		for _, p := range o.partitions {
+			partitions = append(partitions, p)
+		}
+		b.update(key, o, partitions)
+	}
+}
+
+// advance records the version of an observed blob, before any change it makes is broadcast at that version.
+// Callers must hold the lock.
+func (b *broadcaster) advance(blob *Blob) {
+	if version := listVersion(blob.GetResourceVersion()); version > b.version {
+		b.version = version
+	}
+}
+
+// progress tells subscribers about the version observed, once any change made by the blob observed at it has been
+// broadcast.
+// Callers must hold the lock.
+func (b *broadcaster) progress() {
+	for _, s := range b.subscribers {
+		s.observed(b.version)
+	}
+}
+
+// subscribe starts telling s about every change, first presenting the objects observed so far as additions.
+func (b *broadcaster) subscribe(s subscriber) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for k, o := range b.objects {
+		if o.obj != nil {
+			s.changed(change{key: k, cur: o.obj, committed: o.committed, version: o.version})
+		}
+	}
+	s.observed(b.version)
+	b.subscribers = append(b.subscribers, s)
+}
+
+// update joins the object committed among the partitions observed for key, broadcasting a change if it's new.
+// Callers must hold the lock.
+func (b *broadcaster) update(key string, o *object, partitions []Blob) {
+	o.waiting = false
+	if findManifest(partitions) == nil {
+		// Nothing's committed, either not yet or no longer
+		if o.obj != nil {
+			// The deletion is the blob just observed
+			b.broadcast(change{key: key, prev: o.obj, version: b.version})
+			o.obj, o.committed, o.version = nil, nil, 0
+		}
+		return
+	}
+
+	for _, name := range missingSegments(partitions) {
+		if segment, ok := b.segments[name]; ok {
+			partitions = append(partitions, segment)
+		}
+	}
+
+	if len(missingPartitions(partitions)) > 0 {
+		// The committed partitions haven't all been observed yet, wait for the rest of them
+		o.waiting = true
+		return
+	}
+
+	joined := b.store.newFunc()
+	committed, _, err := b.store.join(key, partitions, joined)
+	if storage.IsNotFound(err) {
+		o.waiting = true
+		return
+	}
+	if err != nil {
+		// Nothing more will be observed to fix it, so watchers are told, like etcd3 tells them about what it can't
+		// decode
+		b.broadcast(change{key: key, version: b.version, err: err})
+		return
+	}
+
+	version, err := b.store.versioner.ObjectResourceVersion(joined)
+	if err != nil || version == o.version {
+		return
+	}
+
+	prev := o.obj
+	o.obj, o.committed, o.version = joined, committed, version
+	b.broadcast(change{key: key, prev: prev, cur: joined, committed: committed, version: version})
+}
+
+// broadcast sends a change to every subscriber and interested watcher, stopping any watcher that can't keep up.
+// Callers must hold the lock.
+func (b *broadcaster) broadcast(c change) {
+	if c.version > b.changed {
+		b.changed = c.version
+	}
+	if c.err == nil {
+		for _, s := range b.subscribers {
+			s.changed(c)
+		}
+	}
+	fanOut(b.watchers, c)
+}
+
+// watch registers a new watcher for key, first replaying the current state of matching objects when there's no
+// resourceVersion.
+// Only the latest state of each object is known, so watches can't resume from a version older than the latest change
+// to the store's objects: they're expired, and the consumer lists again. Watches from a later version are only sent
+// what's observed after it.
+func (b *broadcaster) watch(ctx context.Context, key string, recursive bool, resourceVersion string, pred storage.SelectionPredicate) (*watcher, error) {
+	since, err := b.store.versioner.ParseResourceVersion(resourceVersion)
+	if err != nil {
+		return nil, apierrors.NewBadRequest(fmt.Sprintf("invalid resource version: %v", err))
+	}
+
+	if err := b.start(ctx); err != nil {
+		return nil, err
+	}
+
+	w := newWatcher(key, recursive, pred, b.store.versioner, b.remove)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if since > 0 && since < b.changed {
+		return nil, apierrors.NewResourceExpired(fmt.Sprintf("too old resource version: %d (%d)", since, b.changed))
+	}
+
+	var initial []change
+	for k, o := range b.objects {
+		if since == 0 && o.obj != nil && w.interested(k) {
+			// Start from the current state of the world
+			initial = append(initial, change{key: k, cur: o.obj})
+		}
+	}
+	b.watchers[w] = since
+
+	go w.run(ctx, initial)
+
+	return w, nil
+}
+
+func (b *broadcaster) remove(w *watcher) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	delete(b.watchers, w)
+}
+
+// watcher translates changes into watch events for a key, or all keys below it when recursive.
+type watcher struct {
+	key       string
+	recursive bool
+	pred      storage.SelectionPredicate
+	versioner storage.Versioner
+
+	incoming chan change
+	result   chan watch.Event
+	done     chan struct{}
+	stopOnce sync.Once
+	remove   func(*watcher)
+}
+
+var _ watch.Interface = &watcher{}
+
+// newWatcher returns a watcher for key, or all keys below it when recursive, that's removed from whatever sends it
+// changes when stopped.
+func newWatcher(key string, recursive bool, pred storage.SelectionPredicate, versioner storage.Versioner, remove func(*watcher)) *watcher {
+	if recursive && !strings.HasSuffix(key, "/") {
+		key += "/"
+	}
+
+	return &watcher{
+		key:       key,
+		recursive: recursive,
+		pred:      pred,
+		versioner: versioner,
+		incoming:  make(chan change, incomingBufSize),
+		result:    make(chan watch.Event, outgoingBufSize),
+		done:      make(chan struct{}),
+		remove:    remove,
+	}
+}
+
+// fanOut sends a change to every interested watcher that started before it, stopping any watcher that can't keep up.
+// Callers must hold the lock guarding watchers.
+func fanOut(watchers map[*watcher]uint64, c change) {
+	for w, since := range watchers {
+		if c.version <= since || !w.interested(c.key) {
+			continue
+		}
+
+		select {
+		case w.incoming <- c:
+		default:
+			// Too slow, make the consumer start over
+			delete(watchers, w)
+			w.stop()
+		}
+	}
+}
+
+func (w *watcher) ResultChan() <-chan watch.Event {
+	return w.result
+}
+
+func (w *watcher) Stop() {
+	w.remove(w)
+	w.stop()
+}
+
+func (w *watcher) stop() {
+	w.stopOnce.Do(func() {
+		close(w.done)
+	})
+}
+
+func (w *watcher) interested(key string) bool {
+	if w.recursive {
+		return strings.HasPrefix(key, w.key)
+	}
+
+	return key == w.key
+}
+
+func (w *watcher) run(ctx context.Context, initial []change) {
+	defer close(w.result)
+	defer w.Stop()
+
+	send := func(c change) bool {
+		event := w.transform(c)
+		if event == nil {
+			return true
+		}
+
+		select {
+		case w.result <- *event:
+			return true
+		case <-w.done:
+		case <-ctx.Done():
+		}
+
+		return false
+	}
+
+	for _, c := range initial {
+		if !send(c) {
+			return
+		}
+	}
+
+	for {
+		select {
+		case c := <-w.incoming:
+			if !send(c) {
+				return
+			}
+		case <-w.done:
+			return
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// transform returns the event a change amounts to for the watcher's predicate, or nil if there's nothing to send.
+func (w *watcher) transform(c change) *watch.Event {
+	if c.err != nil {
+		err := c.err
+		if _, ok := err.(apierrors.APIStatus); !ok {
+			err = apierrors.NewInternalError(err)
+		}
+		status := err.(apierrors.APIStatus).Status()
+
+		return &watch.Event{Type: watch.Error, Object: &status}
+	}
+
+	var (
+		curMatches  = c.cur != nil && w.matches(c.cur)
+		prevMatches = c.prev != nil && w.matches(c.prev)
+	)
+	switch {
+	case curMatches && prevMatches:
+		return &watch.Event{Type: watch.Modified, Object: c.cur.DeepCopyObject()}
+	case curMatches:
+		return &watch.Event{Type: watch.Added, Object: c.cur.DeepCopyObject()}
+	case prevMatches:
+		// Either deleted or no longer selected, both look like a deletion to the consumer
+		obj := c.prev.DeepCopyObject()
+		if c.cur != nil {
+			// Report the version the object stopped being selected at
+			if version, err := w.versioner.ObjectResourceVersion(c.cur); err == nil {
+				w.versioner.UpdateObject(obj, version)
+			}
+		} else if c.version > 0 {
+			// Or was deleted at
+			w.versioner.UpdateObject(obj, c.version)
+		}
+
+		return &watch.Event{Type: watch.Deleted, Object: obj}
+	}
+
+	return nil
+}
+
+func (w *watcher) matches(obj runtime.Object) bool {
+	matches, err := w.pred.Matches(obj)
+	return err == nil && matches
+}